@@ -4,9 +4,13 @@ import (
 	"fmt"
 	"github.com/madokast/direct/memory"
 	"github.com/madokast/direct/memory/trace_type"
+	"github.com/madokast/direct/utils"
 	"github.com/madokast/direct/utils/gpm"
 	"github.com/madokast/direct/utils/spin"
+	"github.com/madokast/nopreempt"
 	"runtime"
+	"sync"
+	"sync/atomic"
 )
 
 type SizeType = memory.SizeType
@@ -17,126 +21,531 @@ const KB = memory.KB
 const MB = memory.MB
 const GB = memory.GB
 
-type globalMemoryNameSpace struct{} // like a namespace
-
-var (
-	Global        globalMemoryNameSpace
-	global        memory.Memory
+// Arena is an independent memory with local memories of every M.
+// Collections remember the arena they are made in and free memory to it.
+type Arena struct {
+	id            arenaID
+	memory        memory.Memory
 	locals        []memory.LocalMemory          // mid -> local
 	extraLocals   map[int64]*memory.LocalMemory // mid -> local
 	extraLocalsMu spin.Mutex
+	parent        *Arena         // the arena sharing memory and local memories with a budget. Nil if not a budget
+	budget        *budget        // nil if not a budget
+	region        *Region        // nil if not a region
+	tracer        *memory.Tracer // nil if not traced
+	profiler      *profiler      // nil if the profile rate is 0
+	quarantine    *quarantine    // nil if frees are not checked
+	pressure      *pressure
+	waiters       *allocWaiters // of Ctx allocations
+}
+
+// arenaID is stored in collection headers. 0 for Global
+type arenaID SizeType
+
+const globalArenaID arenaID = 0
+const maxArenaNumber = 1024
+
+var (
+	Global    = &Arena{id: globalArenaID} // the default arena
+	arenas    [maxArenaNumber]atomic.Pointer[Arena]
+	arenasMu  sync.Mutex
+	nextArena = globalArenaID + 1
 )
 
 var localsMaxSize = int64(runtime.NumCPU())
 
-func (g globalMemoryNameSpace) allocPage(pageNumber SizeType, _type trace_type.Type, callerSkip int) (page memory.PageHandler, err error) {
-	var local *memory.LocalMemory = nil
-retry:
-	mp := gpm.DisablePreempt()
-	mid := mp.MID()
-	if mid < localsMaxSize {
-		local = &locals[mid]
-	} else {
-		extraLocalsMu.Lock()
-		local = extraLocals[mid]
-		if local == nil {
-			gpm.EnablePreempt(mp)
-			newLocal := global.NewLocalMemory()
-			extraLocals[mid] = &newLocal
-			extraLocalsMu.Unlock()
-			goto retry
+func init() {
+	arenas[globalArenaID].Store(Global)
+}
+
+// Option configures the memory of an arena in Init and NewArena
+type Option func(*arenaConfig)
+
+type arenaConfig struct {
+	reservedSize      SizeType
+	scavengeThreshold SizeType
+	trace             bool
+	profileRate       SizeType
+	quarantineSize    SizeType
+	softLimit         SizeType
+	hugePages         bool
+	localCacheSize    SizeType
+	backend           memory.Backend
+}
+
+func newArenaConfig(options []Option) (config arenaConfig) {
+	config.trace = memory.Trace
+	config.profileRate = ProfileRate
+	config.localCacheSize = memory.DefaultLocalCacheSize
+	for _, option := range options {
+		option(&config)
+	}
+	return config
+}
+
+// WithReservedSize reserves address space of maxSize. The arena commits totalSize at first and grows up to maxSize
+func WithReservedSize(maxSize SizeType) Option {
+	return func(c *arenaConfig) {
+		c.reservedSize = maxSize
+	}
+}
+
+// WithScavengeThreshold makes the arena give freed memory back to the OS when more than size memory is freed since the last scavenge
+func WithScavengeThreshold(size SizeType) Option {
+	return func(c *arenaConfig) {
+		c.scavengeThreshold = size
+	}
+}
+
+// WithHugePages asks for huge pages backing the memory, by MAP_HUGETLB if the pool of the OS has enough, or else
+// by madvise(MADV_HUGEPAGE). Large runs are aligned to the huge page. Stats tells what is obtained.
+// Memory from MAP_HUGETLB is committed fully even WithReservedSize
+func WithHugePages(on bool) Option {
+	return func(c *arenaConfig) {
+		c.hugePages = on
+	}
+}
+
+// WithLocalCacheSize bounds the size of pages cached in the local memory of each thread. The default is memory.DefaultLocalCacheSize
+func WithLocalCacheSize(size SizeType) Option {
+	return func(c *arenaConfig) {
+		c.localCacheSize = size
+	}
+}
+
+// WithBackend allocates the memory by the backend, e.g. memory.NewHeapBackend() under the race detector.
+// The default is memory.DefaultBackend. A memory WithReservedSize or WithHugePages is mapped by the OS
+func WithBackend(backend memory.Backend) Option {
+	return func(c *arenaConfig) {
+		c.backend = backend
+	}
+}
+
+// WithTrace turns on or off tracing allocations of the arena for leak info. The default is memory.Trace
+func WithTrace(on bool) Option {
+	return func(c *arenaConfig) {
+		c.trace = on
+	}
+}
+
+// NewArena makes and inits an arena besides Global. Free it after use
+func NewArena(totalSize SizeType, options ...Option) *Arena {
+	a, err := registerArena(func(id arenaID) bool { return id != globalArenaID })
+	if err != nil {
+		panic(err.Error())
+	}
+	a.Init(totalSize, options...)
+	return a
+}
+
+// registerArena registers an arena at the first free id accepted
+func registerArena(accept func(id arenaID) bool) (*Arena, error) {
+	arenasMu.Lock()
+	defer arenasMu.Unlock()
+	for i := arenaID(0); i < maxArenaNumber; i++ {
+		id := (nextArena + i) % maxArenaNumber
+		if arenas[id].Load() == nil && accept(id) {
+			a := &Arena{id: id}
+			arenas[id].Store(a)
+			nextArena = (id + 1) % maxArenaNumber
+			return a, nil
+		}
+	}
+	return nil, fmt.Errorf("no free arena id. The max number is %d", maxArenaNumber)
+}
+
+// unregisterArena frees the id of an arena besides Global
+func unregisterArena(a *Arena) {
+	if a.id != globalArenaID {
+		arenasMu.Lock()
+		arenas[a.id].Store(nil)
+		arenasMu.Unlock()
+	}
+}
+
+// arenaOf returns the arena of the id stored in collection headers
+func arenaOf(id arenaID) *Arena {
+	a := arenas[id].Load()
+	if utils.Asserted {
+		if a == nil || a.memory.IsNull() {
+			panic(fmt.Sprintf("arena %d is freed", id))
 		}
-		extraLocalsMu.Unlock()
 	}
+	return a
+}
 
+func (a *Arena) allocPage(pageNumber SizeType, _type trace_type.Type, callerSkip int) (page memory.PageHandler, err error) {
+	if a.region != nil {
+		return a.regionAllocPage(pageNumber, _type, callerSkip+1)
+	}
+	if a.budget != nil {
+		if err = a.budget.charge(pageNumber << memory.BasePageSizeShiftNumber); err != nil {
+			return page, err
+		}
+	}
+	local, mp := a.currentLocal()
 	page, err = local.AllocPage(pageNumber)
 	gpm.EnablePreempt(mp)
+	if err != nil && a.Trim() > 0 {
+		// memory cached by other threads may be enough
+		local, mp = a.currentLocal()
+		page, err = local.AllocPage(pageNumber)
+		gpm.EnablePreempt(mp)
+	}
+	if a.budget != nil && err != nil {
+		a.budget.credit(pageNumber << memory.BasePageSizeShiftNumber)
+	}
 
-	if memory.Trace && err == nil {
+	if a.tracer != nil && err == nil {
 		_, file, line, _ := runtime.Caller(callerSkip)
-		global.Tracer().TraceAlloc(global.PagePointerOf(page), _type, pageNumber*memory.BasePageSize, file, line)
+		a.tracer.TraceAlloc(a.memory.PagePointerOf(page), _type, pageNumber*memory.BasePageSize, file, line)
+	}
+	if a.profiler != nil && err == nil {
+		a.profiler.alloc(a.memory.PagePointerOf(page), pageNumber*memory.BasePageSize, callerSkip+1)
+	}
+	if err == nil {
+		a.pressure.check(a.memory.AllocatedPageNumber())
 	}
 	return page, err
 }
 
-func (g globalMemoryNameSpace) freePage(pageHandler memory.PageHandler) {
-	if memory.Trace {
-		global.Tracer().DeTraceAlloc(global.PagePointerOf(pageHandler))
+func (a *Arena) freePage(pageHandler memory.PageHandler) {
+	if a.region != nil {
+		a.region.forget(a.memory.PagePointerOf(pageHandler))
+		a.parent.freePage(pageHandler)
+		return
+	}
+	if a.tracer != nil {
+		a.tracer.DeTraceAlloc(a.memory.PagePointerOf(pageHandler))
+	}
+	if a.profiler != nil {
+		a.profiler.free(a.memory.PagePointerOf(pageHandler))
+	}
+
+	if a.budget != nil {
+		a.budget.credit(pageHandler.Size())
+	}
+	if a.quarantine != nil {
+		a.release(a.quarantine.put(a.memory.PagePointerOf(pageHandler), pageHandler, pageHandler.Size()))
+		return
 	}
+	local, mp := a.currentLocal()
+	local.FreePage(pageHandler)
+	waiting := a.waiters.waiting()
+	if waiting {
+		local.Flush() // out of reach of waiters otherwise
+	}
+	gpm.EnablePreempt(mp)
+	if waiting {
+		a.waiters.wake()
+	}
+	a.pressure.check(a.memory.AllocatedPageNumber())
+}
 
-	var local *memory.LocalMemory
+// allocSmall allocates an object not larger than memory.MaxSmallObjectSize. Returns the object and its real size
+func (a *Arena) allocSmall(size SizeType, _type trace_type.Type, callerSkip int) (ptr memory.Pointer, realSize SizeType, err error) {
+	if a.region != nil {
+		return a.regionAllocSmall(size, _type, callerSkip+1)
+	}
+	if a.budget != nil {
+		if err = a.budget.charge(memory.SmallObjectSize(size)); err != nil {
+			return ptr, realSize, err
+		}
+	}
+	local, mp := a.currentLocal()
+	ptr, realSize, err = local.AllocSmall(size)
+	gpm.EnablePreempt(mp)
+	if err != nil && a.Trim() > 0 {
+		// memory cached by other threads may be enough
+		local, mp = a.currentLocal()
+		ptr, realSize, err = local.AllocSmall(size)
+		gpm.EnablePreempt(mp)
+	}
+	if a.budget != nil && err != nil {
+		a.budget.credit(memory.SmallObjectSize(size))
+	}
+
+	if a.tracer != nil && err == nil {
+		_, file, line, _ := runtime.Caller(callerSkip)
+		a.tracer.TraceAlloc(ptr, _type, realSize, file, line)
+	}
+	if a.profiler != nil && err == nil {
+		a.profiler.alloc(ptr, realSize, callerSkip+1)
+	}
+	if err == nil {
+		a.pressure.check(a.memory.AllocatedPageNumber())
+	}
+	return ptr, realSize, err
+}
+
+func (a *Arena) freeSmall(ptr memory.Pointer) {
+	if a.region != nil {
+		a.region.forget(ptr)
+		a.parent.freeSmall(ptr)
+		return
+	}
+	if a.tracer != nil {
+		a.tracer.DeTraceAlloc(ptr)
+	}
+	if a.profiler != nil {
+		a.profiler.free(ptr)
+	}
+
+	if a.budget != nil {
+		a.budget.credit(a.memory.SmallObjectSizeOf(ptr))
+	}
+	if a.quarantine != nil {
+		a.release(a.quarantine.put(ptr, memory.SmallObjectPageHandler, a.memory.SmallObjectSizeOf(ptr)))
+		return
+	}
+	local, mp := a.currentLocal()
+	local.FreeSmall(ptr)
+	waiting := a.waiters.waiting()
+	if waiting {
+		local.Flush()
+	}
+	gpm.EnablePreempt(mp)
+	if waiting {
+		a.waiters.wake()
+	}
+	a.pressure.check(a.memory.AllocatedPageNumber())
+}
+
+// release checks memory leaving the quarantine and frees it for reuse
+func (a *Arena) release(evicted []quarantined) {
+	if len(evicted) == 0 {
+		return
+	}
+	for i := range evicted {
+		evicted[i].check() // may panic, so before preempt disabled
+	}
+	local, mp := a.currentLocal()
+	defer gpm.EnablePreempt(mp)
+	for i := range evicted {
+		if evicted[i].page == memory.SmallObjectPageHandler {
+			local.FreeSmall(evicted[i].ptr)
+		} else {
+			local.FreePage(evicted[i].page)
+		}
+	}
+}
+
+// allocObject allocates byteSize bytes by allocSmall if small enough, else by pages.
+// Returns the memory, its real size and the handler for freeObject
+func (a *Arena) allocObject(byteSize SizeType, _type trace_type.Type, callerSkip int) (ptr memory.Pointer, realSize SizeType, pageHandler memory.PageHandler, err error) {
+	if byteSize <= memory.MaxSmallObjectSize {
+		ptr, realSize, err = a.allocSmall(byteSize, _type, callerSkip+1)
+		if err == nil {
+			return ptr, realSize, memory.SmallObjectPageHandler, nil
+		}
+		if _, ok := err.(*QuotaExceededError); ok {
+			return memory.NullPointer, 0, memory.PageHandler(0), err
+		}
+		// no room for a new slab span. Try a page
+	}
+	pageNumber := (byteSize + memory.BasePageSize - 1) >> memory.BasePageSizeShiftNumber
+	pageHandler, err = a.allocPage(pageNumber, _type, callerSkip+1)
+	if err != nil {
+		return memory.NullPointer, 0, memory.PageHandler(0), err
+	}
+	return a.memory.PagePointerOf(pageHandler), pageHandler.Size(), pageHandler, nil
+}
+
+// freeObject frees the memory from allocObject
+func (a *Arena) freeObject(ptr memory.Pointer, pageHandler memory.PageHandler) {
+	if pageHandler == memory.SmallObjectPageHandler {
+		a.freeSmall(ptr)
+	} else {
+		a.freePage(pageHandler)
+	}
+}
+
+// currentLocal returns the local memory of current M with preempt disabled. Call gpm.EnablePreempt(mp) after use
+func (a *Arena) currentLocal() (local *memory.LocalMemory, mp nopreempt.MP) {
+	if utils.Asserted {
+		if a.memory.IsNull() {
+			panic("use an un-init arena")
+		}
+	}
+	if a.parent != nil {
+		return a.parent.currentLocal()
+	}
 retry:
-	mp := gpm.DisablePreempt()
+	mp = gpm.DisablePreempt()
 	mid := mp.MID()
 	if mid < localsMaxSize {
-		local = &locals[mid]
+		local = &a.locals[mid]
 	} else {
-		extraLocalsMu.Lock()
-		local = extraLocals[mid]
+		a.extraLocalsMu.Lock()
+		local = a.extraLocals[mid]
 		if local == nil {
 			gpm.EnablePreempt(mp)
-			newLocal := global.NewLocalMemory()
-			extraLocals[mid] = &newLocal
-			extraLocalsMu.Unlock()
+			newLocal := a.locals[0].NewLocalMemory()
+			a.extraLocals[mid] = &newLocal
+			a.extraLocalsMu.Unlock()
 			goto retry
 		}
-		extraLocalsMu.Unlock()
+		a.extraLocalsMu.Unlock()
 	}
-	local.FreePage(pageHandler)
-	gpm.EnablePreempt(mp)
+	return local, mp
+}
+
+// Trim returns memory cached in local memories of all threads to the global free lists. Returns the size returned.
+// It is called automatically before OOM. Thread-safe. A budget trims its parent
+func (a *Arena) Trim() SizeType {
+	if a.parent != nil {
+		return a.parent.Trim()
+	}
+	var trimmed SizeType = 0
+	for i := range a.locals {
+		trimmed += a.locals[i].Flush()
+	}
+	a.extraLocalsMu.Lock()
+	for mid := range a.extraLocals {
+		trimmed += a.extraLocals[mid].Flush()
+	}
+	a.extraLocalsMu.Unlock()
+	return trimmed
 }
 
-func (g globalMemoryNameSpace) pagePointerOf(pageHandler memory.PageHandler) memory.Pointer {
-	return global.PagePointerOf(pageHandler)
+// flushLocals returns memory cached in local memories and the quarantine. No goroutine should use the arena meanwhile
+func (a *Arena) flushLocals() {
+	if a.quarantine != nil {
+		a.release(a.quarantine.drain())
+	}
+	a.Trim()
 }
 
-func (g globalMemoryNameSpace) freePointer(ptr memory.Pointer, pageNumber SizeType) {
-	index := global.PointerToPageIndex(ptr)
+func (a *Arena) pagePointerOf(pageHandler memory.PageHandler) memory.Pointer {
+	return a.memory.PagePointerOf(pageHandler)
+}
+
+func (a *Arena) freePointer(ptr memory.Pointer, pageNumber SizeType) {
+	index := a.memory.PointerToPageIndex(ptr)
 	pageHandler := memory.MakePageHandler(pageNumber, index)
-	g.freePage(pageHandler)
+	a.freePage(pageHandler)
 }
 
-func (g globalMemoryNameSpace) Init(totalSize SizeType) {
-	if !global.IsNull() {
-		panic("global memory has been initialized")
+func (a *Arena) Init(totalSize SizeType, options ...Option) {
+	if !a.memory.IsNull() {
+		panic("arena memory has been initialized")
 	}
-	global = memory.New(totalSize)
-	locals = make([]memory.LocalMemory, localsMaxSize)
-	extraLocals = map[int64]*memory.LocalMemory{}
+	config := newArenaConfig(options)
+	if config.hugePages {
+		a.memory = memory.NewHugePages(totalSize, config.reservedSize)
+	} else if config.reservedSize > 0 {
+		a.memory = memory.NewReserved(totalSize, config.reservedSize)
+	} else {
+		a.memory = memory.New(totalSize, config.backend)
+	}
+	a.initLocals(config)
+}
+
+// initLocals makes local memories after the memory is set
+func (a *Arena) initLocals(config arenaConfig) {
+	setArenaBase(a.id, a.memory)
+	if config.trace {
+		a.tracer = a.memory.StartTrace()
+	} else {
+		a.memory.StopTrace()
+	}
+	a.profiler = nil
+	if config.profileRate > 0 {
+		a.profiler = newProfiler(config.profileRate)
+	}
+	a.quarantine = nil
+	if config.quarantineSize > 0 {
+		a.quarantine = newQuarantine(config.quarantineSize, a.memory)
+	}
+	a.pressure = newPressure(a.memory.TotalSize(), config.softLimit)
+	a.waiters = &allocWaiters{}
+	if config.scavengeThreshold > 0 {
+		a.memory.SetScavengeThreshold(config.scavengeThreshold)
+	}
+	a.locals = make([]memory.LocalMemory, localsMaxSize)
+	a.extraLocals = map[int64]*memory.LocalMemory{}
 
 	for i := int64(0); i < localsMaxSize; i++ {
-		locals[i] = global.NewLocalMemory()
+		a.locals[i] = a.memory.NewLocalMemory()
+		a.locals[i].SetMaxCachedSize(config.localCacheSize)
 	}
 }
 
-func (g globalMemoryNameSpace) Free() {
-	if global.IsNull() {
-		panic("free an un-init global memory")
+// Free releases the memory of the arena. An arena from NewArena cannot be used after Free.
+// A file-backed arena is written back and closed
+func (a *Arena) Free() {
+	if a.memory.IsNull() {
+		panic("free an un-init arena memory")
+	}
+	if a.region != nil {
+		a.region.Close()
+		return
 	}
-	for i := range locals {
-		locals[i].Destroy()
+	if a.parent != nil {
+		a.freeBudget()
+		return
 	}
-	for mid := range extraLocals {
-		extraLocals[mid].Destroy()
+	if a.quarantine != nil {
+		a.release(a.quarantine.drain())
+		a.quarantine.free()
 	}
-	locals = nil
-	extraLocals = nil
+	for i := range a.locals {
+		a.locals[i].Destroy()
+	}
+	for mid := range a.extraLocals {
+		a.extraLocals[mid].Destroy()
+	}
+	a.locals = nil
+	a.extraLocals = nil
 
-	allocatedPageNumber := global.AllocatedPageNumber()
-	if allocatedPageNumber > 0 {
+	allocatedPageNumber := a.memory.AllocatedPageNumber()
+	if allocatedPageNumber > 0 && !a.memory.FileBacked() {
 		fmt.Printf("memory leak %s\n", memory.HumanFriendlyMemorySize(allocatedPageNumber<<memory.BasePageSizeShiftNumber))
-		if memory.Trace {
-			fmt.Println(global.MemoryLeakInfo())
+		if a.tracer != nil {
+			fmt.Println(a.memory.MemoryLeakInfo())
 		}
 	}
-	global.Free()
-	global = memory.NullMemory
+	a.memory.Free()
+	a.memory = memory.NullMemory
+	a.tracer = nil
+	a.profiler = nil
+	a.quarantine = nil
+	a.pressure = nil
+	a.waiters = nil
+	setArenaBase(a.id, memory.NullMemory)
+	unregisterArena(a)
+}
+
+// Traced reports whether allocations of the arena are traced. See WithTrace
+func (a *Arena) Traced() bool {
+	return a.tracer != nil
+}
+
+func (a *Arena) IsMemoryLeak() bool {
+	return a.memory.IsMemoryLeak()
+}
+
+func (a *Arena) MemoryLeakInfo() string {
+	return a.memory.MemoryLeakInfo()
+}
+
+// Scavenge gives the physical memory of freed pages back to the OS. Returns the released size.
+// Pages cached in local memories are not released
+func (a *Arena) Scavenge() SizeType {
+	return a.memory.Scavenge()
+}
+
+// ScavengedSize is the total size given back to the OS
+func (a *Arena) ScavengedSize() SizeType {
+	return a.memory.ScavengedSize()
 }
 
-func (g globalMemoryNameSpace) IsMemoryLeak() bool {
-	return global.IsMemoryLeak()
+// CommittedSize is the accessible size of the arena. It grows with WithReservedSize
+func (a *Arena) CommittedSize() SizeType {
+	return a.memory.CommittedSize()
 }
 
-func (g globalMemoryNameSpace) MemoryLeakInfo() string {
-	return global.MemoryLeakInfo()
+// AllocatedPageNumber includes pages cached in local memories
+func (a *Arena) AllocatedPageNumber() SizeType {
+	return a.memory.AllocatedPageNumber()
 }
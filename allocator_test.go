@@ -2,7 +2,10 @@ package direct
 
 import (
 	"github.com/madokast/direct/memory"
+	"github.com/madokast/direct/memory/trace_type"
 	"github.com/madokast/direct/utils"
+	"runtime"
+	"sync"
 	"testing"
 )
 
@@ -44,7 +47,7 @@ func BenchmarkGoAlloc(b *testing.B) {
 }
 
 func BenchmarkLocalMemory(b *testing.B) {
-	global := memory.New(1024 * 1024)
+	global := memory.New(1024*1024, nil)
 	local := global.NewLocalMemory()
 	var err error
 	b.ResetTimer()
@@ -70,3 +73,159 @@ func BenchmarkGlobalMemory(b *testing.B) {
 	b.StopTimer()
 	Global.Free()
 }
+
+func TestNewArena(t *testing.T) {
+	Global.Init(1 * memory.MB)
+	defer Global.Free()
+	arena := NewArena(1 * memory.MB)
+	utils.Assert(arena.id != globalArenaID)
+	utils.Assert(arenaOf(arena.id) == arena)
+
+	s := utils.PanicErr1(MakeSliceIn[int](arena, 10))
+	for i := 0; i < 1000; i++ {
+		utils.PanicErr(s.Append(i)) // grows in the arena
+	}
+	m := utils.PanicErr1(MakeMapIn[int, int](arena, 10))
+	for i := 0; i < 1000; i++ {
+		utils.PanicErr(m.Put(i, i))
+	}
+	st := utils.PanicErr1(MakeStackIn[int](arena))
+	for i := 0; i < 1000; i++ {
+		utils.PanicErr(st.Push(i))
+	}
+	sf := NewStringFactoryIn(arena)
+	str := utils.PanicErr1(sf.CreateFromGoString("hello"))
+	cp := utils.PanicErr1(s.Copy())
+
+	utils.Assert(Global.AllocatedPageNumber() == 0, Global.AllocatedPageNumber())
+	utils.Assert(arena.AllocatedPageNumber() > 0)
+	utils.Assert(cp.Get(999) == 999)
+	utils.Assert(m.Get(999) == 999)
+	utils.Assert(str.String() == "hello")
+
+	cp.Free()
+	str.Free()
+	sf.Destroy()
+	st.Free()
+	m.Free()
+	s.Free()
+	utils.Assert(!arena.IsMemoryLeak(), arena.MemoryLeakInfo())
+	arena.Free()
+	utils.Assert(arenas[arena.id].Load() == nil)
+}
+
+func TestNewArena_parallel(t *testing.T) {
+	wg := sync.WaitGroup{}
+	for k := 0; k < 8; k++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			arena := NewArena(1 * memory.MB)
+			defer arena.Free()
+			for i := 0; i < 100; i++ {
+				s := utils.PanicErr1(MakeSliceIn[int](arena, 1))
+				for j := 0; j < 100; j++ {
+					utils.PanicErr(s.Append(j))
+				}
+				s.Free()
+			}
+			utils.Assert(!arena.IsMemoryLeak(), arena.MemoryLeakInfo())
+		}()
+	}
+	wg.Wait()
+}
+
+func TestArena_reserved(t *testing.T) {
+	arena := NewArena(1*memory.MB, WithReservedSize(1*memory.GB))
+	defer arena.Free()
+
+	s := utils.PanicErr1(MakeSliceIn[int](arena, 10))
+	for i := 0; i < 10*1024*1024; i++ {
+		utils.PanicErr(s.Append(i)) // 80MB
+	}
+	utils.Assert(arena.CommittedSize() > 80*memory.MB, arena.CommittedSize())
+	utils.Assert(arena.CommittedSize() < 1*memory.GB, arena.CommittedSize())
+	s.Free()
+}
+
+func TestWithHugePages(t *testing.T) {
+	arena := NewArena(16*memory.MB, WithHugePages(true), WithReservedSize(256*memory.MB))
+	defer arena.Free()
+
+	s := utils.PanicErr1(MakeSliceIn[int](arena, 10))
+	for i := 0; i < 4*1024*1024; i++ {
+		utils.PanicErr(s.Append(i)) // 32MB
+	}
+	utils.Assert(s.pointer()%memory.Pointer(memory.HugePageSize) == 0, s.pointer()) // the page is aligned
+	stats := arena.Stats()
+	t.Log(stats.HugePages, memory.HumanFriendlyMemorySize(stats.HugePageBacked))
+	if runtime.GOOS == "linux" {
+		utils.Assert(stats.HugePages != memory.HugePagesNone)
+	}
+	utils.PanicErr(arena.Verify())
+	s.Free()
+}
+
+func TestArena_Trim(t *testing.T) {
+	arena := NewArena(32*memory.MB, WithLocalCacheSize(16*memory.MB))
+	defer arena.Free()
+
+	// cache 12MB in the local memory of another thread
+	cached, release := make(chan struct{}), make(chan struct{})
+	go func() {
+		runtime.LockOSThread()
+		defer runtime.UnlockOSThread()
+		var pages []memory.PageHandler
+		for i := 0; i < 12; i++ {
+			pages = append(pages, utils.PanicErr1(arena.allocPage(memory.MB>>memory.BasePageSizeShiftNumber, trace_type.Slice, 1)))
+		}
+		for _, page := range pages {
+			arena.freePage(page)
+		}
+		cached <- struct{}{}
+		<-release
+	}()
+	<-cached
+	defer close(release)
+	utils.Assert(arena.Stats().AllocatedSize >= 12*memory.MB, arena.Stats().AllocatedSize)
+
+	// trimmed before OOM
+	page := utils.PanicErr1(arena.allocPage(24*memory.MB>>memory.BasePageSizeShiftNumber, trace_type.Slice, 1))
+	arena.freePage(page)
+	utils.Assert(arena.Trim() <= 16*memory.MB)
+	for _, size := range arena.Stats().LocalCachedSizes {
+		utils.Assert(size == 0, size)
+	}
+	utils.Assert(arena.Stats().AllocatedSize == 0, arena.Stats().AllocatedSize)
+}
+
+func TestArena_Scavenge(t *testing.T) {
+	arena := NewArena(256*memory.MB, WithScavengeThreshold(8*memory.MB))
+	defer arena.Free()
+
+	s := utils.PanicErr1(MakeSliceIn[int](arena, 10))
+	for i := 0; i < 4*1024*1024; i++ {
+		utils.PanicErr(s.Append(i)) // 32MB
+	}
+	s.Free()
+	arena.Scavenge()
+	t.Log(arena.ScavengedSize())
+	if runtime.GOOS == "linux" {
+		utils.Assert(arena.ScavengedSize() > 16*memory.MB, arena.ScavengedSize())
+	}
+}
+
+func TestWithBackend(t *testing.T) {
+	heap := memory.NewHeapBackend()
+	arena := NewArena(4*memory.MB, WithBackend(heap))
+	utils.Assert(heap.AllocatedSize() > 4*memory.MB, heap.AllocatedSize())
+
+	s := utils.PanicErr1(MakeSliceIn[int](arena, 10))
+	for i := 0; i < 1000; i++ {
+		utils.PanicErr(s.Append(i))
+	}
+	utils.Assert(s.Get(999) == 999)
+	s.Free()
+	arena.Free()
+	utils.Assert(heap.AllocatedSize() == 0, heap.AllocatedSize())
+}
@@ -0,0 +1,99 @@
+package direct
+
+import (
+	"fmt"
+	"github.com/madokast/direct/memory"
+	"sync/atomic"
+)
+
+/**
+A budget caps the memory taken by a subsystem in an arena. It is an arena sharing the memory and local memories
+of its parent, so collections made in it keep the budget when they grow.
+Allocations are charged in allocPage and allocSmall and credited when freed, even if freed memory stays in local caches.
+Budgets are not kept in files and snapshots, so do not make persistent collections in a budget.
+*/
+
+type budget struct {
+	name  string
+	limit SizeType
+	used  atomic.Int64
+}
+
+// QuotaExceededError is returned when an allocation exceeds the budget before the arena is out of memory
+type QuotaExceededError struct {
+	budget string
+	limit  SizeType
+	used   SizeType
+	size   SizeType
+}
+
+func (e *QuotaExceededError) Error() string {
+	return fmt.Sprintf("quota of budget %s exceeded when alloc %s. The limit is %s and %s is used", e.budget,
+		memory.HumanFriendlyMemorySize(e.size), memory.HumanFriendlyMemorySize(e.limit), memory.HumanFriendlyMemorySize(e.used))
+}
+
+// NewBudget makes a budget of limit bytes in the arena. Make collections in the returned arena.
+// Free it after its collections are freed. Other memory of the arena is the remainder
+func (a *Arena) NewBudget(name string, limit SizeType) (*Arena, error) {
+	if a.memory.IsNull() {
+		panic("make a budget of an un-init arena")
+	}
+	if a.region != nil {
+		return nil, fmt.Errorf("budget %s cannot be made in region %s", name, a.region.name)
+	}
+	if a.parent != nil {
+		return nil, fmt.Errorf("budget %s cannot be nested in budget %s", name, a.budget.name)
+	}
+	b, err := registerArena(func(id arenaID) bool { return id != globalArenaID })
+	if err != nil {
+		return nil, err
+	}
+	b.memory = a.memory
+	b.parent = a
+	b.budget = &budget{name: name, limit: limit}
+	b.tracer = a.tracer
+	b.profiler = a.profiler
+	b.quarantine = a.quarantine
+	b.pressure = a.pressure
+	b.waiters = a.waiters
+	setArenaBase(b.id, b.memory)
+	return b, nil
+}
+
+// BudgetUsed returns bytes taken by collections of the budget. 0 if the arena is not a budget
+func (a *Arena) BudgetUsed() SizeType {
+	if a.budget == nil {
+		return 0
+	}
+	return SizeType(a.budget.used.Load())
+}
+
+// charge takes size from the budget. Returns QuotaExceededError if over the limit
+func (b *budget) charge(size SizeType) error {
+	used := SizeType(b.used.Add(int64(size)))
+	if used > b.limit {
+		b.used.Add(-int64(size))
+		return &QuotaExceededError{budget: b.name, limit: b.limit, used: used - size, size: size}
+	}
+	return nil
+}
+
+func (b *budget) credit(size SizeType) {
+	b.used.Add(-int64(size))
+}
+
+// freeBudget unregisters the budget. Its memory is kept by the parent
+func (a *Arena) freeBudget() {
+	if used := a.BudgetUsed(); used > 0 {
+		fmt.Printf("budget %s leak %s\n", a.budget.name, memory.HumanFriendlyMemorySize(used))
+	}
+	setArenaBase(a.id, memory.NullMemory)
+	a.memory = memory.NullMemory
+	a.parent = nil
+	a.tracer = nil
+	a.profiler = nil
+	a.quarantine = nil
+	a.pressure = nil
+	a.waiters = nil
+	unregisterArena(a)
+}
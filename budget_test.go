@@ -0,0 +1,71 @@
+package direct
+
+import (
+	"errors"
+	"github.com/madokast/direct/memory"
+	"github.com/madokast/direct/utils"
+	"sync"
+	"testing"
+)
+
+func TestArena_NewBudget(t *testing.T) {
+	arena := NewArena(16 * memory.MB)
+	defer arena.Free()
+	cache := utils.PanicErr1(arena.NewBudget("cache", 1*memory.MB))
+	_, err := cache.NewBudget("nested", 1*memory.MB)
+	utils.Assert(err != nil)
+
+	s := utils.PanicErr1(MakeSliceIn[int](cache, 10))
+	for err = nil; err == nil; {
+		err = s.Append(1) // grows in the budget
+	}
+	var quotaExceededError *QuotaExceededError
+	utils.Assert(errors.As(err, &quotaExceededError), err)
+	t.Log(err)
+	utils.Assert(cache.BudgetUsed() > 512*memory.KB && cache.BudgetUsed() <= 1*memory.MB, cache.BudgetUsed())
+
+	other := utils.PanicErr1(MakeSliceIn[int](arena, 512*1024)) // 4MB of the remainder
+	s.Free()
+	utils.Assert(cache.BudgetUsed() == 0, cache.BudgetUsed())
+	m := utils.PanicErr1(MakeMapIn[int, int](cache, 1))
+	utils.PanicErr(m.Put(1, 1))
+	sf := NewStringFactoryIn(cache)
+	str := utils.PanicErr1(sf.CreateFromGoString("hello")) // a small object
+	sf.Destroy()
+	utils.Assert(cache.BudgetUsed() > 0)
+	str.Free()
+	m.Free()
+	utils.Assert(cache.BudgetUsed() == 0, cache.BudgetUsed()) // freed memory in local caches is credited
+	utils.Assert(arena.BudgetUsed() == 0)
+	other.Free()
+	cache.Free()
+	utils.Assert(arenas[cache.id].Load() == nil)
+	utils.Assert(!arena.IsMemoryLeak(), arena.MemoryLeakInfo())
+}
+
+func TestArena_NewBudget_parallel(t *testing.T) {
+	arena := NewArena(64 * memory.MB)
+	defer arena.Free()
+	cache := utils.PanicErr1(arena.NewBudget("cache", 4*memory.MB))
+	defer cache.Free()
+
+	wg := sync.WaitGroup{}
+	for k := 0; k < 8; k++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 100; i++ {
+				s, err := MakeSliceIn[int](cache, 16*1024) // 128KB
+				if err != nil {
+					var quotaExceededError *QuotaExceededError
+					utils.Assert(errors.As(err, &quotaExceededError), err)
+					continue
+				}
+				utils.Assert(cache.BudgetUsed() <= 4*memory.MB)
+				s.Free()
+			}
+		}()
+	}
+	wg.Wait()
+	utils.Assert(cache.BudgetUsed() == 0, cache.BudgetUsed())
+}
@@ -0,0 +1,172 @@
+package direct
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/madokast/direct/memory"
+	"github.com/madokast/direct/memory/trace_type"
+	"io"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync/atomic"
+)
+
+/**
+A heap dump lists objects alive in a traced arena with their allocation sites, and the ownership among them.
+Headers of collections are followed to what they own: the table of a map and the nodes of a stack.
+Tables and nodes are not traced for speed unless asserted, so they are found from their owners and have no site.
+A String holder of a StringFactory is pinned by Strings in the go heap. Their number is its reference count.
+*/
+
+// HeapNode is an object in a heap dump
+type HeapNode struct {
+	memory.HeapObject
+	References int32 // to a String holder, including the factory. 0 for others
+}
+
+// HeapEdge means the object at From owns the object at To
+type HeapEdge struct {
+	From  memory.Pointer
+	To    memory.Pointer
+	Label string
+}
+
+// HeapDump is a snapshot of objects alive in an arena. Made by Arena.HeapDump
+type HeapDump struct {
+	Nodes         []HeapNode // sorted by address
+	Edges         []HeapEdge
+	AllocatedSize SizeType // of all allocated pages, including objects not traced and memory cached in local memories
+	Partial       bool     // objects allocated before tracing, or by other processes sharing the file, are not in Nodes
+}
+
+// HeapDump walks objects alive in the arena. Error if the arena is not traced. See WithTrace.
+// No goroutine should use the arena meanwhile. A budget dumps its parent
+func (a *Arena) HeapDump() (*HeapDump, error) {
+	if a.parent != nil {
+		return a.parent.HeapDump()
+	}
+	if a.tracer == nil {
+		return nil, errors.New("heap dump needs the arena traced. Turn on by WithTrace")
+	}
+	dump := &HeapDump{
+		AllocatedSize: a.memory.AllocatedPageNumber() << memory.BasePageSizeShiftNumber,
+		Partial:       a.tracer.Partial(),
+	}
+	index := map[memory.Pointer]int{}
+	for _, object := range a.tracer.HeapObjects() {
+		index[object.Address] = len(dump.Nodes)
+		dump.Nodes = append(dump.Nodes, HeapNode{HeapObject: object})
+	}
+	// an owned object not traced is added
+	own := func(from, to memory.Pointer, label string, _type trace_type.Type, size SizeType) {
+		if _, ok := index[to]; !ok {
+			index[to] = len(dump.Nodes)
+			dump.Nodes = append(dump.Nodes, HeapNode{HeapObject: memory.HeapObject{
+				Address: to, PageIndex: a.memory.PageIndexOf(to), Size: size, Type: _type}})
+		}
+		dump.Edges = append(dump.Edges, HeapEdge{From: from, To: to, Label: label})
+	}
+	for i, tracedNumber := 0, len(dump.Nodes); i < tracedNumber; i++ {
+		node := &dump.Nodes[i]
+		ptr := node.Address
+		switch {
+		case node.Type == trace_type.MapHeader:
+			// the layout of mapHeader does not depend on its key and value
+			table := memory.PointerAs[mapHeader[SizeType, SizeType]](ptr).table
+			if table != nullSlice {
+				own(ptr, table.pointer(), "table", trace_type.MapTable, a.objectSizeOf(table.pointer(), table.header().pageHandler))
+			}
+		case node.Type == trace_type.StackHeader:
+			header := memory.PointerAs[stackHeader](ptr)
+			// a node has the pages of the header node, or one page if the header node is small
+			nodeSize := memory.BasePageSize
+			if header.headerPageHandler != memory.SmallObjectPageHandler {
+				nodeSize = header.headerPageHandler.Size()
+			}
+			from := ptr
+			for next := deref(header.next); next.IsNotNull(); next = deref(memory.PointerAs[stackNodeHeader](next).next) {
+				own(from, next, "next", trace_type.StackNode, nodeSize)
+				from = next
+			}
+		case strings.HasPrefix(string(node.Type), string(trace_type.StringFactory)):
+			holder := memory.PointerAs[sliceHeader](ptr)
+			node.References = atomic.LoadInt32(memory.PointerAs[int32](holder.elementBasePointer()))
+		}
+	}
+	sort.Slice(dump.Nodes, func(i, j int) bool { return dump.Nodes[i].Address < dump.Nodes[j].Address })
+	return dump, nil
+}
+
+// objectSizeOf is the real size of an object from allocObject
+func (a *Arena) objectSizeOf(ptr memory.Pointer, pageHandler memory.PageHandler) SizeType {
+	if pageHandler == memory.SmallObjectPageHandler {
+		return a.memory.SmallObjectSizeOf(ptr)
+	}
+	return pageHandler.Size()
+}
+
+type heapNodeJSON struct {
+	Address    string          `json:"address"`
+	PageIndex  SizeType        `json:"pageIndex"`
+	Size       SizeType        `json:"size"`
+	Type       trace_type.Type `json:"type"`
+	File       string          `json:"file,omitempty"`
+	Line       int             `json:"line,omitempty"`
+	References int32           `json:"references,omitempty"`
+}
+
+type heapEdgeJSON struct {
+	From  string `json:"from"`
+	To    string `json:"to"`
+	Label string `json:"label"`
+}
+
+// WriteJSON writes nodes and edges as JSON. Addresses are hexadecimal strings
+func (d *HeapDump) WriteJSON(w io.Writer) error {
+	dump := struct {
+		Nodes         []heapNodeJSON `json:"nodes"`
+		Edges         []heapEdgeJSON `json:"edges"`
+		AllocatedSize SizeType       `json:"allocatedSize"`
+		Partial       bool           `json:"partial"`
+	}{
+		Nodes:         make([]heapNodeJSON, 0, len(d.Nodes)),
+		Edges:         make([]heapEdgeJSON, 0, len(d.Edges)),
+		AllocatedSize: d.AllocatedSize,
+		Partial:       d.Partial,
+	}
+	for _, node := range d.Nodes {
+		dump.Nodes = append(dump.Nodes, heapNodeJSON{Address: node.Address.String(), PageIndex: node.PageIndex, Size: node.Size,
+			Type: node.Type, File: node.File, Line: node.Line, References: node.References})
+	}
+	for _, edge := range d.Edges {
+		dump.Edges = append(dump.Edges, heapEdgeJSON{From: edge.From.String(), To: edge.To.String(), Label: edge.Label})
+	}
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(&dump)
+}
+
+// WriteDot writes a Graphviz digraph of the nodes and which owns which. Render it by `dot -Tsvg`
+func (d *HeapDump) WriteDot(w io.Writer) error {
+	bw := bufio.NewWriter(w)
+	_, _ = fmt.Fprintln(bw, "digraph heap {")
+	_, _ = fmt.Fprintln(bw, "  node [shape=box, fontname=monospace];")
+	for _, node := range d.Nodes {
+		label := fmt.Sprintf("%s\n%s\n%s", node.Type, node.Address.String(), memory.HumanFriendlyMemorySize(node.Size))
+		if node.File != "" {
+			label += fmt.Sprintf("\n%s:%d", filepath.Base(node.File), node.Line)
+		}
+		if node.References > 0 {
+			label += fmt.Sprintf("\nreferences %d", node.References)
+		}
+		_, _ = fmt.Fprintf(bw, "  \"%s\" [label=\"%s\"];\n", node.Address.String(), escapeLabel(label))
+	}
+	for _, edge := range d.Edges {
+		_, _ = fmt.Fprintf(bw, "  \"%s\" -> \"%s\" [label=\"%s\"];\n", edge.From.String(), edge.To.String(), escapeLabel(edge.Label))
+	}
+	_, _ = fmt.Fprintln(bw, "}")
+	return bw.Flush()
+}
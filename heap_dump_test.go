@@ -0,0 +1,70 @@
+package direct
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/madokast/direct/memory"
+	"github.com/madokast/direct/memory/trace_type"
+	"github.com/madokast/direct/utils"
+	"os"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+func TestArena_HeapDump(t *testing.T) {
+	arena := NewArena(16*memory.MB, WithTrace(true))
+	defer arena.Free()
+	_, file, line, _ := runtime.Caller(0)
+	m := utils.PanicErr1(MakeMapIn[int, int](arena, 10))
+	defer m.Free()
+	stack := utils.PanicErr1(MakeStackIn[[64]int](arena))
+	defer stack.Free()
+	for i := 0; i < 100; i++ {
+		utils.PanicErr(stack.Push([64]int{i}))
+	}
+	factory := NewStringFactoryIn(arena)
+	s1 := utils.PanicErr1(factory.CreateFromGoString("hello"))
+	s2 := utils.PanicErr1(factory.CreateFromGoString("world"))
+	defer s1.Free()
+	defer s2.Free()
+	defer factory.Destroy()
+
+	dump := utils.PanicErr1(arena.HeapDump())
+	types := map[trace_type.Type]int{}
+	for i, node := range dump.Nodes {
+		utils.Assert(i == 0 || dump.Nodes[i-1].Address < node.Address)
+		if strings.HasPrefix(string(node.Type), string(trace_type.StringFactory)) {
+			utils.Assert(node.References == 3, node) // two strings and the factory
+			node.Type = trace_type.StringFactory
+		}
+		types[node.Type]++
+		if node.Type == trace_type.MapHeader {
+			utils.Assert(node.File == file && node.Line == line+1, node)
+		}
+	}
+	utils.Assert(types[trace_type.MapHeader] == 1 && types[trace_type.MapTable] == 1, types)
+	utils.Assert(types[trace_type.StackHeader] == 1 && types[trace_type.StackNode] == 99, types)
+	utils.Assert(types[trace_type.StringFactory] == 1, types)
+	utils.Assert(len(dump.Edges) == 1+99, len(dump.Edges))
+
+	var buffer bytes.Buffer
+	utils.PanicErr(dump.WriteJSON(&buffer))
+	var decoded map[string]any
+	utils.PanicErr(json.Unmarshal(buffer.Bytes(), &decoded))
+	utils.Assert(len(decoded["nodes"].([]any)) == len(dump.Nodes))
+
+	buffer.Reset()
+	utils.PanicErr(dump.WriteDot(&buffer))
+	dot := buffer.String()
+	utils.Assert(strings.HasPrefix(dot, "digraph heap {") && strings.Count(dot, "->") == len(dump.Edges), dot)
+	utils.Assert(strings.Contains(dot, `[label="table"]`), dot)
+	if path := os.Getenv("DIRECT_HEAP_DUMP"); path != "" {
+		utils.PanicErr(os.WriteFile(path, buffer.Bytes(), 0644))
+	}
+
+	untraced := NewArena(1*memory.MB, WithTrace(false))
+	defer untraced.Free()
+	_, err := untraced.HeapDump()
+	utils.Assert(err != nil)
+}
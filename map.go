@@ -19,13 +19,15 @@ var userDefinedHashEqualFuncSet = map[reflect.Value]int{} // funcVal->objRefCnt
 type mapHeader[Key comparable, Value any] struct {
 	table             Slice[entry[Key, Value]] // hashTable + list
 	tableLength       SizeType
-	tableBasePtr      memory.Pointer
+	tableBase         ref
 	count             SizeType
 	mask              SizeType
 	free              SizeType
-	hash              func(Key) SizeType
+	hash              func(Key) SizeType // nil unless keyKind is customKey
 	equal             func(Key, Key) bool
-	headerPageHandler memory.PageHandler // for free
+	keyKind           SizeType           // functions are process-local, so simple and String keys are hashed without them
+	headerPageHandler memory.PageHandler // for freeObject
+	arena             arenaID            // the arena allocating it
 }
 
 type entry[Key comparable, Value any] struct {
@@ -35,31 +37,57 @@ type entry[Key comparable, Value any] struct {
 }
 
 const nilMap = 0
+
+// keyKind of mapHeader
+const (
+	customKey SizeType = iota // hash and equal functions of the process
+	simpleKey
+	stringKey
+)
 const emptyTableFlag = 0 // a slot in table is empty is entry.next = emptyTableFlag
 const listTailFlag = 1   // a slot is the tail of list if entry.next = listTailFlag
 
 func MakeMap[Key comparable, Value any](capacity SizeType) (Map[Key, Value], error) {
-	if isSimpleType[Key]() {
-		return makeCustomMap0[Key, Value](capacity, simpleHash[Key], simpleEqual[Key], 3)
-	} else if isString[Key]() {
-		return makeCustomMap0[Key, Value](capacity, hashString[Key], equalString[Key], 3)
-	} else {
-		var k Key
-		str := fmt.Sprintf("%T is not simple type. Use MakeCustomMap", k)
-		return nilMap, errors.New(str)
+	return makeMap0[Key, Value](Global, capacity, 4)
+}
+
+// MakeMapIn is MakeMap in the arena
+func MakeMapIn[Key comparable, Value any](arena *Arena, capacity SizeType) (Map[Key, Value], error) {
+	return makeMap0[Key, Value](arena, capacity, 4)
+}
+
+func makeMap0[Key comparable, Value any](arena *Arena, capacity SizeType, traceSkip int) (Map[Key, Value], error) {
+	keyKind, err := defaultKeyKind[Key]()
+	if err != nil {
+		return nilMap, err
 	}
+	return makeCustomMap0[Key, Value](arena, capacity, keyKind, nil, nil, traceSkip)
 }
 
-func MakeMapFromGoMap[Key comparable, Value any](gm map[Key]Value) (m Map[Key, Value], err error) {
+// defaultKeyKind returns the kind of simple types and String
+func defaultKeyKind[Key comparable]() (SizeType, error) {
 	if isSimpleType[Key]() {
-		m, err = makeCustomMap0[Key, Value](SizeType(len(gm)), simpleHash[Key], simpleEqual[Key], 3)
+		return simpleKey, nil
 	} else if isString[Key]() {
-		m, err = makeCustomMap0[Key, Value](SizeType(len(gm)), hashString[Key], equalString[Key], 3)
+		return stringKey, nil
 	} else {
 		var k Key
 		str := fmt.Sprintf("%T is not simple type. Use MakeCustomMap", k)
-		return nilMap, errors.New(str)
+		return customKey, errors.New(str)
 	}
+}
+
+func MakeMapFromGoMap[Key comparable, Value any](gm map[Key]Value) (m Map[Key, Value], err error) {
+	return makeMapFromGoMap0(Global, gm)
+}
+
+// MakeMapFromGoMapIn is MakeMapFromGoMap in the arena
+func MakeMapFromGoMapIn[Key comparable, Value any](arena *Arena, gm map[Key]Value) (m Map[Key, Value], err error) {
+	return makeMapFromGoMap0(arena, gm)
+}
+
+func makeMapFromGoMap0[Key comparable, Value any](arena *Arena, gm map[Key]Value) (m Map[Key, Value], err error) {
+	m, err = makeMap0[Key, Value](arena, SizeType(len(gm)), 5)
 	if err != nil {
 		return nilMap, err
 	}
@@ -70,11 +98,16 @@ func MakeMapFromGoMap[Key comparable, Value any](gm map[Key]Value) (m Map[Key, V
 }
 
 func MakeCustomMap[Key comparable, Value any](capacity SizeType, hash func(Key) SizeType, equal func(key1 Key, key2 Key) bool) (Map[Key, Value], error) {
-	return makeCustomMap0[Key, Value](capacity, hash, equal, 3)
+	return makeCustomMap0[Key, Value](Global, capacity, customKey, hash, equal, 3)
 }
 
-func makeCustomMap0[Key comparable, Value any](capacity SizeType, hash func(Key) SizeType, equal func(Key, Key) bool, traceSkip int) (Map[Key, Value], error) {
-	if utils.Asserted {
+// MakeCustomMapIn is MakeCustomMap in the arena
+func MakeCustomMapIn[Key comparable, Value any](arena *Arena, capacity SizeType, hash func(Key) SizeType, equal func(key1 Key, key2 Key) bool) (Map[Key, Value], error) {
+	return makeCustomMap0[Key, Value](arena, capacity, customKey, hash, equal, 3)
+}
+
+func makeCustomMap0[Key comparable, Value any](arena *Arena, capacity SizeType, keyKind SizeType, hash func(Key) SizeType, equal func(Key, Key) bool, traceSkip int) (Map[Key, Value], error) {
+	if utils.Asserted && keyKind == customKey {
 		if hash == nil {
 			panic("hash function is nil")
 		}
@@ -88,29 +121,36 @@ func makeCustomMap0[Key comparable, Value any](capacity SizeType, hash func(Key)
 	}
 	normalizeCap <<= 1 // enlarge once again because a test encounters capacity expansion.
 
-	table, err := makeSliceWithLength0[entry[Key, Value]](normalizeCap, trace_type.MapTable, traceSkip+2) // <<= 1 for link space
+	table, err := makeSliceWithLength0[entry[Key, Value]](arena, normalizeCap, trace_type.MapTable, traceSkip+2) // <<= 1 for link space
 	if err != nil {
 		return nilMap, err
 	}
-	pageMapHeader, err := Global.allocPage(1, trace_type.MapHeader, traceSkip)
+	ptr, _, pageMapHeader, err := arena.allocObject(memory.Sizeof[mapHeader[Key, Value]](), trace_type.MapHeader, traceSkip)
 	if err != nil {
 		table.Free()
 		return nilMap, err
 	}
-	var theMap = Map[Key, Value](Global.pagePointerOf(pageMapHeader))
+	var theMap = Map[Key, Value](refOf(arena.id, ptr))
 	header := theMap.header()
 
 	header.table = table
 	header.tableLength = normalizeCap
-	header.tableBasePtr = table.header().elementBasePointer
+	header.tableBase = table.header().elementBase
 	header.count = 0
 	header.mask = (normalizeCap >> 1) - 1
 	header.free = normalizeCap >> 1 // do (>>1) for link
 	header.hash = hash
 	header.equal = equal
+	header.keyKind = keyKind
 	header.headerPageHandler = pageMapHeader
+	header.arena = arena.id
 
-	header.hashEqualRefCtrl(1)
+	if keyKind == customKey {
+		header.hashEqualRefCtrl(1)
+		if arena.region != nil { // Close does not call Free
+			arena.region.setFinalizer(ptr, func() { header.hashEqualRefCtrl(-1) })
+		}
+	}
 	return theMap, nil
 }
 
@@ -120,7 +160,7 @@ func (m Map[Key, Value]) Put(k Key, v Value) error {
 		return err
 	}
 	header := m.header()
-	loc := header.hash(k) & header.mask
+	loc := header.hashOf(k) & header.mask
 	slot := header.dataAt(loc)
 	next := slot.next
 	if next == emptyTableFlag {
@@ -132,7 +172,7 @@ func (m Map[Key, Value]) Put(k Key, v Value) error {
 		header.count++
 		return nil
 	} else if next == listTailFlag { // only one, no link
-		if header.equal(slot.key, k) { // replace
+		if header.equals(slot.key, k) { // replace
 			slot.value = v
 		} else { // add link
 			slot.next = header.free
@@ -146,13 +186,13 @@ func (m Map[Key, Value]) Put(k Key, v Value) error {
 		}
 		return nil
 	} else { // has next
-		if header.equal(slot.key, k) {
+		if header.equals(slot.key, k) {
 			slot.value = v // replace
 			return nil
 		} else {
 			for {
 				slot = header.dataAt(next)
-				if header.equal(slot.key, k) { // replace
+				if header.equals(slot.key, k) { // replace
 					slot.value = v
 					return nil
 				}
@@ -180,7 +220,7 @@ func (m Map[Key, Value]) DirectPut(k Key, v Value) error {
 		return err
 	}
 	header := m.header()
-	loc := header.hash(k) & header.mask
+	loc := header.hashOf(k) & header.mask
 	slot := header.dataAt(loc)
 	next := slot.next
 	if next == emptyTableFlag { // empty
@@ -193,7 +233,7 @@ func (m Map[Key, Value]) DirectPut(k Key, v Value) error {
 		return nil
 	} else if next == listTailFlag { // only one, no link
 		if utils.Asserted {
-			if header.equal(slot.key, k) {
+			if header.equals(slot.key, k) {
 				panic(fmt.Sprintf("DirectPut faces duplicated key %v value %v, %v", slot.key, slot.value, v))
 			}
 		}
@@ -208,14 +248,14 @@ func (m Map[Key, Value]) DirectPut(k Key, v Value) error {
 		return nil
 	} else { // has next
 		if utils.Asserted {
-			if header.equal(slot.key, k) {
+			if header.equals(slot.key, k) {
 				panic(fmt.Sprintf("DirectPut faces duplicated key %v value %v, %v", slot.key, slot.value, v))
 			}
 		}
 		for {
 			slot = header.dataAt(next)
 			if utils.Asserted {
-				if header.equal(slot.key, k) {
+				if header.equals(slot.key, k) {
 					panic(fmt.Sprintf("DirectPut faces duplicated key %v value %v, %v", slot.key, slot.value, v))
 				}
 			}
@@ -251,7 +291,7 @@ func (m Map[Key, Value]) directPutNoGrow(k Key, v Value) {
 			panic("full map calls directPutNoGrow")
 		}
 	}
-	loc := header.hash(k) & header.mask
+	loc := header.hashOf(k) & header.mask
 	slot := header.dataAt(loc)
 	next := slot.next
 	if next == emptyTableFlag { // empty
@@ -264,7 +304,7 @@ func (m Map[Key, Value]) directPutNoGrow(k Key, v Value) {
 		return
 	} else if next == listTailFlag { // only one, no link
 		if utils.Asserted {
-			if header.equal(slot.key, k) {
+			if header.equals(slot.key, k) {
 				panic(fmt.Sprintf("DirectPut faces duplicated key %v value %v, %v", slot.key, slot.value, v))
 			}
 		}
@@ -279,14 +319,14 @@ func (m Map[Key, Value]) directPutNoGrow(k Key, v Value) {
 		return
 	} else { // has next
 		if utils.Asserted {
-			if header.equal(slot.key, k) {
+			if header.equals(slot.key, k) {
 				panic(fmt.Sprintf("DirectPut faces duplicated key %v value %v, %v", slot.key, slot.value, v))
 			}
 		}
 		for {
 			slot = header.dataAt(next)
 			if utils.Asserted {
-				if header.equal(slot.key, k) {
+				if header.equals(slot.key, k) {
 					panic(fmt.Sprintf("DirectPut faces duplicated key %v value %v, %v", slot.key, slot.value, v))
 				}
 			}
@@ -318,24 +358,24 @@ func (m Map[Key, Value]) Get2(k Key) (val Value, ok bool) {
 			panic("use a moved or freed or null map")
 		}
 	}
-	loc := header.hash(k) & header.mask
+	loc := header.hashOf(k) & header.mask
 	slot := header.dataAt(loc)
 	next := slot.next
 	if next == emptyTableFlag {
 		return val, false
 	} else if next == listTailFlag {
-		if header.equal(slot.key, k) {
+		if header.equals(slot.key, k) {
 			return slot.value, true
 		} else {
 			return val, false
 		}
 	} else {
-		if header.equal(slot.key, k) {
+		if header.equals(slot.key, k) {
 			return slot.value, true
 		} else {
 			for {
 				slot = header.dataAt(next)
-				if header.equal(slot.key, k) {
+				if header.equals(slot.key, k) {
 					return slot.value, true
 				}
 				next = slot.next
@@ -359,24 +399,24 @@ func (m Map[Key, Value]) Get(k Key) (val Value) {
 			panic("use a moved or freed or null map")
 		}
 	}
-	loc := header.hash(k) & header.mask
+	loc := header.hashOf(k) & header.mask
 	slot := header.dataAt(loc)
 	next := slot.next
 	if next == emptyTableFlag {
 		return val
 	} else if next == listTailFlag {
-		if header.equal(slot.key, k) {
+		if header.equals(slot.key, k) {
 			return slot.value
 		} else {
 			return val
 		}
 	} else {
-		if header.equal(slot.key, k) {
+		if header.equals(slot.key, k) {
 			return slot.value
 		} else {
 			for {
 				slot = header.dataAt(next)
-				if header.equal(slot.key, k) {
+				if header.equals(slot.key, k) {
 					return slot.value
 				}
 				next = slot.next
@@ -400,19 +440,19 @@ func (m Map[Key, Value]) Delete(k Key) {
 			panic("use a moved or freed or null map")
 		}
 	}
-	loc := header.hash(k) & header.mask
+	loc := header.hashOf(k) & header.mask
 	slot := header.dataAt(loc)
 	next := slot.next
 	if next == emptyTableFlag {
 		return
 	} else if next == listTailFlag {
-		if header.equal(slot.key, k) {
+		if header.equals(slot.key, k) {
 			slot.next = emptyTableFlag
 			header.count--
 			return
 		}
 	} else {
-		if header.equal(slot.key, k) {
+		if header.equals(slot.key, k) {
 			*slot = *header.dataAt(next)
 			header.count--
 			return
@@ -422,7 +462,7 @@ func (m Map[Key, Value]) Delete(k Key) {
 			for {
 				last2Slot = slot
 				slot = header.dataAt(next)
-				if targetSlot == nil && header.equal(slot.key, k) {
+				if targetSlot == nil && header.equals(slot.key, k) {
 					targetSlot = slot
 				}
 				next = slot.next
@@ -464,7 +504,31 @@ func (mh *mapHeader[Key, Value]) dataAt(index SizeType) *entry[Key, Value] {
 			panic(fmt.Sprintf("Map table out of bound(%d, %d)", index, mh.tableLength))
 		}
 	}
-	return memory.PointerAs[entry[Key, Value]](mh.tableBasePtr + memory.Pointer(index*memory.Sizeof[entry[Key, Value]]()))
+	return memory.PointerAs[entry[Key, Value]](mh.tableBasePtr() + memory.Pointer(index*memory.Sizeof[entry[Key, Value]]()))
+}
+
+func (mh *mapHeader[Key, Value]) tableBasePtr() memory.Pointer {
+	return deref(mh.tableBase)
+}
+
+func (mh *mapHeader[Key, Value]) hashOf(k Key) SizeType {
+	switch mh.keyKind {
+	case simpleKey:
+		return simpleHash(k)
+	case stringKey:
+		return hashString(k)
+	}
+	return mh.hash(k)
+}
+
+func (mh *mapHeader[Key, Value]) equals(k1, k2 Key) bool {
+	switch mh.keyKind {
+	case simpleKey:
+		return k1 == k2
+	case stringKey:
+		return equalString(k1, k2)
+	}
+	return mh.equal(k1, k2)
 }
 
 func (mh *mapHeader[Key, Value]) hashEqualRefCtrl(cnt int) {
@@ -536,15 +600,18 @@ func (m Map[Key, Value]) Moved() bool {
 // :: m.Free(&m)
 func (m Map[Key, Value]) Free() {
 	if m.pointer().IsNotNull() {
+		checkDoubleFree(m.pointer())
 		header := m.header()
 		if header.headerPageHandler.IsNull() {
 			panic("double free?")
 		}
 
-		header.hashEqualRefCtrl(-1)
+		if header.keyKind == customKey {
+			header.hashEqualRefCtrl(-1)
+		}
 
 		header.table.Free()
-		Global.freePage(header.headerPageHandler)
+		arenaOf(header.arena).freeObject(m.pointer(), header.headerPageHandler)
 	}
 }
 
@@ -611,7 +678,7 @@ func (m Map[Key, Value]) checkCapacity(appendSize SizeType) error {
 			}
 			newNormalizeCap <<= 1 // enlarge once again because a test encounters capacity expansion.
 
-			newTable, err = makeSliceWithLength0[entry[Key, Value]](newNormalizeCap, trace_type.MapTable, 5)
+			newTable, err = makeSliceWithLength0[entry[Key, Value]](arenaOf(header.arena), newNormalizeCap, trace_type.MapTable, 5)
 			if err != nil {
 				return err
 			}
@@ -621,11 +688,11 @@ func (m Map[Key, Value]) checkCapacity(appendSize SizeType) error {
 		{
 			oldTable := header.table
 			oldMask := header.mask
-			oldTableBasePtr := header.tableBasePtr
+			oldTableBasePtr := header.tableBasePtr()
 
 			header.table = newTable
 			header.tableLength = newNormalizeCap
-			header.tableBasePtr = newTable.header().elementBasePointer
+			header.tableBase = newTable.header().elementBase
 			header.count = 0
 			header.mask = (newNormalizeCap >> 1) - 1
 			header.free = newNormalizeCap >> 1
@@ -651,8 +718,61 @@ func (m Map[Key, Value]) checkCapacity(appendSize SizeType) error {
 	return nil
 }
 
+// Verify checks the table, the chains of entries and the count. Every key is in the chain of its hash. Nil for the null map
+func (m Map[Key, Value]) Verify() error {
+	if m.IsNull() {
+		return nil
+	}
+	header := m.header()
+	if err := verifyObject(header.arena, m.pointer(), header.headerPageHandler, memory.Sizeof[mapHeader[Key, Value]]()); err != nil {
+		return err
+	}
+	if header.table == nullSlice {
+		return memory.NewCorruptedError("map %s has no table", m.pointer().String())
+	}
+	if err := header.table.Verify(); err != nil {
+		return err
+	}
+	tableLength := header.tableLength
+	if header.table.Length() != tableLength || header.tableBase != header.table.header().elementBase {
+		return memory.NewCorruptedError("map %s has table length %d and base %s but its table is %d at %s", m.pointer().String(),
+			tableLength, deref(header.tableBase).String(), header.table.Length(), header.table.header().elementBasePointer().String())
+	}
+	if (header.mask+1)*2 != tableLength || header.mask&(header.mask+1) != 0 || header.free <= header.mask || header.free > tableLength {
+		return memory.NewCorruptedError("map %s has mask %d and free %d in table length %d", m.pointer().String(), header.mask, header.free, tableLength)
+	}
+	linked := make([]bool, tableLength-header.mask-1) // each link entry is in one chain
+	var count SizeType = 0
+	for loc := SizeType(0); loc <= header.mask; loc++ {
+		slot := header.dataAt(loc)
+		next := slot.next
+		if next == emptyTableFlag {
+			continue
+		}
+		for {
+			if header.hashOf(slot.key)&header.mask != loc {
+				return memory.NewCorruptedError("key %v in map %s is in the chain of %d", slot.key, m.pointer().String(), loc)
+			}
+			count++
+			if next == listTailFlag {
+				break
+			}
+			if next <= header.mask || next >= header.free || linked[next-header.mask-1] {
+				return memory.NewCorruptedError("entry %d is linked in the chain of %d in map %s", next, loc, m.pointer().String())
+			}
+			linked[next-header.mask-1] = true
+			slot = header.dataAt(next)
+			next = slot.next
+		}
+	}
+	if count != header.count {
+		return memory.NewCorruptedError("map %s has %d entries but count %d", m.pointer().String(), count, header.count)
+	}
+	return nil
+}
+
 func (m Map[Key, Value]) pointer() memory.Pointer {
-	return memory.Pointer(m)
+	return deref(ref(m))
 }
 
 func (m Map[Key, Value]) IsNull() bool {
@@ -24,12 +24,12 @@ func (m Map[Key, Value]) Iterator() (iter MapIterator[Key, Value]) {
 	header := m.header()
 	return MapIterator[Key, Value]{
 		tableIter: SliceIterator[entry[Key, Value]]{
-			cur:   header.tableBasePtr - memory.Pointer(memory.Sizeof[entry[Key, Value]]()),
-			end:   header.tableBasePtr + memory.Pointer((header.mask+1)*memory.Sizeof[entry[Key, Value]]()),
+			cur:   header.tableBasePtr() - memory.Pointer(memory.Sizeof[entry[Key, Value]]()),
+			end:   header.tableBasePtr() + memory.Pointer((header.mask+1)*memory.Sizeof[entry[Key, Value]]()),
 			index: memory.SizeTypeMax,
 		},
 		currentSlot:  nil,
-		tableBasePtr: header.tableBasePtr,
+		tableBasePtr: header.tableBasePtr(),
 	}
 }
 
@@ -166,7 +166,7 @@ func BenchmarkMyStringMapGet(b *testing.B) {
 	}
 	b.ResetTimer()
 	for _, k := range keys {
-		_ = m.Get(k)
+		_ = m.Get(k) // about 1.4x with the relocatable tag
 	}
 	b.StopTimer()
 	for _, key := range keys {
@@ -0,0 +1,160 @@
+package memory
+
+import (
+	"bytes"
+	"sync"
+	"sync/atomic"
+	"unsafe"
+)
+
+/**
+A Backend gives memories their bytes and operates on them. The Lib functions use the default backend,
+which is MmapBackend on unix and HeapBackend elsewhere, or LinknameBackend calling the runtime by the linkname build tag.
+New takes a backend for the memory, which also zeroes, moves and compares bytes of the memory and of collections in it.
+Reserved, huge page and file-backed memories are mapped by the OS directly, and operated on by the default backend.
+*/
+
+// Backend allocates memory and operates on bytes. It must be safe for concurrent use and comparable
+type Backend interface {
+	Alloc(size SizeType) Pointer // null if it cannot
+	Free(ptr Pointer)            // ptr from Alloc
+	Zero(ptr Pointer, size SizeType)
+	Move(to, from Pointer, size SizeType)
+	Equal(p1, p2 Pointer, size SizeType) bool
+}
+
+var defaultBackend = newDefaultBackend()
+
+// DefaultBackend is the backend of the Lib functions, and of New when none is given
+func DefaultBackend() Backend {
+	return defaultBackend
+}
+
+// SetDefaultBackend replaces the default backend. Call it before any memory is made, and never after
+func SetDefaultBackend(backend Backend) {
+	if backend == nil {
+		panic("nil backend")
+	}
+	defaultBackend = backend
+}
+
+// backends registered by New. A memory keeps the index in its header. Index 0 is for memories mapped by the OS directly.
+// Copied on write, so reading needs no lock
+var backends atomic.Pointer[[]Backend]
+var backendsMu sync.Mutex
+
+func init() {
+	backends.Store(&[]Backend{nil})
+}
+
+// registerBackend returns the index of the backend in backends, adding it if new. Backends are compared by ==
+func registerBackend(backend Backend) SizeType {
+	backendsMu.Lock()
+	defer backendsMu.Unlock()
+	old := *backends.Load()
+	for i := 1; i < len(old); i++ {
+		if old[i] == backend {
+			return SizeType(i)
+		}
+	}
+	registered := append(old[:len(old):len(old)], backend)
+	backends.Store(&registered)
+	return SizeType(len(old))
+}
+
+// Backend of the memory from New. Nil for a memory mapped by the OS directly
+func (m Memory) Backend() Backend {
+	return (*backends.Load())[m.header().backendIndex]
+}
+
+// backend operates on bytes of the memory. The default backend for a memory mapped by the OS directly
+func (m Memory) backend() Backend {
+	if index := m.header().backendIndex; index != 0 {
+		return (*backends.Load())[index]
+	}
+	return defaultBackend
+}
+
+// ZeroBytes zeroes [ptr, ptr+size) in the memory by its backend
+func (m Memory) ZeroBytes(ptr Pointer, size SizeType) {
+	m.backend().Zero(ptr, size)
+}
+
+// MoveBytes copies size bytes from from to to by the backend of the memory. They may overlap
+func (m Memory) MoveBytes(to, from Pointer, size SizeType) {
+	m.backend().Move(to, from, size)
+}
+
+// EqualBytes compares size bytes from p1 and p2 by the backend of the memory
+func (m Memory) EqualBytes(p1, p2 Pointer, size SizeType) bool {
+	return m.backend().Equal(p1, p2, size)
+}
+
+// bytesAt is [ptr, ptr+size) as a Go slice
+func bytesAt(ptr Pointer, size SizeType) []byte {
+	if size == 0 {
+		return nil
+	}
+	return unsafe.Slice((*byte)(ptr.UnsafePointer()), size.Int())
+}
+
+// goBytes operates on bytes by Go slices, which the compiler turns into memclr, memmove and memequal of the runtime
+type goBytes struct{}
+
+func (goBytes) Zero(ptr Pointer, size SizeType) {
+	bs := bytesAt(ptr, size)
+	for i := range bs {
+		bs[i] = 0
+	}
+}
+
+func (goBytes) Move(to, from Pointer, size SizeType) {
+	copy(bytesAt(to, size), bytesAt(from, size))
+}
+
+func (goBytes) Equal(p1, p2 Pointer, size SizeType) bool {
+	return bytes.Equal(bytesAt(p1, size), bytesAt(p2, size))
+}
+
+// HeapBackend allocates byte slices from the Go heap, kept alive until freed. Its memory is seen by the race detector,
+// and pointers into it pass checkptr. The GC does not scan it, so it must not keep Go pointers
+type HeapBackend struct {
+	goBytes
+	mu     sync.Mutex
+	slices map[Pointer][]byte
+}
+
+func NewHeapBackend() *HeapBackend {
+	return &HeapBackend{slices: map[Pointer][]byte{}}
+}
+
+func (h *HeapBackend) Alloc(size SizeType) Pointer {
+	if size == 0 {
+		return NullPointer
+	}
+	bs := make([]byte, size)
+	ptr := Pointer(uintptr(unsafe.Pointer(&bs[0])))
+	h.mu.Lock()
+	h.slices[ptr] = bs
+	h.mu.Unlock()
+	registerHeapBytes(bs)
+	return ptr
+}
+
+func (h *HeapBackend) Free(ptr Pointer) {
+	unregisterHeapBytes(ptr)
+	h.mu.Lock()
+	delete(h.slices, ptr)
+	h.mu.Unlock()
+}
+
+// AllocatedSize is the size not freed
+func (h *HeapBackend) AllocatedSize() SizeType {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	var size SizeType = 0
+	for _, bs := range h.slices {
+		size += SizeType(len(bs))
+	}
+	return size
+}
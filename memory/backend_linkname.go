@@ -0,0 +1,60 @@
+//go:build linkname
+
+package memory
+
+import (
+	"unsafe"
+)
+
+// LinknameBackend calls functions of the runtime by go:linkname. Newer toolchains may refuse to link it
+type LinknameBackend struct{}
+
+// newDefaultBackend is LinknameBackend by the linkname build tag
+func newDefaultBackend() Backend {
+	return LinknameBackend{}
+}
+
+func (LinknameBackend) Alloc(size SizeType) Pointer {
+	return Pointer(uintptr(sysAllocOS(size.UIntPtr())))
+}
+
+func (LinknameBackend) Free(ptr Pointer) {
+	sysFreeOS(ptr.UnsafePointer(), 0) // 0 is ok, just for log
+}
+
+func (LinknameBackend) Zero(ptr Pointer, size SizeType) {
+	memclrNoHeapPointers(unsafe.Pointer(ptr.UIntPtr()), size.UIntPtr())
+}
+
+func (LinknameBackend) Move(to, from Pointer, size SizeType) {
+	memmove(unsafe.Pointer(to.UIntPtr()), unsafe.Pointer(from.UIntPtr()), size.UIntPtr())
+}
+
+func (LinknameBackend) Equal(p1, p2 Pointer, size SizeType) bool {
+	return memequal(unsafe.Pointer(p1.UIntPtr()), unsafe.Pointer(p2.UIntPtr()), size.UIntPtr())
+}
+
+//go:linkname sysAllocOS runtime.sysAllocOS
+//go:noescape GoUnusedParameter
+//goland:noinspection GoUnusedParameter
+func sysAllocOS(n uintptr) unsafe.Pointer
+
+//go:linkname sysFreeOS runtime.sysFreeOS
+//go:noescape GoUnusedParameter
+//goland:noinspection GoUnusedParameter
+func sysFreeOS(v unsafe.Pointer, n uintptr)
+
+//go:noescape
+//go:linkname memclrNoHeapPointers runtime.memclrNoHeapPointers
+//goland:noinspection GoUnusedParameter
+func memclrNoHeapPointers(ptr unsafe.Pointer, n uintptr)
+
+//go:linkname memmove runtime.memmove
+//go:noescape GoUnusedParameter
+//goland:noinspection GoUnusedParameter
+func memmove(to, from unsafe.Pointer, n uintptr)
+
+//go:linkname memequal runtime.memequal
+//go:noescape GoUnusedParameter
+//goland:noinspection GoUnusedParameter
+func memequal(a, b unsafe.Pointer, size uintptr) bool
@@ -0,0 +1,8 @@
+//go:build !linkname
+
+package memory
+
+// newDefaultBackend is the backend of the OS without the linkname build tag
+func newDefaultBackend() Backend {
+	return osBackend()
+}
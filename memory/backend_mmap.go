@@ -0,0 +1,47 @@
+//go:build unix
+
+package memory
+
+import (
+	"sync"
+	"syscall"
+	"unsafe"
+)
+
+// MmapBackend maps anonymous private memory by syscall.Mmap. It is zero at first
+type MmapBackend struct {
+	goBytes
+}
+
+var mmapBackendMappings = map[Pointer][]byte{}
+var mmapBackendMu sync.Mutex
+
+func (MmapBackend) Alloc(size SizeType) Pointer {
+	if size == 0 {
+		return NullPointer
+	}
+	bs, err := syscall.Mmap(-1, 0, size.Int(), syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_ANON|syscall.MAP_PRIVATE)
+	if err != nil {
+		return NullPointer
+	}
+	ptr := Pointer(uintptr(unsafe.Pointer(&bs[0])))
+	mmapBackendMu.Lock()
+	mmapBackendMappings[ptr] = bs
+	mmapBackendMu.Unlock()
+	return ptr
+}
+
+func (MmapBackend) Free(ptr Pointer) {
+	mmapBackendMu.Lock()
+	bs := mmapBackendMappings[ptr]
+	delete(mmapBackendMappings, ptr)
+	mmapBackendMu.Unlock()
+	if bs != nil {
+		_ = syscall.Munmap(bs)
+	}
+}
+
+// osBackend is the default backend without the linkname build tag
+func osBackend() Backend {
+	return MmapBackend{}
+}
@@ -0,0 +1,8 @@
+//go:build !unix
+
+package memory
+
+// osBackend is the default backend without the linkname build tag. Mmap is not supported
+func osBackend() Backend {
+	return NewHeapBackend()
+}
@@ -0,0 +1,85 @@
+package memory
+
+import (
+	"github.com/madokast/direct/utils"
+	"testing"
+)
+
+func TestBackend(t *testing.T) {
+	heap := NewHeapBackend()
+	for _, backend := range []Backend{DefaultBackend(), heap} {
+		memory := New(1*MB, backend)
+		utils.Assert(memory.Backend() == backend)
+
+		p1, err := memory.allocPage(4)
+		utils.PanicErr(err)
+		p2, err := memory.allocPage(4)
+		utils.PanicErr(err)
+		ptr1, ptr2 := memory.PagePointerOf(p1), memory.PagePointerOf(p2)
+		for i := SizeType(0); i < p1.Size(); i++ {
+			*PointerAs[byte](ptr1 + Pointer(i)) = byte(i)
+		}
+		utils.Assert(!memory.EqualBytes(ptr1, ptr2, p1.Size()))
+		memory.MoveBytes(ptr2, ptr1, p1.Size())
+		utils.Assert(memory.EqualBytes(ptr1, ptr2, p1.Size()))
+		memory.MoveBytes(ptr1+1, ptr1, 16) // overlapped
+		utils.Assert(*PointerAs[byte](ptr1 + 16) == 15)
+		memory.ZeroBytes(ptr1, p1.Size())
+		utils.Assert(*PointerAs[byte](ptr1 + 16) == 0)
+		utils.Assert(!memory.EqualBytes(ptr1, ptr2, p1.Size()))
+		utils.Assert(memory.EqualBytes(ptr1, ptr2, 1))
+
+		memory.freePage(p1)
+		memory.freePage(p2)
+		utils.PanicErr(memory.Verify())
+		memory.Free()
+	}
+	utils.Assert(heap.AllocatedSize() == 0, heap.AllocatedSize())
+	reserved := NewReserved(1*MB, 1*MB)
+	utils.Assert(reserved.Backend() == nil)
+	reserved.Free()
+}
+
+// countingBackend counts bytes zeroed and moved
+type countingBackend struct {
+	*HeapBackend
+	zeroed, moved *SizeType
+}
+
+func (c countingBackend) Zero(ptr Pointer, size SizeType) {
+	*c.zeroed += size
+	c.HeapBackend.Zero(ptr, size)
+}
+
+func (c countingBackend) Move(to, from Pointer, size SizeType) {
+	*c.moved += size
+	c.HeapBackend.Move(to, from, size)
+}
+
+func TestBackend_perMemory(t *testing.T) {
+	var zeroed, moved SizeType
+	backend := countingBackend{HeapBackend: NewHeapBackend(), zeroed: &zeroed, moved: &moved}
+	m1, m2 := New(1*MB, backend), New(1*MB, backend)
+	utils.Assert(m1.header().backendIndex == m2.header().backendIndex) // registered once
+	utils.Assert(zeroed > 0)                                           // bitmaps
+
+	zeroed = 0
+	page, err := m1.allocPage(1)
+	utils.PanicErr(err)
+	utils.PanicErr(m1.SetRoot("counted", m1.PagePointerOf(page)))
+	utils.Assert(zeroed > 0) // the root directory
+	m1.MoveBytes(m1.PagePointerOf(page)+8, m1.PagePointerOf(page), 8)
+	utils.Assert(moved == 8)
+
+	m3 := New(1*MB, nil)
+	zeroed, moved = 0, 0
+	page3, err := m3.allocPage(1)
+	utils.PanicErr(err)
+	m3.ZeroBytes(m3.PagePointerOf(page3), BasePageSize)
+	utils.Assert(zeroed == 0 && moved == 0)
+
+	m1.Free()
+	m2.Free()
+	m3.Free()
+	utils.Assert(backend.AllocatedSize() == 0)
+}
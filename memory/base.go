@@ -71,7 +71,7 @@ func (p Pointer) UIntPtr() uintptr {
 }
 
 func (p Pointer) UnsafePointer() unsafe.Pointer {
-	return unsafe.Pointer(uintptr(p))
+	return unsafePointerOf(p)
 }
 
 func (p Pointer) IsNull() bool {
@@ -102,7 +102,7 @@ func (s SizeType) BitString() string {
 }
 
 func PointerAs[T any](p Pointer) *T {
-	return (*T)(unsafe.Pointer(uintptr(p)))
+	return (*T)(unsafePointerOf(p))
 }
 
 const KB = 1024
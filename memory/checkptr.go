@@ -0,0 +1,69 @@
+//go:build race
+
+package memory
+
+import (
+	"sort"
+	"sync"
+	"sync/atomic"
+	"unsafe"
+)
+
+/**
+The race detector turns on checkptr, which rejects an unsafe.Pointer converted from an integer into the Go heap.
+Allocations of HeapBackend are registered here, and pointers into them are derived by unsafe.Add from their bases.
+*/
+
+// heapBytes is an allocation of HeapBackend
+type heapBytes struct {
+	base unsafe.Pointer
+	size SizeType
+}
+
+// heapAllocations sorted by base. Copied on write, so reading needs no lock
+var heapAllocations atomic.Pointer[[]heapBytes]
+var heapAllocationsMu sync.Mutex
+
+func registerHeapBytes(bs []byte) {
+	heapAllocationsMu.Lock()
+	defer heapAllocationsMu.Unlock()
+	var old []heapBytes
+	if loaded := heapAllocations.Load(); loaded != nil {
+		old = *loaded
+	}
+	base := unsafe.Pointer(&bs[0])
+	i := sort.Search(len(old), func(i int) bool { return uintptr(old[i].base) > uintptr(base) })
+	registered := make([]heapBytes, 0, len(old)+1)
+	registered = append(registered, old[:i]...)
+	registered = append(registered, heapBytes{base: base, size: SizeType(len(bs))})
+	registered = append(registered, old[i:]...)
+	heapAllocations.Store(&registered)
+}
+
+func unregisterHeapBytes(ptr Pointer) {
+	heapAllocationsMu.Lock()
+	defer heapAllocationsMu.Unlock()
+	old := *heapAllocations.Load()
+	registered := make([]heapBytes, 0, len(old))
+	for _, allocation := range old {
+		if Pointer(uintptr(allocation.base)) != ptr {
+			registered = append(registered, allocation)
+		}
+	}
+	heapAllocations.Store(&registered)
+}
+
+// unsafePointerOf converts p from the base of the allocation of HeapBackend containing it, if any
+func unsafePointerOf(p Pointer) unsafe.Pointer {
+	if loaded := heapAllocations.Load(); loaded != nil {
+		allocations := *loaded
+		i := sort.Search(len(allocations), func(i int) bool { return Pointer(uintptr(allocations[i].base)) > p }) - 1
+		if i >= 0 {
+			allocation := allocations[i]
+			if offset := uintptr(p) - uintptr(allocation.base); offset <= allocation.size.UIntPtr() { // the end is ok
+				return unsafe.Add(allocation.base, offset)
+			}
+		}
+	}
+	return unsafe.Pointer(uintptr(p)) // not in the Go heap
+}
@@ -0,0 +1,14 @@
+//go:build !race
+
+package memory
+
+import "unsafe"
+
+// registerHeapBytes is for checkptr of the race detector. HeapBackend keeps the allocation reachable anyway
+func registerHeapBytes([]byte) {}
+
+func unregisterHeapBytes(Pointer) {}
+
+func unsafePointerOf(p Pointer) unsafe.Pointer {
+	return unsafe.Pointer(uintptr(p))
+}
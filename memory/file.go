@@ -0,0 +1,178 @@
+package memory
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"unsafe"
+)
+
+/**
+A file-backed memory is mapped on a file by mmap. Memory in it is written back to the file.
+Collections store absolute pointers, so the file is mapped at the address where it was created
+and open fails if the address is used by others in the process.
+The header of a memory keeps no absolute pointer. Under the relocatable build tag the file is mapped at any address.
+A shared memory is a file in /dev/shm attached by processes. Its lock is a spin.SharedMutex.
+The file is kept open until Free for the lease of the process on the lock, so the lock of a dead process is taken over.
+*/
+
+// leasedFiles of file-backed memories, open until Free
+var leasedFiles = map[Memory]*os.File{}
+var leasedFilesMu sync.Mutex
+
+// NewFile creates a file of size and maps a memory on it. The file must not exist
+func NewFile(path string, size SizeType) (Memory, error) {
+	size = (size + 7) & (SizeTypeMax - 7)
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0o644)
+	if err != nil {
+		return NullMemory, err
+	}
+	if err = file.Truncate(int64(size)); err != nil {
+		_ = file.Close()
+		return NullMemory, err
+	}
+	ptr, err := libMapFile(file.Fd(), size, NullPointer)
+	if err != nil {
+		_ = file.Close()
+		return NullMemory, err
+	}
+	m := Memory(ptr)
+	m.initHeader(ptr, size, 0)
+	m.header().fileSize = size
+	if err = m.leaseFile(file); err != nil {
+		libUnmapFile(ptr, size)
+		return NullMemory, err
+	}
+	m.startTrace()
+	return m, nil
+}
+
+// OpenFile maps the memory in the file from NewFile at its original address, or anywhere if Relocatable
+func OpenFile(path string) (Memory, error) {
+	m, err := openFile(path)
+	if err != nil {
+		return NullMemory, err
+	}
+	header := m.header()
+	header.mu.Reset() // the process holding it may crash
+	header.lockFreeState = 0
+	return m, nil
+}
+
+// NewShared creates a shared memory named name in /dev/shm. Other processes attach it by AttachShared.
+// It is mapped at the same address in every process so pointers in it are valid everywhere, unless Relocatable
+func NewShared(name string, size SizeType) (Memory, error) {
+	path, err := sharedMemoryPath(name)
+	if err != nil {
+		return NullMemory, err
+	}
+	return NewFile(path, size)
+}
+
+// AttachShared maps the shared memory from NewShared. Free detaches it
+func AttachShared(name string) (Memory, error) {
+	path, err := sharedMemoryPath(name)
+	if err != nil {
+		return NullMemory, err
+	}
+	return openFile(path)
+}
+
+// RemoveShared removes the name of the shared memory. Attached processes can use it until Free
+func RemoveShared(name string) error {
+	path, err := sharedMemoryPath(name)
+	if err != nil {
+		return err
+	}
+	return os.Remove(path)
+}
+
+func sharedMemoryPath(name string) (string, error) {
+	if name == "" || strings.ContainsRune(name, '/') {
+		return "", fmt.Errorf("bad shared memory name %q", name)
+	}
+	return "/dev/shm/" + name, nil
+}
+
+func openFile(path string) (Memory, error) {
+	file, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		return NullMemory, err
+	}
+	leased := false
+	defer func() {
+		if !leased {
+			_ = file.Close()
+		}
+	}()
+
+	var header memoryHeader
+	if _, err = file.ReadAt(unsafe.Slice((*byte)(unsafe.Pointer(&header)), memoryHeaderSize.Int()), 0); err != nil {
+		return NullMemory, err
+	}
+	if err = checkMagic(header.magic); err != nil {
+		return NullMemory, fmt.Errorf("cannot open %s: %w", path, err)
+	}
+	stat, err := file.Stat()
+	if err != nil {
+		return NullMemory, err
+	}
+	if header.fileSize == 0 || SizeType(stat.Size()) != header.fileSize {
+		return NullMemory, fmt.Errorf("%s has size %d but the memory size is %d", path, stat.Size(), header.fileSize)
+	}
+	address := header.libPointer
+	if Relocatable {
+		address = NullPointer
+	}
+	ptr, err := libMapFile(file.Fd(), header.fileSize, address)
+	if err != nil {
+		return NullMemory, fmt.Errorf("cannot map %s at %s: %w", path, address.String(), err)
+	}
+	m := Memory(ptr)
+	if err = m.leaseFile(file); err != nil {
+		libUnmapFile(ptr, header.fileSize)
+		return NullMemory, err
+	}
+	leased = true
+	m.startTrace()
+	return m, nil
+}
+
+// leaseFile takes the lease of the process on the lock by the file, and keeps it open until releaseFile
+func (m Memory) leaseFile(file *os.File) error {
+	if err := m.header().mu.Lease(file.Fd()); err != nil {
+		return fmt.Errorf("cannot lease the lock of the memory: %w", err)
+	}
+	leasedFilesMu.Lock()
+	leasedFiles[m] = file
+	leasedFilesMu.Unlock()
+	return nil
+}
+
+// releaseFile closes the file, releasing the lease
+func (m Memory) releaseFile() {
+	leasedFilesMu.Lock()
+	file := leasedFiles[m]
+	delete(leasedFiles, m)
+	leasedFilesMu.Unlock()
+	if file != nil {
+		m.header().mu.Release()
+		_ = file.Close()
+	}
+}
+
+// Sync writes a file-backed memory back to the file
+func (m Memory) Sync() error {
+	header := m.header()
+	if header.fileSize == 0 {
+		return errors.New("memory is not file-backed")
+	}
+	return libSyncFile(m.pointer(), header.fileSize)
+}
+
+// FileBacked tells whether the memory is from NewFile or OpenFile
+func (m Memory) FileBacked() bool {
+	return m.header().fileSize > 0
+}
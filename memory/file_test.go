@@ -0,0 +1,151 @@
+package memory
+
+import (
+	"fmt"
+	"github.com/madokast/direct/utils"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+func TestMemory_NewFile(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("file-backed memory is only supported on linux")
+	}
+	path := filepath.Join(t.TempDir(), "memory")
+	memory := utils.PanicErr1(NewFile(path, 1*MB))
+	page := utils.PanicErr1(memory.allocPage(4))
+	copy(memory.pageAsBytes(page), "hello")
+	utils.PanicErr(memory.SetRoot("hello", memory.PagePointerOf(page)))
+	utils.PanicErr(memory.Sync())
+	address := memory.pointer()
+	memory.Free()
+
+	memory = utils.PanicErr1(OpenFile(path))
+	utils.Assert(memory.pointer() == address || Relocatable)
+	utils.Assert(memory.FileBacked())
+	ptr, ok := memory.Root("hello")
+	utils.Assert(ok)
+	utils.Assert(ptr == memory.PagePointerOf(page))
+	utils.Assert(string(memory.pageAsBytes(page)[:5]) == "hello")
+	utils.Assert(memory.AllocatedPageNumber() == 4+rootDirectoryPageNumber, memory.AllocatedPageNumber())
+	memory.freePage(page)
+	memory.DeleteRoot("hello")
+	utils.Assert(memory.AllocatedPageNumber() == 0, memory.AllocatedPageNumber())
+	memory.Free()
+}
+
+func TestMemory_OpenFile_otherBuild(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("file-backed memory is only supported on linux")
+	}
+	// as if made by the build with the relocatable tag flipped
+	path := filepath.Join(t.TempDir(), "memory")
+	memory := utils.PanicErr1(NewFile(path, 1*MB))
+	memory.header().magic ^= 1 << 8
+	memory.Free()
+	_, err := OpenFile(path)
+	utils.Assert(err != nil && strings.Contains(err.Error(), "relocatable"), err)
+}
+
+func TestMemory_OpenFile_relocated(t *testing.T) {
+	if runtime.GOOS != "linux" || !Relocatable {
+		t.Skip("run with the relocatable tag on linux")
+	}
+	dir := t.TempDir()
+	path := filepath.Join(dir, "memory")
+	memory := utils.PanicErr1(NewFile(path, 1*MB))
+	defer memory.Free()
+	const class = 0
+	objects := make([]Pointer, 0, 64)
+	list := smallObjectList{}
+	utils.PanicErr(memory.allocSmallObjects(class, &list, 64))
+	for list.length > 0 {
+		objects = append(objects, list.pop())
+	}
+	for _, ptr := range objects[32:] {
+		memory.freeSmallObject(ptr)
+	}
+	page := utils.PanicErr1(memory.allocPage(4))
+	utils.PanicErr(memory.Sync())
+	utils.PanicErr(os.WriteFile(filepath.Join(dir, "copy"), utils.PanicErr1(os.ReadFile(path)), 0o644))
+
+	relocated := utils.PanicErr1(OpenFile(filepath.Join(dir, "copy"))) // the address is taken by the origin
+	defer relocated.Free()
+	utils.Assert(relocated.pointer() != memory.pointer())
+	offset := relocated.pointer() - memory.pointer()
+	utils.Assert(relocated.PagePointerOf(page) == memory.PagePointerOf(page)+offset)
+	list = smallObjectList{}
+	utils.PanicErr(relocated.allocSmallObjects(class, &list, 32))
+	for list.length > 0 {
+		ptr := list.pop()
+		utils.Assert(relocated.slabSpanOf(ptr) == memory.slabSpanOf(objects[0]), ptr.String()) // the freed objects
+		relocated.freeSmallObject(ptr)
+	}
+	for _, ptr := range objects[:32] {
+		relocated.freeSmallObject(ptr + offset)
+	}
+	relocated.freePage(page)
+	utils.Assert(relocated.AllocatedPageNumber() == 0, relocated.AllocatedPageNumber())
+}
+
+func TestMemory_AttachShared_deadHolder(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("shared memory is only supported on linux")
+	}
+	if name := os.Getenv("DIRECT_DEAD_HOLDER"); name != "" {
+		memory := utils.PanicErr1(AttachShared(name))
+		memory.header().mu.Lock()
+		os.Exit(0) // dies holding the lock
+	}
+
+	name := fmt.Sprintf("direct-dead-holder-%d", os.Getpid())
+	memory := utils.PanicErr1(NewShared(name, 4*MB))
+	defer func() { utils.PanicErr(RemoveShared(name)) }()
+	defer memory.Free()
+	child := exec.Command(os.Args[0], "-test.run=^TestMemory_AttachShared_deadHolder$")
+	child.Env = append(os.Environ(), "DIRECT_DEAD_HOLDER="+name)
+	utils.PanicErr(child.Run())
+
+	utils.Assert(!memory.NeedsVerify())
+	_ = memory.Stats() // takes over the lock
+	utils.Assert(memory.NeedsVerify())
+	utils.PanicErr(memory.Verify())
+	utils.Assert(!memory.NeedsVerify())
+}
+
+func TestMemory_OpenFile_crashed(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("file-backed memory is only supported on linux")
+	}
+	path := filepath.Join(t.TempDir(), "memory")
+	memory := utils.PanicErr1(NewFile(path, 1*MB))
+	memory.header().mu.Lock() // as if crashed holding the lock
+	memory.Free()
+	memory = utils.PanicErr1(OpenFile(path))
+	defer memory.Free()
+	utils.Assert(memory.NeedsVerify())
+	utils.PanicErr(memory.Verify())
+	utils.Assert(!memory.NeedsVerify())
+}
+
+func TestMemory_SetRoot(t *testing.T) {
+	memory := New(1*MB, nil)
+	defer memory.Free()
+
+	for i := SizeType(0); i < rootEntryNumber; i++ {
+		utils.PanicErr(memory.SetRoot(string(rune('a'+i%26))+string(rune('a'+i/26)), Pointer(i)))
+	}
+	utils.Assert(memory.SetRoot("full", 1) != nil)
+	utils.Assert(memory.SetRoot("", 1) != nil)
+	utils.PanicErr(memory.SetRoot("ba", 100)) // replace
+	ptr, ok := memory.Root("ba")
+	utils.Assert(ok && ptr == 100, ptr)
+	for i := SizeType(0); i < rootEntryNumber; i++ {
+		memory.DeleteRoot(string(rune('a'+i%26)) + string(rune('a'+i/26)))
+	}
+	utils.Assert(memory.AllocatedPageNumber() == 0)
+}
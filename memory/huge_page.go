@@ -0,0 +1,97 @@
+package memory
+
+import "fmt"
+
+/**
+A memory backed by huge pages has fewer TLB misses. NewHugePages maps it by MAP_HUGETLB from the pool of the OS,
+which is reserved at once and never swapped. If the pool is short, the memory is reserved as usual and
+madvise(MADV_HUGEPAGE) asks the kernel to back it by transparent huge pages when it can.
+Pages of such a memory start at a huge page boundary, and runs of a huge page or more are allocated aligned to it,
+so a large run is covered by whole huge pages.
+*/
+
+// HugePages tells how a memory is backed by huge pages
+type HugePages uint8
+
+const (
+	HugePagesNone        HugePages = iota // base pages of the OS
+	HugePagesTransparent                  // madvise(MADV_HUGEPAGE). The kernel backs aligned huge pages when it can
+	HugePagesHugeTLB                      // MAP_HUGETLB. All backed by huge pages from the pool
+)
+
+// HugePageSize is the huge page size assumed
+const HugePageSize = 2 * MB
+
+const hugePagePageNumber = HugePageSize >> BasePageSizeShiftNumber
+
+func (h HugePages) String() string {
+	switch h {
+	case HugePagesNone:
+		return "none"
+	case HugePagesTransparent:
+		return "transparent"
+	case HugePagesHugeTLB:
+		return "hugetlb"
+	default:
+		return fmt.Sprintf("HugePages(%d)", uint8(h))
+	}
+}
+
+// NewHugePages is NewReserved asking for huge pages. MAP_HUGETLB is tried first, then madvise(MADV_HUGEPAGE).
+// A memory by MAP_HUGETLB is committed fully. HugePages tells what is obtained
+func NewHugePages(size, maxSize SizeType) Memory {
+	if size > maxSize {
+		maxSize = size
+	}
+	maxSize = (maxSize + HugePageSize - 1) &^ (HugePageSize - 1)
+	if ptr, err := libMapHugeTLB(maxSize); err == nil {
+		m := Memory(ptr) // aligned to the huge page
+		m.initHeader(ptr, maxSize, 0)
+		m.alignPageBase(maxSize)
+		header := m.header()
+		header.reservedSize = maxSize // freed as a reserved memory
+		header.hugePages = HugePagesHugeTLB
+		m.startTrace()
+		return m
+	}
+	// one more huge page for the alignment
+	ptr := libReserve(maxSize + HugePageSize)
+	if ptr.IsNull() {
+		panic(fmt.Sprintf("cannot reserve memory %s", HumanFriendlyMemorySize(maxSize+HugePageSize)))
+	}
+	m := Memory((ptr + Pointer(HugePageSize-1)) &^ Pointer(HugePageSize-1))
+	m.initReserved(ptr, maxSize+HugePageSize, size, maxSize, true)
+	if libAdviseHugePages(m.pointer(), maxSize) {
+		m.header().hugePages = HugePagesTransparent
+	}
+	m.startTrace()
+	return m
+}
+
+// alignPageBase moves the zero-th page to the next huge page boundary in the memory of size bytes,
+// so a page index of a multiple of hugePagePageNumber is aligned to the huge page
+func (m Memory) alignPageBase(size SizeType) {
+	header := m.header()
+	pageBase := (m.pageBasePointer() + Pointer(HugePageSize-1)) &^ Pointer(HugePageSize-1)
+	header.pageBaseOffset = SizeType(pageBase - m.pointer())
+	header.maxPageIndex = (size - header.pageBaseOffset - BasePageSize) >> BasePageSizeShiftNumber
+	header.committedPageIndex = header.maxPageIndex
+	header.hugePageAligned = true
+}
+
+// HugePages tells how the memory is backed by huge pages
+func (m Memory) HugePages() HugePages {
+	return m.header().hugePages
+}
+
+// HugePageBackedSize is the size backed by huge pages now. It reads /proc/self/smaps for transparent huge pages
+func (m Memory) HugePageBackedSize() SizeType {
+	switch m.header().hugePages {
+	case HugePagesHugeTLB:
+		return m.mappingSize()
+	case HugePagesTransparent:
+		return libHugePageBackedSize(m.pointer(), m.mappingSize())
+	default:
+		return 0
+	}
+}
@@ -0,0 +1,48 @@
+package memory
+
+import (
+	"github.com/madokast/direct/utils"
+	"runtime"
+	"testing"
+)
+
+func TestNewHugePages(t *testing.T) {
+	memory := NewHugePages(8*MB, 64*MB)
+	defer memory.Free()
+	t.Log(memory.HugePages())
+	utils.Assert(memory.pageBasePointer()%Pointer(HugePageSize) == 0, memory.pageBasePointer())
+	if runtime.GOOS == "linux" {
+		utils.Assert(memory.HugePages() != HugePagesNone)
+	}
+
+	small, err := memory.allocPage(3)
+	utils.PanicErr(err)
+	large, err := memory.allocPage(hugePagePageNumber + 5) // committed on demand
+	utils.PanicErr(err)
+	utils.Assert(memory.PagePointerOf(large)%Pointer(HugePageSize) == 0, large)
+	LibZero(memory.PagePointerOf(large), large.Size())
+	memory.freePage(small) // merged with the gap before large
+	utils.PanicErr(memory.Verify())
+	utils.Assert(memory.AllocatedPageNumber() == large.PageNumber(), memory.AllocatedPageNumber())
+
+	var pages []PageHandler
+	for {
+		page, err := memory.allocPage(hugePagePageNumber)
+		if err != nil {
+			break
+		}
+		utils.Assert(memory.PagePointerOf(page)%Pointer(HugePageSize) == 0, page)
+		pages = append(pages, page)
+	}
+	// a freed run not large enough for alignment is used rather than OOM
+	memory.freePage(pages[1])
+	pages[1], err = memory.allocPage(hugePagePageNumber)
+	utils.PanicErr(err)
+	for _, page := range pages {
+		memory.freePage(page)
+	}
+	memory.freePage(large)
+	utils.PanicErr(memory.Verify())
+	utils.Assert(memory.AllocatedPageNumber() == 0)
+	utils.Assert(memory.Stats().HugePages == memory.HugePages())
+}
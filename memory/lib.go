@@ -6,8 +6,9 @@ import (
 	"unsafe"
 )
 
+// LibMalloc allocates by the default backend. Panics if it cannot
 func LibMalloc(size SizeType) Pointer {
-	pointer := Pointer(uintptr(sysAllocOS(size.UIntPtr())))
+	pointer := defaultBackend.Alloc(size)
 	if pointer.IsNull() {
 		panic(fmt.Sprintf("cannot allocate memory %s", HumanFriendlyMemorySize(size)))
 	}
@@ -21,19 +22,22 @@ func LibCalloc(size SizeType) Pointer {
 }
 
 func LibFree(ptr Pointer) {
-	sysFreeOS(ptr.UnsafePointer(), 0) // 0 is ok, just for log
+	defaultBackend.Free(ptr)
 }
 
+// LibZero zeroes by the default backend. Bytes of a memory are operated on by its backend, see Memory.ZeroBytes
 func LibZero(ptr Pointer, size SizeType) {
-	memclrNoHeapPointers(unsafe.Pointer(ptr.UIntPtr()), size.UIntPtr())
+	defaultBackend.Zero(ptr, size)
 }
 
+// LibMemMove moves by the default backend. See Memory.MoveBytes
 func LibMemMove(to, from Pointer, size SizeType) {
-	memmove(unsafe.Pointer(to.UIntPtr()), unsafe.Pointer(from.UIntPtr()), size.UIntPtr())
+	defaultBackend.Move(to, from, size)
 }
 
+// LibMemEqual compares by the default backend. See Memory.EqualBytes
 func LibMemEqual(p1, p2 Pointer, size SizeType) bool {
-	return memequal(unsafe.Pointer(p1.UIntPtr()), unsafe.Pointer(p2.UIntPtr()), size.UIntPtr())
+	return defaultBackend.Equal(p1, p2, size)
 }
 
 func LibGoSliceHeaderPointer[E any](slice []E) Pointer {
@@ -41,8 +45,10 @@ func LibGoSliceHeaderPointer[E any](slice []E) Pointer {
 }
 
 const markFreeMemoryValue = 0b1010
+const markFreeMemoryWord = Word(0x0101010101010101) * markFreeMemoryValue
 
-func libMarkFreedMemory(ptr Pointer, size SizeType) {
+// LibMarkFreedMemory fills freed memory with the poison pattern. See LibFindWrittenAfterFree
+func LibMarkFreedMemory(ptr Pointer, size SizeType) {
 	var bs []byte
 	*((*reflect.SliceHeader)(unsafe.Pointer(&bs))) = reflect.SliceHeader{
 		Data: ptr.UIntPtr(),
@@ -54,27 +60,18 @@ func libMarkFreedMemory(ptr Pointer, size SizeType) {
 	}
 }
 
-//go:linkname sysAllocOS runtime.sysAllocOS
-//go:noescape GoUnusedParameter
-//goland:noinspection GoUnusedParameter
-func sysAllocOS(n uintptr) unsafe.Pointer
-
-//go:linkname sysFreeOS runtime.sysFreeOS
-//go:noescape GoUnusedParameter
-//goland:noinspection GoUnusedParameter
-func sysFreeOS(v unsafe.Pointer, n uintptr)
-
-//go:noescape
-//go:linkname memclrNoHeapPointers runtime.memclrNoHeapPointers
-//goland:noinspection GoUnusedParameter
-func memclrNoHeapPointers(ptr unsafe.Pointer, n uintptr)
-
-//go:linkname memmove runtime.memmove
-//go:noescape GoUnusedParameter
-//goland:noinspection GoUnusedParameter
-func memmove(to, from unsafe.Pointer, n uintptr)
-
-//go:linkname memequal runtime.memequal
-//go:noescape GoUnusedParameter
-//goland:noinspection GoUnusedParameter
-func memequal(a, b unsafe.Pointer, size uintptr) bool
+// LibFindWrittenAfterFree returns the offset of the first byte not in the poison pattern of LibMarkFreedMemory, or size if none
+func LibFindWrittenAfterFree(ptr Pointer, size SizeType) SizeType {
+	var offset SizeType = 0
+	for ; offset+8 <= size; offset += 8 {
+		if *PointerAs[Word](ptr + Pointer(offset)) != markFreeMemoryWord {
+			break
+		}
+	}
+	for ; offset < size; offset++ {
+		if *PointerAs[byte](ptr + Pointer(offset)) != markFreeMemoryValue {
+			return offset
+		}
+	}
+	return size
+}
@@ -0,0 +1,142 @@
+//go:build linux
+
+package memory
+
+import (
+	"bufio"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+	"unsafe"
+)
+
+var osPageSize = SizeType(syscall.Getpagesize())
+
+// libReserve maps size bytes of address space without access. Commit it by libCommit before use
+func libReserve(size SizeType) Pointer {
+	ptr, _ := libReserveAt(NullPointer, size)
+	return ptr
+}
+
+// libReserveAt is libReserve at address unless address is null. The address is aligned to the OS page
+func libReserveAt(address Pointer, size SizeType) (Pointer, error) {
+	flags := syscall.MAP_ANON | syscall.MAP_PRIVATE | syscall.MAP_NORESERVE
+	if address.IsNotNull() {
+		flags |= mapFixedNoReplace
+	}
+	ptr, _, errno := syscall.Syscall6(syscall.SYS_MMAP, address.UIntPtr(), size.UIntPtr(),
+		syscall.PROT_NONE, uintptr(flags), ^uintptr(0), 0)
+	if errno != 0 {
+		return NullPointer, errno
+	}
+	if address.IsNotNull() && Pointer(ptr) != address {
+		// old kernels take the address as a hint
+		_, _, _ = syscall.Syscall(syscall.SYS_MUNMAP, ptr, size.UIntPtr(), 0)
+		return NullPointer, syscall.EEXIST
+	}
+	return Pointer(ptr), nil
+}
+
+// libCommit makes reserved memory [ptr, ptr+size) readable and writable. The range is extended to OS pages
+func libCommit(ptr Pointer, size SizeType) bool {
+	start := ptr &^ Pointer(osPageSize-1)
+	end := (ptr + Pointer(size) + Pointer(osPageSize-1)) &^ Pointer(osPageSize-1)
+	bs := unsafe.Slice((*byte)(start.UnsafePointer()), int(end-start))
+	return syscall.Mprotect(bs, syscall.PROT_READ|syscall.PROT_WRITE) == nil
+}
+
+// libRelease unmaps the memory from libReserve
+func libRelease(ptr Pointer, size SizeType) {
+	_, _, _ = syscall.Syscall(syscall.SYS_MUNMAP, ptr.UIntPtr(), size.UIntPtr(), 0)
+}
+
+// libDiscard gives the physical memory of [ptr, ptr+size) back to the OS. Anonymous memory reads zero after it.
+// ptr and size are aligned to the OS page
+func libDiscard(ptr Pointer, size SizeType) bool {
+	bs := unsafe.Slice((*byte)(ptr.UnsafePointer()), size.Int())
+	return syscall.Madvise(bs, syscall.MADV_DONTNEED) == nil
+}
+
+// libMapHugeTLB maps size bytes of huge pages from the pool. Fails if the pool is short.
+// size is aligned to the huge page
+func libMapHugeTLB(size SizeType) (Pointer, error) {
+	ptr, _, errno := syscall.Syscall6(syscall.SYS_MMAP, 0, size.UIntPtr(), syscall.PROT_READ|syscall.PROT_WRITE,
+		syscall.MAP_ANON|syscall.MAP_PRIVATE|syscall.MAP_HUGETLB, ^uintptr(0), 0)
+	if errno != 0 {
+		return NullPointer, errno
+	}
+	return Pointer(ptr), nil
+}
+
+// libAdviseHugePages asks the kernel to back [ptr, ptr+size) by transparent huge pages
+func libAdviseHugePages(ptr Pointer, size SizeType) bool {
+	bs := unsafe.Slice((*byte)(ptr.UnsafePointer()), size.Int())
+	return syscall.Madvise(bs, syscall.MADV_HUGEPAGE) == nil
+}
+
+// libHugePageBackedSize sums AnonHugePages of the mappings in [ptr, ptr+size) in /proc/self/smaps. 0 if unknown
+func libHugePageBackedSize(ptr Pointer, size SizeType) SizeType {
+	file, err := os.Open("/proc/self/smaps")
+	if err != nil {
+		return 0
+	}
+	defer func() { _ = file.Close() }()
+	var backed SizeType = 0
+	inside := false
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 2 {
+			continue
+		}
+		if !strings.HasSuffix(fields[0], ":") {
+			// a mapping like 7f0000000000-7f0000200000 rw-p ...
+			from, to, _ := strings.Cut(fields[0], "-")
+			start, err1 := strconv.ParseUint(from, 16, 64)
+			end, err2 := strconv.ParseUint(to, 16, 64)
+			inside = err1 == nil && err2 == nil && Pointer(start) < ptr+Pointer(size) && Pointer(end) > ptr
+		} else if inside && fields[0] == "AnonHugePages:" {
+			if kb, err := strconv.ParseUint(fields[1], 10, 64); err == nil {
+				backed += SizeType(kb) * KB
+			}
+		}
+	}
+	return backed
+}
+
+const mapFixedNoReplace = 0x100000 // MAP_FIXED_NOREPLACE since linux 4.17
+
+// libMapFile maps the file shared. The memory is mapped at address unless address is null
+func libMapFile(fd uintptr, size SizeType, address Pointer) (Pointer, error) {
+	flags := syscall.MAP_SHARED
+	if address.IsNotNull() {
+		flags |= mapFixedNoReplace
+	}
+	ptr, _, errno := syscall.Syscall6(syscall.SYS_MMAP, address.UIntPtr(), size.UIntPtr(),
+		syscall.PROT_READ|syscall.PROT_WRITE, uintptr(flags), fd, 0)
+	if errno != 0 {
+		return NullPointer, errno
+	}
+	if address.IsNotNull() && Pointer(ptr) != address {
+		// old kernels take the address as a hint
+		_, _, _ = syscall.Syscall(syscall.SYS_MUNMAP, ptr, size.UIntPtr(), 0)
+		return NullPointer, syscall.EEXIST
+	}
+	return Pointer(ptr), nil
+}
+
+// libSyncFile writes the mapped memory back to the file
+func libSyncFile(ptr Pointer, size SizeType) error {
+	_, _, errno := syscall.Syscall(syscall.SYS_MSYNC, ptr.UIntPtr(), size.UIntPtr(), syscall.MS_SYNC)
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+// libUnmapFile syncs and unmaps the memory from libMapFile
+func libUnmapFile(ptr Pointer, size SizeType) {
+	_ = libSyncFile(ptr, size)
+	_, _, _ = syscall.Syscall(syscall.SYS_MUNMAP, ptr.UIntPtr(), size.UIntPtr(), 0)
+}
@@ -0,0 +1,59 @@
+//go:build !linux
+
+package memory
+
+import "errors"
+
+const osPageSize SizeType = 4 * KB
+
+// libReserve allocates the whole memory because reserving is not supported
+func libReserve(size SizeType) Pointer {
+	return LibMalloc(size)
+}
+
+// libReserveAt does not support an address
+func libReserveAt(address Pointer, size SizeType) (Pointer, error) {
+	if address.IsNotNull() {
+		return NullPointer, errors.New("mapping at an address is only supported on linux")
+	}
+	return libReserve(size), nil
+}
+
+func libCommit(Pointer, SizeType) bool {
+	return true
+}
+
+func libRelease(ptr Pointer, _ SizeType) {
+	LibFree(ptr)
+}
+
+// libDiscard is not supported
+func libDiscard(Pointer, SizeType) bool {
+	return false
+}
+
+var errHugePagesNotSupported = errors.New("huge pages are only supported on linux")
+
+func libMapHugeTLB(SizeType) (Pointer, error) {
+	return NullPointer, errHugePagesNotSupported
+}
+
+func libAdviseHugePages(Pointer, SizeType) bool {
+	return false
+}
+
+func libHugePageBackedSize(Pointer, SizeType) SizeType {
+	return 0
+}
+
+var errFileNotSupported = errors.New("file-backed memory is only supported on linux")
+
+func libMapFile(uintptr, SizeType, Pointer) (Pointer, error) {
+	return NullPointer, errFileNotSupported
+}
+
+func libSyncFile(Pointer, SizeType) error {
+	return errFileNotSupported
+}
+
+func libUnmapFile(Pointer, SizeType) {}
@@ -2,6 +2,7 @@ package memory
 
 import (
 	"fmt"
+	"github.com/madokast/direct/utils"
 	"reflect"
 	"testing"
 	"unsafe"
@@ -84,10 +85,23 @@ func Test_libMarkFreedMemory(t *testing.T) {
 		}
 	}
 
-	libMarkFreedMemory(ptr, size)
+	LibMarkFreedMemory(ptr, size)
 	for i, b := range bs {
 		if b != markFreeMemoryValue {
 			panic(fmt.Sprint(i, ", ", b))
 		}
 	}
 }
+
+func TestLibFindWrittenAfterFree(t *testing.T) {
+	const size = 1000
+	ptr := LibMalloc(size)
+	defer LibFree(ptr)
+
+	LibMarkFreedMemory(ptr, size)
+	utils.Assert(LibFindWrittenAfterFree(ptr, size) == size)
+	*PointerAs[byte](ptr + 997) = 0
+	utils.Assert(LibFindWrittenAfterFree(ptr, size) == 997, LibFindWrittenAfterFree(ptr, size))
+	*PointerAs[byte](ptr + 17) = 0
+	utils.Assert(LibFindWrittenAfterFree(ptr, size) == 17, LibFindWrittenAfterFree(ptr, size))
+}
@@ -3,51 +3,94 @@ package memory
 import (
 	"fmt"
 	"github.com/madokast/direct/utils"
+	"github.com/madokast/direct/utils/spin"
+	"sync/atomic"
 )
 
+// LocalMemory caches pages and small objects of a thread. Its cached pages are bounded by bytes. See SetMaxCachedSize.
+// Other threads may Flush it, so memory cached by an idle thread is not out of reach
 type LocalMemory struct {
-	localPages   []PageHandler
-	globalMemory Memory
-	noCopy       utils.NoCopy
+	localPages          []PageHandler
+	cachedPageNumber    SizeType // of localPages. Statistical, read by CachedSize in other threads
+	maxCachedPageNumber SizeType // bound of cachedPageNumber
+	smallObjects        [slabClassNumber]smallObjectList
+	globalMemory        Memory
+	mu                  spin.Mutex // taken by the thread using it, and by others flushing it. Before the mu of globalMemory
+	noCopy              utils.NoCopy
 }
 
 const localPoolCapacity = 64         // max capacity of localPages
 const maxAllocTimes = 4              // alloc pageNumber*maxAllocTimes page into local
 const maxAllocOncePageNumber = 40960 // max alloc a-40960 page once from globalMemory
 
+// DefaultLocalCacheSize is the default bound of pages cached in a local memory
+const DefaultLocalCacheSize = 16 * MB
+
 func (m Memory) NewLocalMemory() LocalMemory {
 	return LocalMemory{
-		localPages:   make([]PageHandler, 0, localPoolCapacity),
-		globalMemory: m,
+		localPages:          make([]PageHandler, 0, localPoolCapacity),
+		maxCachedPageNumber: DefaultLocalCacheSize >> BasePageSizeShiftNumber,
+		globalMemory:        m,
 	}
 }
 
+// NewLocalMemory makes another local memory of the same memory and bound
 func (m *LocalMemory) NewLocalMemory() LocalMemory {
 	return LocalMemory{
-		localPages:   make([]PageHandler, 0, localPoolCapacity),
-		globalMemory: m.globalMemory,
+		localPages:          make([]PageHandler, 0, localPoolCapacity),
+		maxCachedPageNumber: m.maxCachedPageNumber,
+		globalMemory:        m.globalMemory,
 	}
 }
 
+// SetMaxCachedSize bounds the size of pages cached. Pages out of the bound are freed to the global memory.
+// Small objects are bounded by number. Call it before use
+func (m *LocalMemory) SetMaxCachedSize(size SizeType) {
+	m.maxCachedPageNumber = size >> BasePageSizeShiftNumber
+}
+
 func (m *LocalMemory) Destroy() {
 	if utils.Asserted {
 		if len(m.localPages) == 1 && m.localPages[0] == nullPageHandle {
 			panic("double free local-memory")
 		}
 	}
+	m.Flush()
+	if utils.Asserted {
+		m.localPages = m.localPages[:0]
+		m.localPages = append(m.localPages, nullPageHandle) // for check only
+	}
+}
+
+// Flush returns cached pages and objects to the global memory. Returns the size returned.
+// It may be called in other threads while the local memory is used
+func (m *LocalMemory) Flush() SizeType {
+	m.mu.Lock()
+	flushed := m.CachedSize()
 	mu := &m.globalMemory.header().mu
 	mu.Lock()
 	for _, page := range m.localPages {
-		m.globalMemory.freePage(page)
+		m.globalMemory.releasePage(page)
 	}
-	mu.Unlock()
-	if utils.Asserted {
-		m.localPages = m.localPages[:0]
-		m.localPages = append(m.localPages, nullPageHandle) // for check only
+	m.localPages = m.localPages[:0]
+	atomic.StoreUint64((*uint64)(&m.cachedPageNumber), 0)
+	for class := range m.smallObjects {
+		m.flushSmallObjects(class, 0)
 	}
+	mu.Unlock()
+	m.mu.Unlock()
+	return flushed
 }
 
 func (m *LocalMemory) AllocPage(pageNumber SizeType) (PageHandler, error) {
+	m.mu.Lock()
+	page, err := m.allocPage(pageNumber)
+	m.mu.Unlock()
+	return page, err
+}
+
+// allocPage caller holds m.mu
+func (m *LocalMemory) allocPage(pageNumber SizeType) (PageHandler, error) {
 	if utils.Asserted {
 		if len(m.localPages) == 1 && m.localPages[0] == nullPageHandle {
 			panic("use a destroyed memory")
@@ -64,18 +107,20 @@ func (m *LocalMemory) AllocPage(pageNumber SizeType) (PageHandler, error) {
 	for i := 0; i < localPageLength; i++ {
 		curPage := m.localPages[i]
 		curPageNumber := curPage.PageNumber()
-		if curPageNumber >= pageNumber {
+		if curPageNumber == pageNumber {
 			last := localPageLength - 1
 			m.localPages[i] = m.localPages[last]
 			m.localPages = m.localPages[:last]
+			m.addCachedPageNumber(-pageNumber)
 			return curPage, nil
 		}
-		//if curPageNumber > pageNumber {
-		//	// break curPage
-		//	curPageIndex := curPage.PageIndex()
-		//	m.localPages[i] = MakePageHandler(curPageNumber-pageNumber, curPageIndex+pageNumber)
-		//	return MakePageHandler(pageNumber, curPageIndex), nil
-		//}
+		if curPageNumber > pageNumber {
+			// break curPage. The remainder stays in local
+			curPageIndex := curPage.PageIndex()
+			m.localPages[i] = MakePageHandler(curPageNumber-pageNumber, curPageIndex+pageNumber)
+			m.addCachedPageNumber(-pageNumber)
+			return MakePageHandler(pageNumber, curPageIndex), nil
+		}
 	}
 
 	// if localPages is full but all is unuseful, free all
@@ -85,16 +130,23 @@ func (m *LocalMemory) AllocPage(pageNumber SizeType) (PageHandler, error) {
 				panic(fmt.Sprintf("AllocPage bad code %d %d", localPageLength, localPoolCapacity))
 			}
 		}
+		mu := &m.globalMemory.header().mu
+		mu.Lock()
 		for _, page := range m.localPages {
-			m.globalMemory.freePage(page)
+			m.globalMemory.releasePage(page)
 		}
+		mu.Unlock()
 		m.localPages = m.localPages[:0]
+		atomic.StoreUint64((*uint64)(&m.cachedPageNumber), 0)
 	}
 
 	/* ------------------------------ alloc from globalMemory ------------------------------ */
+	if page := m.allocPageLockFree(pageNumber); page.IsNotNull() {
+		return page, nil
+	}
 	mu := &m.globalMemory.header().mu
 
-	if pageNumber >= maxAllocOncePageNumber {
+	if pageNumber >= maxAllocOncePageNumber || pageNumber > m.maxCachedPageNumber {
 		// too big alloc
 		mu.Lock()
 		page, err := m.globalMemory.allocPage(pageNumber)
@@ -107,12 +159,14 @@ func (m *LocalMemory) AllocPage(pageNumber SizeType) (PageHandler, error) {
 	var err error
 	var page PageHandler
 	mu.Lock()
-	for allocTimes < maxAllocTimes && totalAllocPageNumber < maxAllocOncePageNumber && len(m.localPages) < localPoolCapacity {
+	for allocTimes < maxAllocTimes && totalAllocPageNumber < maxAllocOncePageNumber && len(m.localPages) < localPoolCapacity &&
+		(allocTimes == 0 || m.cachedPageNumber+pageNumber <= m.maxCachedPageNumber) { // the last one is taken
 		page, err = m.globalMemory.allocPage(pageNumber)
 		if err != nil {
 			break
 		}
 		m.localPages = append(m.localPages, page)
+		m.addCachedPageNumber(pageNumber)
 		allocTimes++
 		totalAllocPageNumber += pageNumber
 	}
@@ -139,6 +193,7 @@ func (m *LocalMemory) AllocPage(pageNumber SizeType) (PageHandler, error) {
 				}
 			}
 			m.localPages = m.localPages[:last] // pop
+			m.addCachedPageNumber(-lastPage.PageNumber())
 			return lastPage, nil
 		}
 		return nullPageHandle, err
@@ -155,6 +210,7 @@ func (m *LocalMemory) AllocPage(pageNumber SizeType) (PageHandler, error) {
 
 	lastPage := m.localPages[last]
 	m.localPages = m.localPages[:last]
+	m.addCachedPageNumber(-lastPage.PageNumber())
 	if utils.Asserted {
 		if lastPage.PageNumber() < pageNumber {
 			panic(fmt.Sprintf("AllocPage bad code lastPage.PageNumber(%d) < pageNumber(%d)", lastPage.PageNumber(), pageNumber))
@@ -164,7 +220,33 @@ func (m *LocalMemory) AllocPage(pageNumber SizeType) (PageHandler, error) {
 	return lastPage, nil
 }
 
+// allocPageLockFree caches runs bumped at once as many as allocPage under mu would. Caller holds m.mu
+func (m *LocalMemory) allocPageLockFree(pageNumber SizeType) PageHandler {
+	var times SizeType = 1
+	for times < maxAllocTimes && times*pageNumber < maxAllocOncePageNumber && len(m.localPages)+int(times) < localPoolCapacity &&
+		m.cachedPageNumber+times*pageNumber <= m.maxCachedPageNumber {
+		times++
+	}
+	page := m.globalMemory.allocPageLockFree(pageNumber, times)
+	if page.IsNull() {
+		return page
+	}
+	pageIndex := page.PageIndex()
+	for i := pageNumber; i < page.PageNumber(); i += pageNumber {
+		m.localPages = append(m.localPages, MakePageHandler(pageNumber, pageIndex+i))
+		m.addCachedPageNumber(pageNumber)
+	}
+	return MakePageHandler(pageNumber, pageIndex)
+}
+
 func (m *LocalMemory) FreePage(pageHandler PageHandler) {
+	m.mu.Lock()
+	m.freePage(pageHandler)
+	m.mu.Unlock()
+}
+
+// freePage caller holds m.mu
+func (m *LocalMemory) freePage(pageHandler PageHandler) {
 	if utils.Asserted {
 		if len(m.localPages) == 1 && m.localPages[0] == nullPageHandle {
 			panic("use a destroyed memory")
@@ -174,18 +256,32 @@ func (m *LocalMemory) FreePage(pageHandler PageHandler) {
 		if pageHandler.IsNull() {
 			panic("free null page")
 		}
-		LibZero(m.PagePointerOf(pageHandler), pageHandler.Size())
+		m.globalMemory.ZeroBytes(m.PagePointerOf(pageHandler), pageHandler.Size())
 	}
 
 	// free too big
-	if pageHandler.PageNumber() > maxAllocOncePageNumber {
+	pageNumber := pageHandler.PageNumber()
+	if pageNumber > maxAllocOncePageNumber || pageNumber > m.maxCachedPageNumber {
 		mu := &m.globalMemory.header().mu
 		mu.Lock()
-		m.globalMemory.freePage(pageHandler)
+		m.globalMemory.releasePage(pageHandler)
 		mu.Unlock()
 		return
 	}
 
+	// free cached pages out of the bound
+	if m.cachedPageNumber+pageNumber > m.maxCachedPageNumber {
+		mu := &m.globalMemory.header().mu
+		mu.Lock()
+		for m.cachedPageNumber+pageNumber > m.maxCachedPageNumber {
+			last := len(m.localPages) - 1
+			m.globalMemory.releasePage(m.localPages[last])
+			m.addCachedPageNumber(-m.localPages[last].PageNumber())
+			m.localPages = m.localPages[:last]
+		}
+		mu.Unlock()
+	}
+
 	localPageLength := len(m.localPages)
 	if localPageLength >= localPoolCapacity {
 		mu := &m.globalMemory.header().mu
@@ -200,10 +296,11 @@ func (m *LocalMemory) FreePage(pageHandler PageHandler) {
 		// free the smaller one
 		mu.Lock()
 		if pageHandler.PageNumber() < lastPage.PageNumber() {
-			m.globalMemory.freePage(pageHandler)
+			m.globalMemory.releasePage(pageHandler)
 		} else {
-			m.globalMemory.freePage(lastPage)
+			m.globalMemory.releasePage(lastPage)
 			m.localPages[last] = pageHandler
+			m.addCachedPageNumber(pageHandler.PageNumber() - lastPage.PageNumber())
 		}
 		mu.Unlock()
 		return
@@ -211,6 +308,81 @@ func (m *LocalMemory) FreePage(pageHandler PageHandler) {
 
 	// usually cache it
 	m.localPages = append(m.localPages, pageHandler)
+	m.addCachedPageNumber(pageHandler.PageNumber())
+}
+
+// addCachedPageNumber adds delta, which may be a negative number wrapped, to cachedPageNumber
+func (m *LocalMemory) addCachedPageNumber(delta SizeType) {
+	atomic.StoreUint64((*uint64)(&m.cachedPageNumber), uint64(m.cachedPageNumber+delta))
+}
+
+// CachedSize is the size of pages and small objects cached in the local memory.
+// It may be called in other threads while the local memory is used, and then is approximate
+func (m *LocalMemory) CachedSize() SizeType {
+	size := SizeType(atomic.LoadUint64((*uint64)(&m.cachedPageNumber))) << BasePageSizeShiftNumber
+	for class := range m.smallObjects {
+		size += SizeType(atomic.LoadUint64((*uint64)(&m.smallObjects[class].length))) * slabClassSize(class)
+	}
+	return size
+}
+
+// AllocSmall allocates an object not larger than MaxSmallObjectSize. Returns the object and its real size
+func (m *LocalMemory) AllocSmall(size SizeType) (Pointer, SizeType, error) {
+	if utils.Asserted {
+		if len(m.localPages) == 1 && m.localPages[0] == nullPageHandle {
+			panic("use a destroyed memory")
+		}
+	}
+	class := slabClassOf(size)
+	objects := &m.smallObjects[class]
+	m.mu.Lock()
+	if objects.length == 0 {
+		mu := &m.globalMemory.header().mu
+		mu.Lock()
+		err := m.globalMemory.allocSmallObjects(class, objects, localSmallObjectBatch)
+		mu.Unlock()
+		if err != nil {
+			m.mu.Unlock()
+			return NullPointer, 0, err
+		}
+	}
+	ptr := objects.pop()
+	m.mu.Unlock()
+	return ptr, slabClassSize(class), nil
+}
+
+// FreeSmall frees an object allocated by AllocSmall
+func (m *LocalMemory) FreeSmall(ptr Pointer) {
+	if utils.Asserted {
+		if len(m.localPages) == 1 && m.localPages[0] == nullPageHandle {
+			panic("use a destroyed memory")
+		}
+		if ptr.IsNull() {
+			panic("free null small object")
+		}
+	}
+	class := m.globalMemory.slabClassOfObject(ptr)
+	if utils.Asserted {
+		m.globalMemory.ZeroBytes(ptr, slabClassSize(class))
+	}
+	objects := &m.smallObjects[class]
+	m.mu.Lock()
+	objects.push(ptr)
+	if objects.length >= 2*localSmallObjectBatch {
+		mu := &m.globalMemory.header().mu
+		mu.Lock()
+		m.flushSmallObjects(class, localSmallObjectBatch)
+		mu.Unlock()
+	}
+	m.mu.Unlock()
+}
+
+// flushSmallObjects returns cached objects to spans until remain. Caller holds mu
+func (m *LocalMemory) flushSmallObjects(class int, remain SizeType) {
+	objects := &m.smallObjects[class]
+	for objects.length > remain {
+		m.globalMemory.freeSmallObject(objects.pop())
+	}
 }
 
 func (m *LocalMemory) PagePointerOf(pageHandler PageHandler) Pointer {
@@ -224,5 +396,9 @@ func (m *LocalMemory) FreePointer(ptr Pointer, pageNumber SizeType) {
 }
 
 func (m *LocalMemory) String() string {
-	return fmt.Sprintf("{localPages:%s}", utils.Jsonify(m.localPages))
+	smallObjectNumbers := make([]SizeType, slabClassNumber)
+	for class := range m.smallObjects {
+		smallObjectNumbers[class] = m.smallObjects[class].length
+	}
+	return fmt.Sprintf("{localPages:%s, smallObjects:%s}", utils.Jsonify(m.localPages), utils.Jsonify(smallObjectNumbers))
 }
@@ -6,7 +6,7 @@ import (
 )
 
 func TestLocalMemory(t *testing.T) {
-	memory := New(4096)
+	memory := New(4096, nil)
 	defer memory.Free()
 
 	localMemory := memory.NewLocalMemory()
@@ -28,7 +28,7 @@ func TestLocalMemory(t *testing.T) {
 }
 
 func TestLocalMemory2(t *testing.T) {
-	memory := New(4096)
+	memory := New(4096, nil)
 	defer memory.Free()
 
 	localMemory := memory.NewLocalMemory()
@@ -50,6 +50,52 @@ func TestLocalMemory2(t *testing.T) {
 	t.Log(page)
 	ptr = localMemory.PagePointerOf(page)
 	utils.Assert(memory.PointerToPageIndex(ptr) == page.PageIndex(), page, memory.PointerToPageIndex(ptr))
-	localMemory.FreePointer(ptr, 5)
+	localMemory.FreePointer(ptr, 2)
+
+}
+
+func TestLocalMemory_split(t *testing.T) {
+	memory := New(4096, nil)
+	defer memory.Free()
+
+	localMemory := memory.NewLocalMemory()
+	defer localMemory.Destroy()
+
+	page, err := localMemory.AllocPage(5)
+	utils.PanicErr(err)
+	localMemory.FreePage(page)
+	allocated := memory.AllocatedPageNumber()
+
+	page2, err := localMemory.AllocPage(2)
+	utils.PanicErr(err)
+	utils.Assert(page2.PageNumber() == 2, page2)
+	utils.Assert(memory.AllocatedPageNumber() == allocated, memory.AllocatedPageNumber(), allocated)
+	localMemory.FreePage(page2)
+}
+
+func TestLocalMemory_SetMaxCachedSize(t *testing.T) {
+	memory := New(64*MB, nil)
+	defer memory.Free()
+	localMemory := memory.NewLocalMemory()
+	localMemory.SetMaxCachedSize(1 * MB)
+	defer localMemory.Destroy()
+
+	var pages []PageHandler
+	for i := 0; i < 16; i++ {
+		page, err := localMemory.AllocPage(1024) // 256KB
+		utils.PanicErr(err)
+		pages = append(pages, page)
+		utils.Assert(localMemory.CachedSize() <= 1*MB, localMemory.CachedSize())
+	}
+	for _, page := range pages {
+		localMemory.FreePage(page)
+		utils.Assert(localMemory.CachedSize() <= 1*MB, localMemory.CachedSize())
+	}
+	page, err := localMemory.AllocPage(8192) // over the bound, not cached
+	utils.PanicErr(err)
+	localMemory.FreePage(page)
+	utils.Assert(localMemory.CachedSize() <= 1*MB, localMemory.CachedSize())
 
+	utils.Assert(localMemory.Flush() > 0 && localMemory.CachedSize() == 0)
+	utils.Assert(memory.AllocatedPageNumber() == 0, memory.AllocatedPageNumber())
 }
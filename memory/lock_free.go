@@ -0,0 +1,190 @@
+package memory
+
+import (
+	"fmt"
+	"github.com/madokast/direct/utils"
+	"runtime"
+	"sync/atomic"
+)
+
+/**
+A LocalMemory missing its cache allocates pages without mu on the fast path.
+Pages are bumped from the empty area by CAS on emptyPageIndex, within committed pages and when no freed run may fit.
+Base pages handed back by local memories are pushed to a lock-free stack, whose head tags the page index
+with a counter against ABA, and popped by allocations of one page.
+They are not merged with their neighbours until drained to free lists under mu, before OOM and when scavenging.
+Writers of emptyPageIndex under mu use CAS too, and the scavenger claims the dirty empty area by CAS before discarding it.
+Verify and SnapshotTo freeze the fast path and wait for allocations in flight, so they see a header changed only under mu.
+*/
+
+// basePageStackCapacity bounds pages in the stack, which are not merged. Beyond it base pages are freed under mu
+const basePageStackCapacity = 4096
+
+const basePageTagShift = pageNumberShift // the page index below, the tag above
+
+const lockFreeFrozen Word = 1 << 63 // in lockFreeState, above the number of lock-free allocations in flight
+
+// enterLockFree counts a lock-free allocation in flight. False if the fast path is frozen
+func (m Memory) enterLockFree() bool {
+	state := (*uint64)(&m.header().lockFreeState)
+	for {
+		s := atomic.LoadUint64(state)
+		if s&uint64(lockFreeFrozen) != 0 {
+			return false
+		}
+		if atomic.CompareAndSwapUint64(state, s, s+1) {
+			return true
+		}
+	}
+}
+
+func (m Memory) exitLockFree() {
+	atomic.AddUint64((*uint64)(&m.header().lockFreeState), ^uint64(0))
+}
+
+// freezeLockFree stops lock-free allocations and waits for those in flight, so the header is changed only under mu.
+// Caller holds mu. Unfreeze before releasing it
+func (m Memory) freezeLockFree() {
+	state := (*uint64)(&m.header().lockFreeState)
+	for {
+		s := atomic.LoadUint64(state)
+		if atomic.CompareAndSwapUint64(state, s, s|uint64(lockFreeFrozen)) {
+			break
+		}
+	}
+	for atomic.LoadUint64(state) != uint64(lockFreeFrozen) {
+		runtime.Gosched()
+	}
+}
+
+func (m Memory) unfreezeLockFree() {
+	atomic.AddUint64((*uint64)(&m.header().lockFreeState), uint64(lockFreeFrozen)) // the bit is set, so adding clears it
+}
+
+// casEmptyPageIndex moves emptyPageIndex from old to new if no one moved it
+func (m Memory) casEmptyPageIndex(old, new SizeType) bool {
+	return atomic.CompareAndSwapUint64((*uint64)(&m.header().emptyPageIndex), uint64(old), uint64(new))
+}
+
+// addLockFreeAllocatedPageNumber adds delta, which may be a negative number wrapped, to pages allocated without mu
+func (m Memory) addLockFreeAllocatedPageNumber(delta SizeType) {
+	atomic.AddUint64((*uint64)(&m.header().lockFreeAllocatedPageNumber), uint64(delta))
+}
+
+// allocPageLockFree allocates without mu a base page from the stack, or times runs of pageNumber pages bumped at once.
+// Null if it cannot or the fast path is frozen, then allocPage under mu
+func (m Memory) allocPageLockFree(pageNumber, times SizeType) PageHandler {
+	if !m.enterLockFree() {
+		return nullPageHandle
+	}
+	defer m.exitLockFree()
+	if pageNumber == 1 {
+		if page := m.popBasePage(); page.IsNotNull() {
+			return page
+		}
+	}
+	header := m.header()
+	if header.hugePageAligned && pageNumber >= hugePagePageNumber {
+		return nullPageHandle
+	}
+	// freed runs are used first against fragmentation
+	if atomic.LoadUint64((*uint64)(&header.freedPageClassBitmap))>>freedPageClassOf(pageNumber) != 0 {
+		return nullPageHandle
+	}
+	return m.bumpPage(pageNumber * times)
+}
+
+// bumpPage allocates committed pages from the empty area by CAS. Null if not enough
+func (m Memory) bumpPage(pageNumber SizeType) PageHandler {
+	header := m.header()
+	for {
+		emptyPageIndex := m.emptyPageIndex()
+		newEmpty := emptyPageIndex + pageNumber
+		if newEmpty > header.maxPageIndex || newEmpty > SizeType(atomic.LoadUint64((*uint64)(&header.committedPageIndex))) {
+			return nullPageHandle
+		}
+		if m.casEmptyPageIndex(emptyPageIndex, newEmpty) {
+			m.addLockFreeAllocatedPageNumber(pageNumber)
+			return MakePageHandler(pageNumber, emptyPageIndex)
+		}
+	}
+}
+
+// releasePage frees a page from a local memory. A base page is pushed to the stack unless full. Caller holds mu
+func (m Memory) releasePage(pageHandler PageHandler) {
+	if pageHandler.PageNumber() == 1 && m.pushBasePage(pageHandler) {
+		return
+	}
+	m.freePage(pageHandler)
+}
+
+// pushBasePage pushes a freed base page to the stack. False if the stack is full
+func (m Memory) pushBasePage(page PageHandler) bool {
+	header := m.header()
+	length := (*uint64)(&header.basePageStackLength)
+	if atomic.AddUint64(length, 1) > basePageStackCapacity {
+		atomic.AddUint64(length, ^uint64(0))
+		return false
+	}
+	if utils.Asserted {
+		m.ZeroBytes(m.PagePointerOf(page), BasePageSize)
+	}
+	m.addLockFreeAllocatedPageNumber(^SizeType(0))
+	next := (*uint64)(m.PagePointerOf(page).UnsafePointer())
+	for {
+		head := atomic.LoadUint64((*uint64)(&header.basePages))
+		atomic.StoreUint64(next, head&uint64(pageIndexMask))
+		tag := (head>>basePageTagShift + 1) << basePageTagShift
+		if atomic.CompareAndSwapUint64((*uint64)(&header.basePages), head, tag|uint64(page.PageIndex())) {
+			return true
+		}
+	}
+}
+
+// popBasePage pops a base page from the stack. Null if empty
+func (m Memory) popBasePage() PageHandler {
+	header := m.header()
+	for {
+		head := atomic.LoadUint64((*uint64)(&header.basePages))
+		pageIndex := SizeType(head & uint64(pageIndexMask))
+		if pageIndex == 0 {
+			return nullPageHandle
+		}
+		page := MakePageHandler(1, pageIndex)
+		next := (*uint64)(m.PagePointerOf(page).UnsafePointer())
+		// next may be garbage if the page is popped by others meanwhile. Then the tag changed and CAS fails
+		tag := (head>>basePageTagShift + 1) << basePageTagShift
+		if atomic.CompareAndSwapUint64((*uint64)(&header.basePages), head, tag|atomic.LoadUint64(next)&uint64(pageIndexMask)) {
+			atomic.StoreUint64(next, 0)
+			atomic.AddUint64((*uint64)(&header.basePageStackLength), ^uint64(0))
+			m.addLockFreeAllocatedPageNumber(1)
+			return page
+		}
+	}
+}
+
+// drainBasePages frees pages in the stack to free lists, so they are merged. Returns the number drained. Caller holds mu
+func (m Memory) drainBasePages() SizeType {
+	var number SizeType = 0
+	for page := m.popBasePage(); page.IsNotNull(); page = m.popBasePage() {
+		m.freePage(page)
+		number++
+	}
+	if utils.Debug && number > 0 {
+		fmt.Println("drain", number, "base pages")
+	}
+	return number
+}
+
+// basePagesInStack lists pages in the stack. No one should use the memory meanwhile.
+// The walk stops at a page out of the memory, or beyond the capacity for a broken stack
+func (m Memory) basePagesInStack() (pages []PageHandler) {
+	header := m.header()
+	pageIndex := SizeType(header.basePages & Word(pageIndexMask))
+	for pageIndex != 0 && pageIndex < header.maxPageIndex && len(pages) <= basePageStackCapacity {
+		page := MakePageHandler(1, pageIndex)
+		pages = append(pages, page)
+		pageIndex = *PointerAs[SizeType](m.PagePointerOf(page))
+	}
+	return pages
+}
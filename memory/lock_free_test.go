@@ -0,0 +1,148 @@
+package memory
+
+import (
+	"fmt"
+	"github.com/madokast/direct/utils"
+	"io"
+	"runtime"
+	"sync"
+	"testing"
+)
+
+func TestMemory_lockFree(t *testing.T) {
+	memory := New(64*MB, nil)
+	defer memory.Free()
+
+	var wg sync.WaitGroup
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			local := memory.NewLocalMemory()
+			local.SetMaxCachedSize(4 * KB)
+			defer local.Destroy()
+			var pages []PageHandler
+			for i := 0; i < 20000; i++ {
+				page, err := local.AllocPage(SizeType(1 + (i*g)%3))
+				utils.PanicErr(err)
+				*PointerAs[int](memory.PagePointerOf(page)) = g
+				pages = append(pages, page)
+				if len(pages) == 128 {
+					for _, page := range pages {
+						utils.Assert(*PointerAs[int](memory.PagePointerOf(page)) == g) // never shared
+						*PointerAs[int](memory.PagePointerOf(page)) = 0
+						local.FreePage(page)
+					}
+					pages = pages[:0]
+				}
+			}
+			for _, page := range pages {
+				*PointerAs[int](memory.PagePointerOf(page)) = 0
+				local.FreePage(page)
+			}
+		}(g)
+	}
+	wg.Wait()
+	utils.PanicErr(memory.Verify())
+	t.Log(len(memory.basePagesInStack()), "base pages in the stack")
+	memory.Scavenge() // drains the stack
+	utils.Assert(len(memory.basePagesInStack()) == 0)
+	utils.PanicErr(memory.Verify())
+	utils.Assert(memory.AllocatedPageNumber() == 0, memory.AllocatedPageNumber())
+}
+
+func TestMemory_freezeLockFree(t *testing.T) {
+	memory := New(64*MB, nil)
+	defer memory.Free()
+	header := memory.header()
+	header.mu.Lock()
+	memory.freezeLockFree()
+	utils.Assert(memory.allocPageLockFree(1, 1).IsNull())
+	memory.unfreezeLockFree()
+	header.mu.Unlock()
+	page := memory.allocPageLockFree(1, 1)
+	utils.Assert(page.IsNotNull())
+	header.mu.Lock()
+	memory.releasePage(page)
+	header.mu.Unlock()
+
+	// verify and snapshot while allocating
+	var wg sync.WaitGroup
+	stop := make(chan struct{})
+	for g := 0; g < 4; g++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			local := memory.NewLocalMemory()
+			local.SetMaxCachedSize(4 * KB)
+			defer local.Destroy()
+			var pages []PageHandler
+			for {
+				select {
+				case <-stop:
+					for _, page := range pages {
+						local.FreePage(page)
+					}
+					return
+				default:
+				}
+				for i := 0; i < 64; i++ {
+					pages = append(pages, utils.PanicErr1(local.AllocPage(SizeType(1+i%2))))
+				}
+				for _, page := range pages {
+					local.FreePage(page)
+				}
+				pages = pages[:0]
+			}
+		}()
+	}
+	for i := 0; i < 200; i++ {
+		utils.PanicErr(memory.Verify())
+		utils.PanicErr(memory.SnapshotTo(io.Discard, 0))
+		runtime.Gosched()
+	}
+	close(stop)
+	wg.Wait()
+	utils.PanicErr(memory.Verify())
+	utils.Assert(memory.AllocatedPageNumber() == 0, memory.AllocatedPageNumber())
+}
+
+// benchmarkContention allocates runs of pageNumber pages in parallel, missing local caches mostly
+func benchmarkContention(b *testing.B, pageNumber SizeType) {
+	for _, procs := range []int{1, 8, 64} {
+		b.Run(fmt.Sprintf("GOMAXPROCS=%d", procs), func(b *testing.B) {
+			defer runtime.GOMAXPROCS(runtime.GOMAXPROCS(procs))
+			memory := New(256*MB, nil)
+			defer memory.Free()
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				local := memory.NewLocalMemory()
+				local.SetMaxCachedSize(4 * KB)
+				defer local.Destroy()
+				pages := make([]PageHandler, 0, 64)
+				for pb.Next() {
+					page, err := local.AllocPage(pageNumber)
+					utils.PanicErr(err)
+					pages = append(pages, page)
+					if len(pages) == cap(pages) {
+						for _, page := range pages {
+							local.FreePage(page)
+						}
+						pages = pages[:0]
+					}
+				}
+				for _, page := range pages {
+					local.FreePage(page)
+				}
+			})
+		})
+	}
+}
+
+func BenchmarkContention_basePage(b *testing.B) {
+	benchmarkContention(b, 1)
+}
+
+func BenchmarkContention_run(b *testing.B) {
+	benchmarkContention(b, 8)
+}
@@ -1,9 +1,11 @@
 package memory
 
 import (
+	"errors"
 	"fmt"
 	"github.com/madokast/direct/utils/spin"
 	"os"
+	"sync/atomic"
 	"unsafe"
 )
 
@@ -11,47 +13,156 @@ import (
 type Memory Pointer
 
 type memoryHeader struct {
-	pageBasePointer         Pointer     // pointer to the zero-th page
-	freedBasePageHeader     PageHandler // a list header of freed page of BasePageSize. Nullable
-	freedCombinedPageHeader PageHandler // a list header of freed combined page. Nullable
-	maxPageIndex            SizeType    // OOM when emptyPageIndex > maxPageIndex and no free
-	emptyPageIndex          SizeType    // next page when no proper freed page
-	libPointer              Pointer     // used for free
-	allocatedPageNumber     SizeType    // statistical
-	mu                      spin.Mutex
+	magic                       Word                              // memoryMagic. Checked when opening a file
+	pageBaseOffset              SizeType                          // offset of the zero-th page from the memory. The header keeps no absolute pointer
+	freedPageHeaders            [freedPageClassNumber]PageHandler // list headers of freed runs by size class. Nullable
+	freedPageClassBitmap        Word                              // bit c is set when freedPageHeaders[c] is not empty
+	maxPageIndex                SizeType                          // OOM when emptyPageIndex > maxPageIndex and no free
+	emptyPageIndex              SizeType                          // next page when no proper freed page
+	libPointer                  Pointer                           // used for free. The start of the mapping, or where a file is mapped first
+	allocatedPageNumber         SizeType                          // statistical
+	slabPartialSpans            [slabClassNumber]PageHandler      // slab spans having free objects by class. Nullable
+	committedPageIndex          SizeType                          // pages before it are accessible. Grows up to maxPageIndex in a reserved memory
+	reservedSize                SizeType                          // size of the reserved address space. 0 if not reserved
+	fileSize                    SizeType                          // size of the mapped file. 0 if not file-backed
+	rootDirectory               PageHandler                       // named roots. Nullable
+	dirtyPageIndex              SizeType                          // pages in [emptyPageIndex, dirtyPageIndex) are used once and not scavenged
+	freedSinceScavenge          SizeType                          // page number freed after the last scavenge
+	scavengeThreshold           SizeType                          // scavenge when freedSinceScavenge reaches it. 0 for off
+	scavengedSize               SizeType                          // statistical
+	hugePages                   HugePages                         // how the memory is backed by huge pages
+	hugePageAligned             bool                              // the zero-th page is aligned to the huge page. See alignPageBase
+	basePages                   Word                              // lock-free stack of freed base pages. See pushBasePage
+	basePageStackLength         SizeType                          // of basePages. Approximate
+	lockFreeAllocatedPageNumber SizeType                          // allocated minus freed without mu. Wraps. See AllocatedPageNumber
+	lockFreeState               Word                              // lockFreeFrozen and lock-free allocations in flight. See freezeLockFree
+	backendIndex                SizeType                          // in backends of the process. 0 if mapped by the OS directly
+	mu                          spin.SharedMutex                  // memory may be shared between processes
 }
 
 const NullMemory = Memory(NullPointer)
 
-func New(size SizeType) Memory {
-	ptr := LibMalloc(((size + 7) & (SizeTypeMax - 7)) + 8) // align
+// memoryMagic is "DIRECT", whether collections store refs, and the layout version of memoryHeader.
+// Memories of the relocatable build and of the other cannot be opened by each other
+const memoryMagic Word = 0x544345524944<<16 | relocatableMagic<<8 | 7
+
+// checkMagic returns an error telling why a memory of the magic cannot be opened. Nil if it can
+func checkMagic(magic Word) error {
+	if magic == memoryMagic {
+		return nil
+	}
+	if magic^memoryMagic == 1<<8 {
+		if Relocatable {
+			return errors.New("the memory is made without the relocatable build tag, so its collections store absolute pointers")
+		}
+		return errors.New("the memory is made by the relocatable build tag, so its collections store refs")
+	}
+	return errors.New("not a memory or its version is not supported")
+}
+
+// New allocates a memory of size by the backend, or the default backend if nil
+func New(size SizeType, backend Backend) Memory {
+	if backend == nil {
+		backend = defaultBackend
+	}
+	ptr := backend.Alloc(((size + 7) & (SizeTypeMax - 7)) + 8) // align
+	if ptr.IsNull() {
+		panic(fmt.Sprintf("cannot allocate memory %s", HumanFriendlyMemorySize(size)))
+	}
 	m := Memory((ptr + 7) & Pointer(SizeTypeMax-7))
+	m.initHeader(ptr, size, registerBackend(backend))
+	m.startTrace()
+	return m
+}
+
+// NewReserved reserves address space of maxSize but commits only size at first.
+// More memory is committed in chunks when the allocated pages grow, so OOM happens at maxSize
+func NewReserved(size, maxSize SizeType) Memory {
+	if size > maxSize {
+		maxSize = size
+	}
+	maxSize = (maxSize + 7) & (SizeTypeMax - 7)
+	ptr := libReserve(maxSize)
+	if ptr.IsNull() {
+		panic(fmt.Sprintf("cannot reserve memory %s", HumanFriendlyMemorySize(maxSize)))
+	}
+	m := Memory(ptr) // aligned to the OS page
+	m.initReserved(ptr, maxSize, size, maxSize, false)
+	m.startTrace()
+	return m
+}
+
+// initReserved inits a memory of maxSize at m in the address space of reservedSize from libPointer, and commits size.
+// Pages are aligned to the huge page if hugePageAligned. Panics if the OS refuses
+func (m Memory) initReserved(libPointer Pointer, reservedSize, size, maxSize SizeType, hugePageAligned bool) {
+	bitmapSize := freeBoundaryBitmapSize((maxSize - memoryHeaderSize) >> BasePageSizeShiftNumber)
+	if !libCommit(m.pointer(), memoryHeaderSize+bitmapSize) {
+		libRelease(libPointer, reservedSize)
+		panic(fmt.Sprintf("cannot commit memory %s", HumanFriendlyMemorySize(memoryHeaderSize+bitmapSize)))
+	}
+	m.initHeader(libPointer, maxSize, 0)
+	if hugePageAligned {
+		m.alignPageBase(maxSize)
+	}
+	header := m.header()
+	header.committedPageIndex = 1 // nothing committed
+	header.reservedSize = reservedSize
+	if pagesOffset := header.pageBaseOffset + BasePageSize; size > pagesOffset && !m.commitTo((size-pagesOffset)>>BasePageSizeShiftNumber) {
+		libRelease(libPointer, reservedSize)
+		panic(fmt.Sprintf("cannot commit memory %s", HumanFriendlyMemorySize(size)))
+	}
+}
+
+// initHeader inits an empty memory of size bytes at m, of the backend in backends. The header and the bitmap must be accessible
+func (m Memory) initHeader(libPointer Pointer, size SizeType, backendIndex SizeType) {
 	header := m.header()
-	header.pageBasePointer = m.pointer() + Pointer(memoryHeaderSize) - Pointer(BasePageSize)
-	header.freedBasePageHeader = nullPageHandle
-	header.freedCombinedPageHeader = nullPageHandle
-	header.maxPageIndex = (size - memoryHeaderSize) >> BasePageSizeShiftNumber
+	header.backendIndex = backendIndex // zeroes the bitmap
+	bitmapSize := freeBoundaryBitmapSize((size - memoryHeaderSize) >> BasePageSizeShiftNumber)
+	header.magic = memoryMagic
+	m.ZeroBytes(m.freeBoundaryBitmap(), bitmapSize)
+	header.pageBaseOffset = memoryHeaderSize + bitmapSize - BasePageSize
+	header.freedPageHeaders = [freedPageClassNumber]PageHandler{}
+	header.freedPageClassBitmap = 0
+	header.slabPartialSpans = [slabClassNumber]PageHandler{}
+	header.maxPageIndex = (size - memoryHeaderSize - bitmapSize) >> BasePageSizeShiftNumber
 	header.emptyPageIndex = 1 // from one pass the null
-	header.libPointer = ptr
+	header.libPointer = libPointer
 	header.allocatedPageNumber = 0
-	header.mu = spin.Mutex{} // zero
-	if Trace {
-		m.startTrace()
-	}
-	return m
+	header.committedPageIndex = header.maxPageIndex
+	header.reservedSize = 0
+	header.fileSize = 0
+	header.rootDirectory = nullPageHandle
+	header.dirtyPageIndex = 1
+	header.freedSinceScavenge = 0
+	header.scavengeThreshold = 0
+	header.scavengedSize = 0
+	header.hugePages = HugePagesNone
+	header.hugePageAligned = false
+	header.basePages = 0
+	header.basePageStackLength = 0
+	header.lockFreeAllocatedPageNumber = 0
+	header.lockFreeState = 0
+	header.mu = spin.SharedMutex{} // zero
 }
 
+// Free releases the memory. A file-backed memory is unmapped and its file is kept
 func (m Memory) Free() {
-	LibFree(m.header().libPointer)
-	if Trace {
-		m.deleteTracer()
+	header := m.header()
+	m.StopTrace()
+	if header.fileSize > 0 {
+		m.releaseFile()
+		libUnmapFile(m.pointer(), header.fileSize) // may be mapped at another address
+	} else if header.reservedSize > 0 {
+		libRelease(header.libPointer, header.reservedSize)
+	} else {
+		m.Backend().Free(header.libPointer)
 	}
 }
 
 // IsMemoryLeak call it before Free
 func (m Memory) IsMemoryLeak() bool {
-	if Trace {
-		return m.Tracer().hasLeak()
+	if t := m.Tracer(); t != nil {
+		return t.hasLeak()
 	} else {
 		_, _ = fmt.Fprintln(os.Stderr, "Memory trace is off. Turn on for leak check")
 		return false
@@ -60,8 +171,8 @@ func (m Memory) IsMemoryLeak() bool {
 
 // MemoryLeakInfo call it before Free
 func (m Memory) MemoryLeakInfo() string {
-	if Trace {
-		return fmt.Sprint("Statistic info: \n", m.String(), "\n leaking objects: \n", m.Tracer().leakReport())
+	if t := m.Tracer(); t != nil {
+		return fmt.Sprint("Statistic info: \n", m.String(), "\n leaking objects: \n", t.leakReport())
 	} else {
 		_, _ = fmt.Fprintln(os.Stderr, "Memory trace is off. Turn on for more info")
 		return fmt.Sprint("Statistic info: ", m.String())
@@ -76,28 +187,47 @@ func (m Memory) pointer() Pointer {
 	return Pointer(m)
 }
 
+// pageBasePointer points to the zero-th page
+func (m Memory) pageBasePointer() Pointer {
+	return m.pointer() + Pointer(m.header().pageBaseOffset)
+}
+
+// freeBoundaryBitmap has one bit per page. Set on the first and the last page of a freed run
+func (m Memory) freeBoundaryBitmap() Pointer {
+	return m.pointer() + Pointer(memoryHeaderSize)
+}
+
 func (m Memory) maxPageIndex() SizeType {
 	return m.header().maxPageIndex
 }
 
+// emptyPageIndex may be moved by bumpers without mu. See bumpPage
 func (m Memory) emptyPageIndex() SizeType {
-	return m.header().emptyPageIndex
+	return SizeType(atomic.LoadUint64((*uint64)(&m.header().emptyPageIndex)))
+}
+
+func (m Memory) freedPageHeader(class int) PageHandler {
+	return m.header().freedPageHeaders[class]
 }
 
-func (m Memory) freedBasePageHeader() PageHandler {
-	return m.header().freedBasePageHeader
+// CommittedSize is the size of accessible pages. It equals to the total size if not reserved
+func (m Memory) CommittedSize() SizeType {
+	return (SizeType(atomic.LoadUint64((*uint64)(&m.header().committedPageIndex))) - 1) << BasePageSizeShiftNumber
 }
 
-func (m Memory) freedCombinedPageHeader() PageHandler {
-	return m.header().freedCombinedPageHeader
+// TotalSize is the size of all pages. It is allocated before OOM
+func (m Memory) TotalSize() SizeType {
+	return m.header().maxPageIndex << BasePageSizeShiftNumber
 }
 
+// AllocatedPageNumber is the number of pages allocated, including pages cached in local memories. Thread-safe
 func (m Memory) AllocatedPageNumber() SizeType {
-	return m.header().allocatedPageNumber
+	header := m.header()
+	return SizeType(atomic.LoadUint64((*uint64)(&header.allocatedPageNumber)) + atomic.LoadUint64((*uint64)(&header.lockFreeAllocatedPageNumber)))
 }
 
 var memoryHeaderSize = SizeType(unsafe.Sizeof(memoryHeader{}))
 
 func (m Memory) header() *memoryHeader {
-	return (*memoryHeader)(unsafe.Pointer(uintptr(m)))
+	return (*memoryHeader)(unsafePointerOf(m.pointer()))
 }
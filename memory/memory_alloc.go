@@ -3,74 +3,166 @@ package memory
 import (
 	"fmt"
 	"github.com/madokast/direct/utils"
+	"math/bits"
 	"reflect"
+	"sync/atomic"
 	"unsafe"
 )
 
 func (m Memory) allocPage(pageNumber SizeType) (PageHandler, error) {
 	header := m.header()
+	// a large run covered by whole huge pages. Unaligned if cannot
+	if header.hugePageAligned && pageNumber >= hugePagePageNumber {
+		if page, err := m.allocAlignedPage(pageNumber, hugePagePageNumber); err == nil {
+			return page, nil
+		}
+	}
 	// alloc from freed
-	if pageNumber == 1 {
-		freedBasePageHeader := header.freedBasePageHeader
-		if freedBasePageHeader.IsNotNull() {
-			nextFreedPage := m.nextFreedPage(freedBasePageHeader)
-			header.freedBasePageHeader = nextFreedPage
-			if utils.Debug {
-				fmt.Println("alloc page from freedBasePage", freedBasePageHeader)
+	if page := m.allocFromFreedPage(pageNumber); page.IsNotNull() {
+		return page, nil
+	}
+	// from new. Bumpers without mu may move emptyPageIndex meanwhile
+	for {
+		emptyPageIndex := m.emptyPageIndex()
+		newEmpty := emptyPageIndex + pageNumber
+		if newEmpty > header.maxPageIndex || !m.commitTo(newEmpty) {
+			if m.drainBasePages() > 0 {
+				return m.allocPage(pageNumber)
 			}
-			header.allocatedPageNumber++
-			return freedBasePageHeader, nil
+			e := OOMError{
+				pageNumber: pageNumber,
+				details:    m.String(),
+			}
+			return nullPageHandle, &e
 		}
-	} else {
-		previous := nullPageHandle
-		combinedPageHeader := header.freedCombinedPageHeader
-		for combinedPageHeader.IsNotNull() {
-			linked := PointerAs[linkedFreePageHeader](m.PagePointerOf(combinedPageHeader))
-			if linked.pageNumber >= pageNumber {
-				if previous.IsNull() {
-					header.freedCombinedPageHeader = linked.next
-				} else {
-					PointerAs[linkedFreePageHeader](m.PagePointerOf(previous)).next = linked.next
-				}
-				if utils.Debug {
-					fmt.Println("alloc", pageNumber, "pages from combinedPage", combinedPageHeader)
-				}
-				header.allocatedPageNumber += linked.pageNumber
-				return combinedPageHeader, nil
+		if m.casEmptyPageIndex(emptyPageIndex, newEmpty) {
+			handler := MakePageHandler(pageNumber, emptyPageIndex)
+			if utils.Debug {
+				fmt.Println("alloc page from empty", handler)
 			}
-			previous = combinedPageHeader
-			combinedPageHeader = linked.next
+			header.allocatedPageNumber += pageNumber
+			return handler, nil
 		}
-		if utils.Debug {
-			if header.freedCombinedPageHeader.IsNotNull() {
-				fmt.Println("failed to reuse combined pages when alloc", pageNumber, "pages")
+	}
+}
+
+// allocAlignedPage allocates pageNumber pages whose page index is a multiple of align
+func (m Memory) allocAlignedPage(pageNumber SizeType, align SizeType) (PageHandler, error) {
+	header := m.header()
+	if page := m.allocFromFreedPage(pageNumber + align - 1); page.IsNotNull() {
+		return m.trimAlignedPage(page, pageNumber, align), nil
+	}
+	// from new. The gap before the aligned index is freed
+	for {
+		emptyPageIndex := m.emptyPageIndex()
+		alignedIndex := (emptyPageIndex + align - 1) / align * align
+		newEmpty := alignedIndex + pageNumber
+		if newEmpty > header.maxPageIndex || !m.commitTo(newEmpty) {
+			if m.drainBasePages() > 0 {
+				return m.allocAlignedPage(pageNumber, align)
 			}
+			e := OOMError{
+				pageNumber: pageNumber,
+				details:    m.String(),
+			}
+			return nullPageHandle, &e
+		}
+		if m.casEmptyPageIndex(emptyPageIndex, newEmpty) {
+			page := MakePageHandler(newEmpty-emptyPageIndex, emptyPageIndex)
+			header.allocatedPageNumber += page.PageNumber()
+			return m.trimAlignedPage(page, pageNumber, align), nil
 		}
 	}
-	// from new
-	newEmpty := header.emptyPageIndex + pageNumber
-	if newEmpty > header.maxPageIndex {
-		e := OOMError{
-			pageNumber: pageNumber,
-			details:    m.String(),
+}
+
+// commitTo commits pages before pageIndex in chunks of reservedCommitPageNumber. False if the OS refuses
+func (m Memory) commitTo(pageIndex SizeType) bool {
+	header := m.header()
+	if pageIndex <= header.committedPageIndex {
+		return true
+	}
+	target := (pageIndex + reservedCommitPageNumber - 1) &^ (reservedCommitPageNumber - 1)
+	if target > header.maxPageIndex {
+		target = header.maxPageIndex
+	}
+	from := m.pageBasePointer() + Pointer(header.committedPageIndex<<BasePageSizeShiftNumber)
+	to := m.pageBasePointer() + Pointer(target<<BasePageSizeShiftNumber)
+	if !libCommit(from, SizeType(to-from)) {
+		return false
+	}
+	if utils.Debug {
+		fmt.Println("commit pages to", target)
+	}
+	atomic.StoreUint64((*uint64)(&header.committedPageIndex), uint64(target)) // read by bumpers
+	return true
+}
+
+// trimAlignedPage frees the head and the tail of page out of the aligned pageNumber pages
+func (m Memory) trimAlignedPage(page PageHandler, pageNumber SizeType, align SizeType) PageHandler {
+	pageIndex := page.PageIndex()
+	alignedIndex := (pageIndex + align - 1) / align * align
+	if alignedIndex > pageIndex {
+		m.freePage(MakePageHandler(alignedIndex-pageIndex, pageIndex))
+	}
+	tailIndex := alignedIndex + pageNumber
+	if endIndex := pageIndex + page.PageNumber(); endIndex > tailIndex {
+		m.freePage(MakePageHandler(endIndex-tailIndex, tailIndex))
+	}
+	return MakePageHandler(pageNumber, alignedIndex)
+}
+
+// allocFromFreedPage splits pageNumber pages from a freed run large enough.
+// The remainder goes back to free lists. Null if not found
+func (m Memory) allocFromFreedPage(pageNumber SizeType) PageHandler {
+	header := m.header()
+	run := nullPageHandle
+	// first-fit in the own class, whose runs may be smaller than pageNumber
+	class := freedPageClassOf(pageNumber)
+	candidate := header.freedPageHeaders[class]
+	for i := 0; i < freedPageClassScanLimit && candidate.IsNotNull(); i++ {
+		if candidate.PageNumber() >= pageNumber {
+			run = candidate
+			break
 		}
-		return nullPageHandle, &e
+		candidate = m.nextFreedPage(candidate)
+	}
+	// any run in a larger class fits
+	if run.IsNull() {
+		largerClasses := header.freedPageClassBitmap &^ ((2 << class) - 1)
+		if largerClasses == 0 {
+			if utils.Debug {
+				if header.freedPageClassBitmap != 0 {
+					fmt.Println("failed to reuse freed pages when alloc", pageNumber, "pages")
+				}
+			}
+			return nullPageHandle
+		}
+		run = header.freedPageHeaders[bits.TrailingZeros64(largerClasses)]
+	}
+
+	runPageNumber := run.PageNumber()
+	pageIndex := run.PageIndex()
+	m.unlinkFreedRun(run)
+	if runPageNumber > pageNumber {
+		// the neighbours of a freed run are never free. No need to merge the remainder
+		m.linkFreedRun(MakePageHandler(runPageNumber-pageNumber, pageIndex+pageNumber))
 	}
-	handler := MakePageHandler(pageNumber, header.emptyPageIndex)
-	header.emptyPageIndex = newEmpty
+	page := MakePageHandler(pageNumber, pageIndex)
 	if utils.Debug {
-		fmt.Println("alloc page from empty", handler)
+		fmt.Println("alloc", pageNumber, "pages from freed run", run)
 	}
 	header.allocatedPageNumber += pageNumber
-	return handler, nil
+	return page
 }
 
+// freePage returns the run to free lists.
+// The run is merged with its adjacent freed runs, and given back to the empty area if it reaches emptyPageIndex
 func (m Memory) freePage(pageHandler PageHandler) {
 	if utils.Asserted {
 		if pageHandler.IsNull() {
 			panic("free null page")
 		}
-		LibZero(m.PagePointerOf(pageHandler), pageHandler.Size())
+		m.ZeroBytes(m.PagePointerOf(pageHandler), pageHandler.Size())
 	}
 	pageNumber := pageHandler.PageNumber()
 	if utils.Asserted {
@@ -79,33 +171,150 @@ func (m Memory) freePage(pageHandler PageHandler) {
 		}
 	}
 	header := m.header()
+	header.allocatedPageNumber -= pageNumber
+	header.freedSinceScavenge += pageNumber
 
-	pagePtr := m.PagePointerOf(pageHandler)
-	// return to linklist
-	if pageNumber == 1 {
-		if header.freedBasePageHeader.IsNull() {
-			header.freedBasePageHeader = pageHandler
-			PointerAs[linkedFreePageHeader](pagePtr).next = nullPageHandle
-		} else {
-			PointerAs[linkedFreePageHeader](pagePtr).next = header.freedBasePageHeader
-			header.freedBasePageHeader = pageHandler
+	pageIndex := pageHandler.PageIndex()
+	endPageIndex := pageIndex + pageNumber
+	// merge the left neighbour. Page 0 is the null page
+	if pageIndex > 1 && m.isFreeBoundary(pageIndex-1) {
+		left := m.freedRunEndAt(pageIndex - 1)
+		m.unlinkFreedRun(left)
+		pageIndex = left.PageIndex()
+	}
+	// merge the right neighbour
+	emptyPageIndex := m.emptyPageIndex()
+	if endPageIndex < emptyPageIndex && m.isFreeBoundary(endPageIndex) {
+		right := m.freedRunStartAt(endPageIndex)
+		m.unlinkFreedRun(right)
+		endPageIndex += right.PageNumber()
+	}
+	if utils.Asserted {
+		if endPageIndex > emptyPageIndex {
+			panic(fmt.Sprintf("freed run [%d, %d) exceeds emptyPageIndex %d", pageIndex, endPageIndex, emptyPageIndex))
+		}
+	}
+	// return to empty, unless bumped meanwhile
+	if endPageIndex == emptyPageIndex && m.casEmptyPageIndex(emptyPageIndex, pageIndex) {
+		if header.dirtyPageIndex < endPageIndex {
+			header.dirtyPageIndex = endPageIndex
+		}
+		if utils.Debug {
+			fmt.Println("free pages to empty", pageIndex)
 		}
 	} else {
-		PointerAs[linkedFreePageHeader](pagePtr).pageNumber = pageNumber
-		if header.freedCombinedPageHeader.IsNull() {
-			header.freedCombinedPageHeader = pageHandler
-			PointerAs[linkedFreePageHeader](pagePtr).next = nullPageHandle
+		m.linkFreedRun(MakePageHandler(endPageIndex-pageIndex, pageIndex))
+	}
+	m.scavengeIfNeeded()
+}
+
+// linkFreedRun pushes the run to the head of the list of its class and writes its boundary tags
+func (m Memory) linkFreedRun(run PageHandler) {
+	header := m.header()
+	pageNumber := run.PageNumber()
+	class := freedPageClassOf(pageNumber)
+
+	linked := PointerAs[linkedFreePageHeader](m.PagePointerOf(run))
+	linked.pageNumber = pageNumber
+	linked.scavenged = false
+	linked.prev = nullPageHandle
+	linked.next = header.freedPageHeaders[class]
+	linked.listLength = 1
+	if linked.next.IsNotNull() {
+		next := PointerAs[linkedFreePageHeader](m.PagePointerOf(linked.next))
+		next.prev = run
+		linked.listLength += next.listLength
+	}
+	header.freedPageHeaders[class] = run
+	if header.freedPageClassBitmap&(1<<class) == 0 {
+		atomic.StoreUint64((*uint64)(&header.freedPageClassBitmap), uint64(header.freedPageClassBitmap|1<<class)) // read by bumpers
+	}
+
+	first := run.PageIndex()
+	last := first + pageNumber - 1
+	*PointerAs[freePageFooter](m.freePageFooterPointer(last)) = freePageFooter{firstPageIndex: first}
+	m.setFreeBoundary(first)
+	m.setFreeBoundary(last)
+}
+
+// unlinkFreedRun removes the run from its list and clears its boundary tags
+func (m Memory) unlinkFreedRun(run PageHandler) {
+	header := m.header()
+	linked := PointerAs[linkedFreePageHeader](m.PagePointerOf(run))
+	pageNumber := linked.pageNumber
+	if utils.Asserted {
+		if run.PageNumber() != pageNumber {
+			panic(fmt.Sprintf("unlink %s but the freed run has %d pages", run.String(), pageNumber))
+		}
+	}
+
+	if linked.prev.IsNull() {
+		class := freedPageClassOf(pageNumber)
+		header.freedPageHeaders[class] = linked.next
+		if linked.next.IsNull() {
+			atomic.StoreUint64((*uint64)(&header.freedPageClassBitmap), uint64(header.freedPageClassBitmap&^(1<<class)))
 		} else {
-			PointerAs[linkedFreePageHeader](pagePtr).next = header.freedCombinedPageHeader
-			header.freedCombinedPageHeader = pageHandler
+			PointerAs[linkedFreePageHeader](m.PagePointerOf(linked.next)).listLength = linked.listLength - 1
 		}
+	} else {
+		PointerAs[linkedFreePageHeader](m.PagePointerOf(header.freedPageHeaders[freedPageClassOf(pageNumber)])).listLength--
+		PointerAs[linkedFreePageHeader](m.PagePointerOf(linked.prev)).next = linked.next
 	}
-	header.allocatedPageNumber -= pageNumber
+	if linked.next.IsNotNull() {
+		PointerAs[linkedFreePageHeader](m.PagePointerOf(linked.next)).prev = linked.prev
+	}
+
+	first := run.PageIndex()
+	m.clearFreeBoundary(first)
+	m.clearFreeBoundary(first + pageNumber - 1)
+}
+
+// freedRunStartAt returns the freed run whose first page is pageIndex
+func (m Memory) freedRunStartAt(pageIndex SizeType) PageHandler {
+	pageNumber := PointerAs[linkedFreePageHeader](m.PagePointerOf(MakePageHandler(1, pageIndex))).pageNumber
+	return MakePageHandler(pageNumber, pageIndex)
+}
+
+// freedRunEndAt returns the freed run whose last page is pageIndex
+func (m Memory) freedRunEndAt(pageIndex SizeType) PageHandler {
+	first := PointerAs[freePageFooter](m.freePageFooterPointer(pageIndex)).firstPageIndex
+	return MakePageHandler(pageIndex-first+1, first)
+}
+
+func (m Memory) freePageFooterPointer(pageIndex SizeType) Pointer {
+	return m.PagePointerOf(MakePageHandler(1, pageIndex)) + Pointer(BasePageSize-freePageFooterSize)
+}
+
+func (m Memory) isFreeBoundary(pageIndex SizeType) bool {
+	word := PointerAs[Word](m.freeBoundaryBitmap() + Pointer((pageIndex>>6)<<3))
+	return *word&(1<<(pageIndex&63)) != 0
+}
+
+func (m Memory) setFreeBoundary(pageIndex SizeType) {
+	word := PointerAs[Word](m.freeBoundaryBitmap() + Pointer((pageIndex>>6)<<3))
+	*word |= 1 << (pageIndex & 63)
+}
+
+func (m Memory) clearFreeBoundary(pageIndex SizeType) {
+	word := PointerAs[Word](m.freeBoundaryBitmap() + Pointer((pageIndex>>6)<<3))
+	*word &^= 1 << (pageIndex & 63)
+}
+
+// freedPageClassOf returns the size class of freed runs. Class c holds runs of [2^c, 2^(c+1)) pages
+func freedPageClassOf(pageNumber SizeType) int {
+	return bits.Len64(uint64(pageNumber)) - 1
+}
+
+const reservedCommitPageNumber SizeType = 4096 // commit 1MB once at least
+
+// freeBoundaryBitmapSize is the byte size of bitmap covering page 0 to pageNumber
+func freeBoundaryBitmapSize(pageNumber SizeType) SizeType {
+	return ((pageNumber + 64) >> 6) << 3
 }
 
 func (m Memory) numberOfFreedBasePages() SizeType {
 	var number SizeType = 0
-	header := m.header().freedBasePageHeader
+	header := m.header().freedPageHeaders[0]
 	for header.IsNotNull() {
 		number++
 		header = m.nextFreedPage(header)
@@ -116,16 +325,27 @@ func (m Memory) numberOfFreedBasePages() SizeType {
 // numberOfFreedCombinedPages number is number of FreedCombinedPages and pageNumber is the sum of FreedCombinedPages size
 // if FreedCombinedPages are 3,3,4 then number is 3 and pageNumber is 10
 func (m Memory) numberOfFreedCombinedPages() (number SizeType, pageNumber SizeType) {
-	header := m.header().freedCombinedPageHeader
-	for header.IsNotNull() {
-		linked := PointerAs[linkedFreePageHeader](m.PagePointerOf(header))
-		pageNumber += linked.pageNumber
-		number++
-		header = linked.next
+	for class := 1; class < freedPageClassNumber; class++ {
+		header := m.header().freedPageHeaders[class]
+		for header.IsNotNull() {
+			linked := PointerAs[linkedFreePageHeader](m.PagePointerOf(header))
+			pageNumber += linked.pageNumber
+			number++
+			header = linked.next
+		}
 	}
 	return
 }
 
+// freedRunNumber is the length of the list of freed runs in the class
+func (m Memory) freedRunNumber(class int) SizeType {
+	head := m.header().freedPageHeaders[class]
+	if head.IsNull() {
+		return 0
+	}
+	return PointerAs[linkedFreePageHeader](m.PagePointerOf(head)).listLength
+}
+
 func (m Memory) nextFreedPage(freedPageHandler PageHandler) PageHandler {
 	if utils.Asserted {
 		if freedPageHandler.IsNull() {
@@ -135,11 +355,24 @@ func (m Memory) nextFreedPage(freedPageHandler PageHandler) PageHandler {
 	return PointerAs[linkedFreePageHeader](m.PagePointerOf(freedPageHandler)).next
 }
 
+const freedPageClassNumber = pageNumberShift // pageNumber < 2^32
+const freedPageClassScanLimit = 8            // max runs checked in the own class before turning to larger classes
+
 type linkedFreePageHeader struct {
 	pageNumber SizeType    // 空页大小
 	next       PageHandler // 链表
+	prev       PageHandler // for unlinking a merged neighbour
+	listLength SizeType    // of the list. Kept by the head only
+	scavenged  bool        // pages inside are given back to the OS
+}
+
+// freePageFooter is the last word of a freed run
+type freePageFooter struct {
+	firstPageIndex SizeType
 }
 
+var freePageFooterSize = Sizeof[freePageFooter]()
+
 // PagePointerOf thread-safe
 func (m Memory) PagePointerOf(pageHandler PageHandler) Pointer {
 	if utils.Asserted {
@@ -148,7 +381,13 @@ func (m Memory) PagePointerOf(pageHandler PageHandler) Pointer {
 		}
 	}
 	offset := Pointer(pageHandler.PageIndex() << BasePageSizeShiftNumber)
-	return m.header().pageBasePointer + offset
+	return m.pageBasePointer() + offset
+}
+
+// Contains reports whether ptr points into the pages of the memory
+func (m Memory) Contains(ptr Pointer) bool {
+	base := m.pageBasePointer()
+	return ptr >= base && ptr < base+Pointer((m.header().maxPageIndex+1)<<BasePageSizeShiftNumber)
 }
 
 func (m Memory) PointerToPageIndex(ptr Pointer) SizeType {
@@ -157,7 +396,7 @@ func (m Memory) PointerToPageIndex(ptr Pointer) SizeType {
 			panic("call PointerToPageIndex by null pointer")
 		}
 	}
-	offset := ptr - m.header().pageBasePointer
+	offset := ptr - m.pageBasePointer()
 	if utils.Asserted {
 		if SizeType(offset)%BasePageSize != 0 {
 			panic(fmt.Sprintf("%s is not a point to a page", ptr.String()))
@@ -166,10 +405,15 @@ func (m Memory) PointerToPageIndex(ptr Pointer) SizeType {
 	return SizeType(offset >> BasePageSizeShiftNumber)
 }
 
+// PageIndexOf returns the index of the page containing ptr. ptr may point into a page. Thread-safe
+func (m Memory) PageIndexOf(ptr Pointer) SizeType {
+	return SizeType(ptr-m.pageBasePointer()) >> BasePageSizeShiftNumber
+}
+
 func (m Memory) pageZero(pageHandler PageHandler) {
 	ptr := m.PagePointerOf(pageHandler)
 	size := pageHandler.PageNumber() << BasePageSizeShiftNumber
-	LibZero(ptr, size)
+	m.ZeroBytes(ptr, size)
 }
 
 func (m Memory) pageAsBytes(pageHandler PageHandler) []byte {
@@ -185,8 +429,7 @@ func (m Memory) pageAsBytes(pageHandler PageHandler) []byte {
 }
 
 func (m Memory) allocatedMemorySize() SizeType {
-	header := m.header()
-	return header.allocatedPageNumber << BasePageSizeShiftNumber
+	return m.AllocatedPageNumber() << BasePageSizeShiftNumber
 }
 
 func (m Memory) Json() map[string]interface{} {
@@ -194,14 +437,20 @@ func (m Memory) Json() map[string]interface{} {
 	header := m.header()
 	info["pointer"] = m.pointer().String()
 	info["libPointer"] = header.libPointer.String()
-	info["pageBasePointer"] = header.pageBasePointer.String()
+	info["pageBasePointer"] = m.pageBasePointer().String()
 	info["maxPageIndex"] = header.maxPageIndex
-	info["emptyPageIndex"] = header.emptyPageIndex
+	info["emptyPageIndex"] = m.emptyPageIndex()
 	totalPageNumber := header.maxPageIndex
 	info["totalPageNumber"] = totalPageNumber
 	info["totalMemory"] = totalPageNumber << BasePageSizeShiftNumber
 	info["totalMemory_h"] = HumanFriendlyMemorySize(totalPageNumber << BasePageSizeShiftNumber)
-	allocatedPageNumber := header.allocatedPageNumber
+	allocatedPageNumber := m.AllocatedPageNumber()
+	info["basePageStackLength"] = atomic.LoadUint64((*uint64)(&header.basePageStackLength))
+	info["scavengedMemory_h"] = HumanFriendlyMemorySize(header.scavengedSize)
+	if header.reservedSize > 0 {
+		info["committedPageIndex"] = header.committedPageIndex
+		info["committedMemory_h"] = HumanFriendlyMemorySize(m.CommittedSize())
+	}
 	info["allocatedPageNumber"] = allocatedPageNumber
 	info["allocatedMemory"] = allocatedPageNumber << BasePageSizeShiftNumber
 	info["allocatedMemory_h"] = HumanFriendlyMemorySize(allocatedPageNumber << BasePageSizeShiftNumber)
@@ -220,3 +469,8 @@ type OOMError struct {
 func (o *OOMError) Error() string {
 	return fmt.Sprintf("out of memory when alloc %d pages. The memory details is \n%s", o.pageNumber, o.details)
 }
+
+// Size is the size failed to allocate
+func (o *OOMError) Size() SizeType {
+	return o.pageNumber << BasePageSizeShiftNumber
+}
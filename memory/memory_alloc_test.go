@@ -6,7 +6,7 @@ import (
 )
 
 func TestMemory_pageAsBytes(t *testing.T) {
-	memory := New(4*1024 + 3)
+	memory := New(4*1024+3, nil)
 	t.Log(memory)
 	defer memory.Free()
 	page, err := memory.allocPage(4)
@@ -10,13 +10,13 @@ func TestMemory_memoryHeaderSize(t *testing.T) {
 }
 
 func TestMemory_newEmpty(t *testing.T) {
-	memory := New(4 * 1024)
+	memory := New(4*1024, nil)
 	defer memory.Free()
 	t.Log(memory)
 }
 
 func TestMemory_alloc1(t *testing.T) {
-	memory := New(4 * 1024)
+	memory := New(4*1024, nil)
 	defer memory.Free()
 	page, err := memory.allocPage(1)
 	utils.PanicErr(err)
@@ -26,7 +26,7 @@ func TestMemory_alloc1(t *testing.T) {
 }
 
 func TestMemory_alloc1_free(t *testing.T) {
-	memory := New(4 * 1024)
+	memory := New(4*1024, nil)
 	defer memory.Free()
 	page, err := memory.allocPage(1)
 	memory.freePage(page)
@@ -36,7 +36,7 @@ func TestMemory_alloc1_free(t *testing.T) {
 }
 
 func TestMemory_alloc11_free(t *testing.T) {
-	memory := New(4 * 1024)
+	memory := New(4*1024, nil)
 	defer memory.Free()
 	page, err := memory.allocPage(1)
 	memory.freePage(page)
@@ -48,7 +48,7 @@ func TestMemory_alloc11_free(t *testing.T) {
 }
 
 func TestMemory_alloc2_free(t *testing.T) {
-	memory := New(4 * 1024)
+	memory := New(4*1024, nil)
 	defer memory.Free()
 	page, err := memory.allocPage(2)
 	memory.freePage(page)
@@ -58,7 +58,7 @@ func TestMemory_alloc2_free(t *testing.T) {
 }
 
 func TestMemory_alloc2121_free(t *testing.T) {
-	memory := New(4 * 1024)
+	memory := New(4*1024, nil)
 	defer memory.Free()
 	page, err := memory.allocPage(2)
 	memory.freePage(page)
@@ -73,7 +73,7 @@ func TestMemory_alloc2121_free(t *testing.T) {
 }
 
 func TestMemory_alloc_2433(t *testing.T) {
-	memory := New(4 * 1024)
+	memory := New(4*1024, nil)
 	defer memory.Free()
 	page, err := memory.allocPage(2)
 	t.Log(memory.allocatedMemorySize())
@@ -91,3 +91,153 @@ func TestMemory_alloc_2433(t *testing.T) {
 	memory.freePage(page2)
 	t.Log(memory)
 }
+
+func TestMemory_coalesce(t *testing.T) {
+	memory := New(16*1024, nil)
+	defer memory.Free()
+	a := utils.PanicErr1(memory.allocPage(2))
+	b := utils.PanicErr1(memory.allocPage(1))
+	c := utils.PanicErr1(memory.allocPage(3))
+	guard := utils.PanicErr1(memory.allocPage(1))
+
+	memory.freePage(a)
+	memory.freePage(c)
+	number, pageNumber := memory.numberOfFreedCombinedPages()
+	utils.Assert(number == 2 && pageNumber == 5, number, pageNumber)
+
+	memory.freePage(b) // merge a, b and c
+	number, pageNumber = memory.numberOfFreedCombinedPages()
+	utils.Assert(number == 1 && pageNumber == 6, number, pageNumber)
+	utils.Assert(memory.numberOfFreedBasePages() == 0, memory.numberOfFreedBasePages())
+
+	page := utils.PanicErr1(memory.allocPage(6))
+	utils.Assert(page.PageIndex() == a.PageIndex(), page, a)
+	memory.freePage(page)
+	memory.freePage(guard) // all back to empty
+	utils.Assert(memory.emptyPageIndex() == 1, memory.emptyPageIndex())
+	utils.Assert(memory.AllocatedPageNumber() == 0, memory.AllocatedPageNumber())
+	t.Log(memory)
+}
+
+func TestMemory_coalesceNoOOM(t *testing.T) {
+	memory := New(64*1024, nil)
+	defer memory.Free()
+
+	var pages []PageHandler
+	for {
+		page, err := memory.allocPage(1)
+		if err != nil {
+			break
+		}
+		pages = append(pages, page)
+	}
+	guard := pages[len(pages)-1]
+	pages = pages[:len(pages)-1]
+	// free odd pages then even pages
+	for i := 1; i < len(pages); i += 2 {
+		memory.freePage(pages[i])
+	}
+	for i := 0; i < len(pages); i += 2 {
+		memory.freePage(pages[i])
+	}
+	utils.Assert(memory.numberOfFreedBasePages() == 0, memory.numberOfFreedBasePages())
+
+	page, err := memory.allocPage(SizeType(len(pages)))
+	utils.PanicErr(err)
+	memory.freePage(page)
+	memory.freePage(guard)
+	utils.Assert(memory.AllocatedPageNumber() == 0, memory.AllocatedPageNumber())
+}
+
+func TestMemory_split(t *testing.T) {
+	memory := New(16*1024, nil)
+	defer memory.Free()
+	big := utils.PanicErr1(memory.allocPage(10))
+	guard := utils.PanicErr1(memory.allocPage(1))
+	memory.freePage(big)
+
+	page := utils.PanicErr1(memory.allocPage(2))
+	utils.Assert(page.PageIndex() == big.PageIndex() && page.PageNumber() == 2, page)
+	utils.Assert(memory.AllocatedPageNumber() == 3, memory.AllocatedPageNumber())
+	number, pageNumber := memory.numberOfFreedCombinedPages()
+	utils.Assert(number == 1 && pageNumber == 8, number, pageNumber)
+
+	one := utils.PanicErr1(memory.allocPage(1))
+	utils.Assert(one.PageIndex() == big.PageIndex()+2, one)
+
+	memory.freePage(one)
+	memory.freePage(page)
+	number, pageNumber = memory.numberOfFreedCombinedPages()
+	utils.Assert(number == 1 && pageNumber == 10, number, pageNumber)
+	memory.freePage(guard)
+	utils.Assert(memory.AllocatedPageNumber() == 0, memory.AllocatedPageNumber())
+}
+
+// fragmentedMemory makes runNumber freed runs of 1 to 8 pages separated by allocated guard pages
+func fragmentedMemory(runNumber int) (memory Memory, guards []PageHandler) {
+	memory = New(SizeType(runNumber)*10*BasePageSize*2, nil)
+	runs := make([]PageHandler, 0, runNumber)
+	for i := 0; i < runNumber; i++ {
+		runs = append(runs, utils.PanicErr1(memory.allocPage(SizeType(i%8+1))))
+		guards = append(guards, utils.PanicErr1(memory.allocPage(1)))
+	}
+	for _, run := range runs {
+		memory.freePage(run)
+	}
+	return memory, guards
+}
+
+func freeFragmentedMemory(memory Memory, guards []PageHandler) {
+	for _, guard := range guards {
+		memory.freePage(guard)
+	}
+	utils.Assert(memory.AllocatedPageNumber() == 0, memory.AllocatedPageNumber())
+	memory.Free()
+}
+
+func BenchmarkMemory_allocPageNotFit(b *testing.B) {
+	memory, guards := fragmentedMemory(40000)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		page, err := memory.allocPage(9) // fits no freed run, so falls back to the empty area
+		utils.PanicErr(err)
+		memory.freePage(page)
+	}
+	b.StopTimer()
+	freeFragmentedMemory(memory, guards)
+}
+
+func BenchmarkMemory_allocPageMixed(b *testing.B) {
+	memory, guards := fragmentedMemory(40000)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		page, err := memory.allocPage(SizeType(i%8 + 1))
+		utils.PanicErr(err)
+		memory.freePage(page)
+	}
+	b.StopTimer()
+	freeFragmentedMemory(memory, guards)
+}
+
+func TestMemory_reserved(t *testing.T) {
+	memory := NewReserved(4*KB, 64*MB)
+	defer memory.Free()
+	utils.Assert(memory.CommittedSize() < 2*MB, memory.CommittedSize())
+
+	var pages []PageHandler
+	for {
+		page, err := memory.allocPage(64)
+		if err != nil {
+			break
+		}
+		memory.pageZero(page) // accessible
+		pages = append(pages, page)
+	}
+	t.Log(memory)
+	utils.Assert(memory.CommittedSize() > 63*MB, memory.CommittedSize())
+	utils.Assert(SizeType(len(pages))*64*BasePageSize > 63*MB, len(pages))
+	for _, page := range pages {
+		memory.freePage(page)
+	}
+	utils.Assert(memory.AllocatedPageNumber() == 0)
+}
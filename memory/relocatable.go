@@ -0,0 +1,9 @@
+//go:build relocatable
+
+package memory
+
+// Relocatable is on by the relocatable build tag. Collections store refs instead of pointers,
+// so a file-backed or shared memory can be mapped at any address
+const Relocatable = true
+
+const relocatableMagic Word = 1
@@ -0,0 +1,9 @@
+//go:build !relocatable
+
+package memory
+
+// Relocatable is on by the relocatable build tag. Collections store absolute pointers without it,
+// so a file-backed or shared memory is mapped at the address where it was created
+const Relocatable = false
+
+const relocatableMagic Word = 0
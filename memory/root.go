@@ -0,0 +1,149 @@
+package memory
+
+import (
+	"fmt"
+)
+
+/**
+Root directory names pointers in the memory, so they can be found after a file-backed memory is reopened
+or a snapshot is restored. A root has a kind telling its type, defined by the user of the memory.
+The directory is a run of rootDirectoryPageNumber pages allocated at the first SetRoot.
+*/
+
+const rootDirectoryPageNumber SizeType = 16
+const rootNameMaxLength = 54
+
+// RootKind is the type of a root. 0 for untyped
+type RootKind uint8
+
+type rootEntry struct {
+	nameLength uint8 // 0 for an empty entry
+	kind       RootKind
+	name       [rootNameMaxLength]byte
+	value      Pointer
+}
+
+var rootEntryNumber = (rootDirectoryPageNumber << BasePageSizeShiftNumber) / Sizeof[rootEntry]()
+
+// SetRoot names the pointer. Thread-safe
+func (m Memory) SetRoot(name string, value Pointer) error {
+	return m.SetTypedRoot(name, value, 0)
+}
+
+// SetTypedRoot names the pointer of the kind. Thread-safe
+func (m Memory) SetTypedRoot(name string, value Pointer, kind RootKind) error {
+	if len(name) == 0 || len(name) > rootNameMaxLength {
+		return fmt.Errorf("bad root name %q. The length should be in [1, %d]", name, rootNameMaxLength)
+	}
+	header := m.header()
+	header.mu.Lock()
+	defer header.mu.Unlock()
+	if header.rootDirectory.IsNull() {
+		directory, err := m.allocPage(rootDirectoryPageNumber)
+		if err != nil {
+			return err
+		}
+		m.ZeroBytes(m.PagePointerOf(directory), directory.Size())
+		header.rootDirectory = directory
+	}
+	var empty *rootEntry
+	for i := SizeType(0); i < rootEntryNumber; i++ {
+		entry := m.rootEntry(i)
+		if entry.nameLength == 0 {
+			if empty == nil {
+				empty = entry
+			}
+		} else if entry.nameIs(name) {
+			entry.kind = kind
+			entry.value = value
+			return nil
+		}
+	}
+	if empty == nil {
+		return fmt.Errorf("too many roots. The max number is %d", rootEntryNumber)
+	}
+	empty.nameLength = uint8(len(name))
+	empty.kind = kind
+	copy(empty.name[:], name)
+	empty.value = value
+	return nil
+}
+
+// Root returns the pointer named by SetRoot. Thread-safe
+func (m Memory) Root(name string) (Pointer, bool) {
+	value, _, ok := m.TypedRoot(name)
+	return value, ok
+}
+
+// TypedRoot returns the pointer and its kind named by SetTypedRoot. Thread-safe
+func (m Memory) TypedRoot(name string) (Pointer, RootKind, bool) {
+	header := m.header()
+	header.mu.Lock()
+	defer header.mu.Unlock()
+	if header.rootDirectory.IsNull() {
+		return NullPointer, 0, false
+	}
+	for i := SizeType(0); i < rootEntryNumber; i++ {
+		entry := m.rootEntry(i)
+		if entry.nameLength > 0 && entry.nameIs(name) {
+			return entry.value, entry.kind, true
+		}
+	}
+	return NullPointer, 0, false
+}
+
+// RootNames returns names of all roots. Thread-safe
+func (m Memory) RootNames() []string {
+	header := m.header()
+	header.mu.Lock()
+	defer header.mu.Unlock()
+	var names []string
+	if header.rootDirectory.IsNull() {
+		return names
+	}
+	for i := SizeType(0); i < rootEntryNumber; i++ {
+		entry := m.rootEntry(i)
+		if entry.nameLength > 0 {
+			names = append(names, string(entry.name[:entry.nameLength]))
+		}
+	}
+	return names
+}
+
+// DeleteRoot removes the name. The directory is freed when no root is left. Thread-safe
+func (m Memory) DeleteRoot(name string) {
+	header := m.header()
+	header.mu.Lock()
+	defer header.mu.Unlock()
+	if header.rootDirectory.IsNull() {
+		return
+	}
+	left := 0
+	for i := SizeType(0); i < rootEntryNumber; i++ {
+		entry := m.rootEntry(i)
+		if entry.nameLength > 0 && entry.nameIs(name) {
+			entry.nameLength = 0
+		}
+		if entry.nameLength > 0 {
+			left++
+		}
+	}
+	if left == 0 {
+		m.freePage(header.rootDirectory)
+		header.rootDirectory = nullPageHandle
+	}
+}
+
+func (m Memory) rootEntry(index SizeType) *rootEntry {
+	return PointerAs[rootEntry](m.PagePointerOf(m.header().rootDirectory) + Pointer(index*Sizeof[rootEntry]()))
+}
+
+func (e *rootEntry) nameIs(name string) bool {
+	return int(e.nameLength) == len(name) && string(e.name[:e.nameLength]) == name
+}
+
+func init() {
+	if Sizeof[rootEntry]() != 64 {
+		panic(fmt.Sprint("size of rootEntry ", Sizeof[rootEntry](), " != 64"))
+	}
+}
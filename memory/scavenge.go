@@ -0,0 +1,103 @@
+package memory
+
+import (
+	"fmt"
+	"github.com/madokast/direct/utils"
+)
+
+/**
+Scavenger gives the physical memory of freed pages back to the OS by madvise.
+The first and the last page of a freed run hold boundary tags, so only pages inside are discarded.
+Pages between emptyPageIndex and dirtyPageIndex were used once and are discarded too.
+A scavenged run is marked and skipped next time. The mark is lost when the run is merged or split.
+*/
+
+// Scavenge gives the physical memory of freed pages back to the OS. Returns the released size. Thread-safe.
+// Pages cached in LocalMemory are not released
+func (m Memory) Scavenge() SizeType {
+	mu := &m.header().mu
+	mu.Lock()
+	defer mu.Unlock()
+	return m.scavenge()
+}
+
+// SetScavengeThreshold makes the memory scavenge itself when more than size memory is freed since the last scavenge. 0 for off
+func (m Memory) SetScavengeThreshold(size SizeType) {
+	mu := &m.header().mu
+	mu.Lock()
+	m.header().scavengeThreshold = size >> BasePageSizeShiftNumber
+	mu.Unlock()
+}
+
+// ScavengedSize is the total size given back to the OS
+func (m Memory) ScavengedSize() SizeType {
+	return m.header().scavengedSize
+}
+
+// scavenge caller holds mu
+func (m Memory) scavenge() (released SizeType) {
+	header := m.header()
+	m.drainBasePages()
+	for class := freedPageClassOf((2 * osPageSize) >> BasePageSizeShiftNumber); class < freedPageClassNumber; class++ {
+		for run := header.freedPageHeaders[class]; run.IsNotNull(); run = m.nextFreedPage(run) {
+			linked := PointerAs[linkedFreePageHeader](m.PagePointerOf(run))
+			if linked.scavenged {
+				continue
+			}
+			first := run.PageIndex()
+			released += m.discardPages(first+1, first+run.PageNumber()-1)
+			linked.scavenged = true
+		}
+	}
+	// claimed as allocated so bumpers keep out while discarding
+	for emptyPageIndex := m.emptyPageIndex(); header.dirtyPageIndex > emptyPageIndex; emptyPageIndex = m.emptyPageIndex() {
+		dirtyPageIndex := header.dirtyPageIndex
+		if !m.casEmptyPageIndex(emptyPageIndex, dirtyPageIndex) {
+			continue
+		}
+		released += m.discardPages(emptyPageIndex, dirtyPageIndex)
+		header.dirtyPageIndex = emptyPageIndex
+		if !m.casEmptyPageIndex(dirtyPageIndex, emptyPageIndex) {
+			// bumped meanwhile
+			run := MakePageHandler(dirtyPageIndex-emptyPageIndex, emptyPageIndex)
+			m.linkFreedRun(run)
+			PointerAs[linkedFreePageHeader](m.PagePointerOf(run)).scavenged = true
+		}
+		break
+	}
+	header.scavengedSize += released
+	header.freedSinceScavenge = 0
+	if utils.Debug {
+		fmt.Println("scavenge", HumanFriendlyMemorySize(released))
+	}
+	return released
+}
+
+// scavengeIfNeeded scavenges when the threshold is reached. Caller holds mu
+func (m Memory) scavengeIfNeeded() {
+	header := m.header()
+	if header.scavengeThreshold > 0 && header.freedSinceScavenge >= header.scavengeThreshold {
+		m.scavenge()
+	}
+}
+
+// discardPages discards the OS pages inside pages [fromPageIndex, toPageIndex). Returns the discarded size
+func (m Memory) discardPages(fromPageIndex, toPageIndex SizeType) SizeType {
+	if fromPageIndex >= toPageIndex {
+		return 0
+	}
+	pageSize := osPageSize
+	if m.header().hugePages == HugePagesHugeTLB {
+		pageSize = HugePageSize // discarded in whole huge pages only
+	}
+	pageBasePointer := m.pageBasePointer()
+	start := (pageBasePointer + Pointer(fromPageIndex<<BasePageSizeShiftNumber) + Pointer(pageSize-1)) &^ Pointer(pageSize-1)
+	end := (pageBasePointer + Pointer(toPageIndex<<BasePageSizeShiftNumber)) &^ Pointer(pageSize-1)
+	if end <= start {
+		return 0
+	}
+	if !libDiscard(start, SizeType(end-start)) {
+		return 0
+	}
+	return SizeType(end - start)
+}
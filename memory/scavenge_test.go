@@ -0,0 +1,63 @@
+package memory
+
+import (
+	"github.com/madokast/direct/utils"
+	"runtime"
+	"testing"
+)
+
+func TestMemory_Scavenge(t *testing.T) {
+	memory := New(16*MB, nil)
+	defer memory.Free()
+
+	var pages []PageHandler
+	for i := 0; i < 64; i++ {
+		page, err := memory.allocPage(64)
+		utils.PanicErr(err)
+		LibMarkFreedMemory(memory.PagePointerOf(page), page.Size())
+		pages = append(pages, page)
+	}
+	// free every other run so they cannot merge
+	for i := 0; i < len(pages); i += 2 {
+		memory.freePage(pages[i])
+	}
+	released := memory.Scavenge()
+	t.Log(memory)
+	if runtime.GOOS == "linux" {
+		utils.Assert(released >= 32*(64*BasePageSize-2*osPageSize), released)
+		// pages inside are discarded and read zero
+		utils.Assert(memory.pageAsBytes(MakePageHandler(1, pages[0].PageIndex()+32))[0] == 0)
+	}
+	utils.Assert(memory.ScavengedSize() == released)
+	utils.Assert(memory.Scavenge() == 0) // nothing new
+
+	// freed runs are still valid
+	for i := 1; i < len(pages); i += 2 {
+		memory.freePage(pages[i])
+	}
+	utils.Assert(memory.AllocatedPageNumber() == 0)
+	utils.Assert(memory.emptyPageIndex() == 1, memory.emptyPageIndex())
+	if runtime.GOOS == "linux" {
+		// the empty area is discarded
+		utils.Assert(memory.Scavenge() >= 63*64*BasePageSize-2*osPageSize)
+	}
+	page, err := memory.allocPage(64 * 64)
+	utils.PanicErr(err)
+	memory.freePage(page)
+}
+
+func TestMemory_SetScavengeThreshold(t *testing.T) {
+	memory := New(16*MB, nil)
+	defer memory.Free()
+	memory.SetScavengeThreshold(1 * MB)
+
+	page, err := memory.allocPage(8192) // 2MB
+	utils.PanicErr(err)
+	guard, err := memory.allocPage(1)
+	utils.PanicErr(err)
+	memory.freePage(page)
+	if runtime.GOOS == "linux" {
+		utils.Assert(memory.ScavengedSize() > 0)
+	}
+	memory.freePage(guard)
+}
@@ -0,0 +1,206 @@
+package memory
+
+import (
+	"fmt"
+	"github.com/madokast/direct/utils"
+	"math/bits"
+)
+
+/**
+Slab allocates small objects less than a page.
+Objects of the same size class are carved from a span of slabSpanPageNumber pages.
+The span index is aligned to slabSpanPageNumber so the span of an object is found by its address.
+Spans with free objects are linked in memoryHeader.slabPartialSpans. A span is freed when all its objects are freed.
+LocalMemory caches objects and exchanges them with spans in batch.
+*/
+
+const MaxSmallObjectSize SizeType = 128 // objects larger than it are allocated by pages
+
+// SmallObjectPageHandler marks an object allocated by AllocSmall instead of pages. Its pageNumber is 0
+const SmallObjectPageHandler = PageHandler(1)
+
+const slabClassNumber = 4
+const slabMinClassShift = 4               // the smallest class is 16 bytes
+const slabSpanPageNumber SizeType = 16    // 4KB
+const slabSpanHeaderSize SizeType = 64    // objects start after the header
+const localSmallObjectBatch SizeType = 32 // objects moved between LocalMemory and spans once
+
+type slabSpanHeader struct {
+	class      SizeType
+	freeNumber SizeType    // number of objects in freeList
+	freeList   SizeType    // offset of the first free object from the memory. The first word of a free object is the offset of the next
+	next       PageHandler // partial span list
+	prev       PageHandler
+}
+
+// smallObjectList is a list of free objects of the same class
+type smallObjectList struct {
+	head   Pointer
+	length SizeType
+}
+
+func (l *smallObjectList) push(ptr Pointer) {
+	*PointerAs[Pointer](ptr) = l.head
+	l.head = ptr
+	l.length++
+}
+
+func (l *smallObjectList) pop() Pointer {
+	ptr := l.head
+	l.head = *PointerAs[Pointer](ptr)
+	l.length--
+	return ptr
+}
+
+// SmallObjectSize returns the real size of an object allocated by AllocSmall(size)
+func SmallObjectSize(size SizeType) SizeType {
+	return slabClassSize(slabClassOf(size))
+}
+
+func slabClassOf(size SizeType) int {
+	if utils.Asserted {
+		if size == 0 || size > MaxSmallObjectSize {
+			panic(fmt.Sprintf("bad small object size %d", size))
+		}
+	}
+	class := bits.Len64(uint64(size-1)) - slabMinClassShift
+	if class < 0 {
+		return 0
+	}
+	return class
+}
+
+func slabClassSize(class int) SizeType {
+	return 1 << (class + slabMinClassShift)
+}
+
+func slabSpanCapacity(class int) SizeType {
+	return (slabSpanPageNumber*BasePageSize - slabSpanHeaderSize) / slabClassSize(class)
+}
+
+// slabSpanOf returns the span holding the object
+func (m Memory) slabSpanOf(ptr Pointer) PageHandler {
+	pageIndex := m.PageIndexOf(ptr)
+	return MakePageHandler(slabSpanPageNumber, pageIndex&^(slabSpanPageNumber-1))
+}
+
+func (m Memory) slabSpanHeader(span PageHandler) *slabSpanHeader {
+	return PointerAs[slabSpanHeader](m.PagePointerOf(span))
+}
+
+// SmallObjectSizeOf returns the real size of an object from AllocSmall. Thread-safe
+func (m Memory) SmallObjectSizeOf(ptr Pointer) SizeType {
+	return slabClassSize(m.slabClassOfObject(ptr))
+}
+
+// slabClassOfObject is thread-safe because the class of a span is not modified while the object is alive
+func (m Memory) slabClassOfObject(ptr Pointer) int {
+	return int(m.slabSpanHeader(m.slabSpanOf(ptr)).class)
+}
+
+// allocSmallObjects moves objects of the class into list until it has number objects. Caller holds mu
+func (m Memory) allocSmallObjects(class int, list *smallObjectList, number SizeType) error {
+	header := m.header()
+	for list.length < number {
+		span := header.slabPartialSpans[class]
+		if span.IsNull() {
+			var err error
+			span, err = m.allocSlabSpan(class)
+			if err != nil {
+				if list.length > 0 {
+					return nil
+				}
+				return err
+			}
+		}
+		spanHeader := m.slabSpanHeader(span)
+		for spanHeader.freeNumber > 0 && list.length < number {
+			ptr := m.pointer() + Pointer(spanHeader.freeList)
+			spanHeader.freeList = *PointerAs[SizeType](ptr)
+			spanHeader.freeNumber--
+			list.push(ptr)
+		}
+		if spanHeader.freeNumber == 0 {
+			m.unlinkSlabSpan(span)
+		}
+	}
+	return nil
+}
+
+// freeSmallObject returns the object to its span. Caller holds mu
+func (m Memory) freeSmallObject(ptr Pointer) {
+	span := m.slabSpanOf(ptr)
+	spanHeader := m.slabSpanHeader(span)
+	*PointerAs[SizeType](ptr) = spanHeader.freeList
+	spanHeader.freeList = SizeType(ptr - m.pointer())
+	spanHeader.freeNumber++
+	if spanHeader.freeNumber == 1 {
+		// a full span has free object now
+		m.linkSlabSpan(span)
+	}
+	if spanHeader.freeNumber == slabSpanCapacity(int(spanHeader.class)) {
+		m.unlinkSlabSpan(span)
+		m.freePage(span)
+		if utils.Debug {
+			fmt.Println("free slab span", span)
+		}
+	}
+}
+
+// allocSlabSpan carves a new span into free objects and links it as partial. Caller holds mu
+func (m Memory) allocSlabSpan(class int) (PageHandler, error) {
+	span, err := m.allocAlignedPage(slabSpanPageNumber, slabSpanPageNumber)
+	if err != nil {
+		return nullPageHandle, err
+	}
+	spanPointer := m.PagePointerOf(span)
+	spanHeader := PointerAs[slabSpanHeader](spanPointer)
+	spanHeader.class = SizeType(class)
+	spanHeader.freeNumber = slabSpanCapacity(class)
+	spanHeader.freeList = 0
+	objectSize := slabClassSize(class)
+	ptr := spanPointer + Pointer(slabSpanHeaderSize+(spanHeader.freeNumber-1)*objectSize)
+	for i := SizeType(0); i < spanHeader.freeNumber; i++ {
+		*PointerAs[SizeType](ptr) = spanHeader.freeList
+		spanHeader.freeList = SizeType(ptr - m.pointer())
+		ptr -= Pointer(objectSize)
+	}
+	m.linkSlabSpan(span)
+	if utils.Debug {
+		fmt.Println("alloc slab span", span, "class", objectSize)
+	}
+	return span, nil
+}
+
+func (m Memory) linkSlabSpan(span PageHandler) {
+	header := m.header()
+	spanHeader := m.slabSpanHeader(span)
+	class := spanHeader.class
+	spanHeader.prev = nullPageHandle
+	spanHeader.next = header.slabPartialSpans[class]
+	if spanHeader.next.IsNotNull() {
+		m.slabSpanHeader(spanHeader.next).prev = span
+	}
+	header.slabPartialSpans[class] = span
+}
+
+func (m Memory) unlinkSlabSpan(span PageHandler) {
+	spanHeader := m.slabSpanHeader(span)
+	if spanHeader.prev.IsNull() {
+		m.header().slabPartialSpans[spanHeader.class] = spanHeader.next
+	} else {
+		m.slabSpanHeader(spanHeader.prev).next = spanHeader.next
+	}
+	if spanHeader.next.IsNotNull() {
+		m.slabSpanHeader(spanHeader.next).prev = spanHeader.prev
+	}
+}
+
+func init() {
+	if Sizeof[slabSpanHeader]() > slabSpanHeaderSize {
+		panic(fmt.Sprint("size of slabSpanHeader ", Sizeof[slabSpanHeader](), " > ", slabSpanHeaderSize))
+	}
+	if slabClassSize(slabClassNumber-1) != MaxSmallObjectSize {
+		panic(fmt.Sprint("the largest slab class ", slabClassSize(slabClassNumber-1), " != ", MaxSmallObjectSize))
+	}
+}
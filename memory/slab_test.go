@@ -0,0 +1,94 @@
+package memory
+
+import (
+	"github.com/madokast/direct/utils"
+	"testing"
+)
+
+func Test_slabClassOf(t *testing.T) {
+	utils.Assert(slabClassOf(1) == 0)
+	utils.Assert(slabClassOf(16) == 0)
+	utils.Assert(slabClassOf(17) == 1)
+	utils.Assert(slabClassOf(32) == 1)
+	utils.Assert(slabClassOf(64) == 2)
+	utils.Assert(slabClassOf(65) == 3)
+	utils.Assert(slabClassOf(MaxSmallObjectSize) == slabClassNumber-1)
+	for class := 0; class < slabClassNumber; class++ {
+		t.Log(slabClassSize(class), slabSpanCapacity(class))
+	}
+}
+
+func TestLocalMemory_AllocSmall(t *testing.T) {
+	memory := New(1*MB, nil)
+	defer memory.Free()
+	localMemory := memory.NewLocalMemory()
+
+	var objects []Pointer
+	seen := map[Pointer]bool{}
+	for i := 0; i < 1000; i++ {
+		size := SizeType(i%int(MaxSmallObjectSize) + 1)
+		ptr, realSize, err := localMemory.AllocSmall(size)
+		utils.PanicErr(err)
+		utils.Assert(realSize >= size && realSize == SmallObjectSize(size), size, realSize)
+		utils.Assert(!seen[ptr], ptr)
+		seen[ptr] = true
+		LibZero(ptr, realSize) // writable
+		objects = append(objects, ptr)
+	}
+	t.Log(memory.AllocatedPageNumber(), localMemory.String())
+	for _, ptr := range objects {
+		localMemory.FreeSmall(ptr)
+	}
+	localMemory.Destroy()
+	utils.Assert(memory.AllocatedPageNumber() == 0, memory.AllocatedPageNumber())
+}
+
+func TestLocalMemory_FreeSmallInOtherLocal(t *testing.T) {
+	memory := New(1*MB, nil)
+	defer memory.Free()
+	local1 := memory.NewLocalMemory()
+	local2 := memory.NewLocalMemory()
+
+	var objects []Pointer
+	for i := 0; i < 1000; i++ {
+		ptr, _, err := local1.AllocSmall(24)
+		utils.PanicErr(err)
+		objects = append(objects, ptr)
+	}
+	for _, ptr := range objects {
+		local2.FreeSmall(ptr)
+	}
+	local1.Destroy()
+	local2.Destroy()
+	utils.Assert(memory.AllocatedPageNumber() == 0, memory.AllocatedPageNumber())
+}
+
+func TestMemory_allocAlignedPage(t *testing.T) {
+	memory := New(64*1024, nil)
+	defer memory.Free()
+	one := utils.PanicErr1(memory.allocPage(1))
+	page := utils.PanicErr1(memory.allocAlignedPage(16, 16))
+	utils.Assert(page.PageIndex()%16 == 0 && page.PageNumber() == 16, page)
+	utils.Assert(memory.AllocatedPageNumber() == 17, memory.AllocatedPageNumber())
+	memory.freePage(one)
+	aligned := utils.PanicErr1(memory.allocAlignedPage(4, 4))
+	utils.Assert(aligned.PageIndex()%4 == 0, aligned)
+	memory.freePage(aligned)
+	memory.freePage(page)
+	utils.Assert(memory.AllocatedPageNumber() == 0, memory.AllocatedPageNumber())
+	utils.Assert(memory.emptyPageIndex() == 1, memory.emptyPageIndex())
+}
+
+func BenchmarkLocalMemory_AllocSmall(b *testing.B) {
+	memory := New(1*MB, nil)
+	localMemory := memory.NewLocalMemory()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		ptr, _, err := localMemory.AllocSmall(64)
+		utils.PanicErr(err)
+		localMemory.FreeSmall(ptr)
+	}
+	b.StopTimer()
+	localMemory.Destroy()
+	memory.Free()
+}
@@ -0,0 +1,151 @@
+package memory
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/madokast/direct/utils/spin"
+	"hash/crc32"
+	"io"
+	"unsafe"
+)
+
+/**
+A snapshot is the used part of a memory written to a stream. Restore it to inspect collections in another process.
+The format is the words
+  snapshotMagic, snapshotVersion, tag, address, mapping size, image size
+followed by the image and the crc32 (IEEE) of all before.
+The image is the memory header, the bitmap and pages before emptyPageIndex, so free lists and roots are restored.
+Pages cached by local memories are not in free lists. Flush them before a snapshot.
+The restored memory is placed at the original address because collections store absolute pointers, or anywhere if Relocatable.
+*/
+
+// snapshotMagic is "DIRECTSS"
+const snapshotMagic Word = 0x5353544345524944
+const snapshotVersion Word = 1
+
+type snapshotHeader struct {
+	magic       Word
+	version     Word
+	tag         Word     // saved for the user of the memory
+	address     Pointer  // of the memory
+	mappingSize SizeType // of the restored memory
+	imageSize   SizeType
+}
+
+var snapshotHeaderSize = Sizeof[snapshotHeader]()
+
+const snapshotChunkSize SizeType = 1 * MB
+
+// SnapshotTo writes the memory to w with the tag. Thread-safe. Allocations wait meanwhile
+func (m Memory) SnapshotTo(w io.Writer, tag Word) error {
+	header := m.header()
+	header.mu.Lock()
+	defer header.mu.Unlock()
+	m.freezeLockFree()
+	defer m.unfreezeLockFree()
+
+	checksum := crc32.NewIEEE()
+	w2 := io.MultiWriter(w, checksum)
+	sh := snapshotHeader{
+		magic:       snapshotMagic,
+		version:     snapshotVersion,
+		tag:         tag,
+		address:     m.pointer(),
+		mappingSize: m.mappingSize(),
+		imageSize:   header.pageBaseOffset + header.emptyPageIndex<<BasePageSizeShiftNumber,
+	}
+	if _, err := w2.Write(unsafe.Slice((*byte)(unsafe.Pointer(&sh)), snapshotHeaderSize.Int())); err != nil {
+		return err
+	}
+	image := unsafe.Slice((*byte)(m.pointer().UnsafePointer()), sh.imageSize.Int())
+	for len(image) > 0 {
+		chunk := image
+		if len(chunk) > snapshotChunkSize.Int() {
+			chunk = chunk[:snapshotChunkSize]
+		}
+		if _, err := w2.Write(chunk); err != nil {
+			return err
+		}
+		image = image[len(chunk):]
+	}
+	return binary.Write(w, binary.LittleEndian, checksum.Sum32())
+}
+
+// RestoreFrom reads a memory and its tag written by SnapshotTo. Free the memory after use
+func RestoreFrom(r io.Reader) (Memory, Word, error) {
+	checksum := crc32.NewIEEE()
+	r2 := io.TeeReader(r, checksum)
+	var sh snapshotHeader
+	if _, err := io.ReadFull(r2, unsafe.Slice((*byte)(unsafe.Pointer(&sh)), snapshotHeaderSize.Int())); err != nil {
+		return NullMemory, 0, err
+	}
+	if sh.magic != snapshotMagic {
+		return NullMemory, 0, errors.New("not a memory snapshot")
+	}
+	if sh.version != snapshotVersion {
+		return NullMemory, 0, fmt.Errorf("snapshot version %d is not supported", sh.version)
+	}
+	if sh.imageSize < memoryHeaderSize || sh.imageSize > sh.mappingSize {
+		return NullMemory, 0, fmt.Errorf("bad snapshot image size %d", sh.imageSize)
+	}
+
+	// the original offset in the OS page is kept, so scavenging works the same
+	offset := sh.address & Pointer(osPageSize-1)
+	address := sh.address - offset
+	if Relocatable {
+		address = NullPointer
+	}
+	mappingSize := sh.mappingSize + SizeType(offset)
+	ptr, err := libReserveAt(address, mappingSize)
+	if err != nil {
+		return NullMemory, 0, fmt.Errorf("cannot map the snapshot at %s: %w", sh.address.String(), err)
+	}
+	m := Memory(ptr + offset)
+	if !libCommit(m.pointer(), sh.mappingSize) {
+		libRelease(ptr, mappingSize)
+		return NullMemory, 0, fmt.Errorf("cannot commit memory %s", HumanFriendlyMemorySize(sh.mappingSize))
+	}
+	image := unsafe.Slice((*byte)(m.pointer().UnsafePointer()), sh.imageSize.Int())
+	if _, err = io.ReadFull(r2, image); err != nil {
+		libRelease(ptr, mappingSize)
+		return NullMemory, 0, err
+	}
+	var sum uint32
+	if err = binary.Read(r, binary.LittleEndian, &sum); err != nil {
+		libRelease(ptr, mappingSize)
+		return NullMemory, 0, err
+	}
+	header := m.header()
+	if sum != checksum.Sum32() {
+		libRelease(ptr, mappingSize)
+		return NullMemory, 0, errors.New("the snapshot is broken")
+	}
+	if err = checkMagic(header.magic); err != nil {
+		libRelease(ptr, mappingSize)
+		return NullMemory, 0, fmt.Errorf("cannot restore the snapshot: %w", err)
+	}
+
+	header.libPointer = ptr
+	header.reservedSize = mappingSize // freed as a reserved memory
+	header.committedPageIndex = header.maxPageIndex
+	header.fileSize = 0
+	header.hugePages = HugePagesNone
+	header.mu = spin.SharedMutex{}
+	header.lockFreeState = 0 // frozen by SnapshotTo
+	header.backendIndex = 0  // mapped by the OS here
+	m.startTrace()
+	return m, sh.tag, nil
+}
+
+// mappingSize is the size of memory from m
+func (m Memory) mappingSize() SizeType {
+	header := m.header()
+	if header.fileSize > 0 {
+		return header.fileSize
+	}
+	if header.reservedSize > 0 {
+		return header.reservedSize - SizeType(m.pointer()-header.libPointer)
+	}
+	return header.pageBaseOffset + (header.maxPageIndex+1)<<BasePageSizeShiftNumber
+}
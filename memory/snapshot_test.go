@@ -0,0 +1,80 @@
+package memory
+
+import (
+	"bytes"
+	"github.com/madokast/direct/utils"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+func TestMemory_SnapshotTo(t *testing.T) {
+	if runtime.GOOS != "linux" && !Relocatable {
+		t.Skip("restoring at the original address is only supported on linux")
+	}
+	memory := New(4*MB, nil)
+	var pages []PageHandler
+	for i := 0; i < 16; i++ {
+		page := utils.PanicErr1(memory.allocPage(SizeType(i + 1)))
+		copy(memory.pageAsBytes(page), "hello")
+		pages = append(pages, page)
+	}
+	for i := 0; i < len(pages); i += 2 {
+		memory.freePage(pages[i])
+	}
+	list := smallObjectList{}
+	utils.PanicErr(memory.allocSmallObjects(0, &list, 8))
+	object := list.pop()
+	*PointerAs[SizeType](object) = 42
+	for list.length > 0 {
+		memory.freeSmallObject(list.pop())
+	}
+	utils.PanicErr(memory.SetTypedRoot("object", object, 7))
+	allocatedPageNumber := memory.AllocatedPageNumber()
+
+	var buffer bytes.Buffer
+	utils.PanicErr(memory.SnapshotTo(&buffer, 100))
+	address := memory.pointer()
+	memory.Free()
+
+	broken := append([]byte{}, buffer.Bytes()...)
+	broken[len(broken)/2]++
+	_, _, err := RestoreFrom(bytes.NewReader(broken))
+	utils.Assert(err != nil)
+	_, _, err = RestoreFrom(bytes.NewReader(buffer.Bytes()[:buffer.Len()-1]))
+	utils.Assert(err != nil)
+
+	memory, tag, err := RestoreFrom(&buffer)
+	utils.PanicErr(err)
+	defer memory.Free()
+	utils.Assert(tag == 100)
+	utils.Assert(memory.pointer() == address || Relocatable)
+	utils.Assert(memory.AllocatedPageNumber() == allocatedPageNumber, memory.AllocatedPageNumber())
+	value, kind, ok := memory.TypedRoot("object")
+	utils.Assert(ok && kind == 7)
+	value += memory.pointer() - address
+	utils.Assert(*PointerAs[SizeType](value) == 42)
+	for i := 1; i < len(pages); i += 2 {
+		utils.Assert(string(memory.pageAsBytes(pages[i])[:5]) == "hello")
+		memory.freePage(pages[i])
+	}
+	memory.freeSmallObject(value)
+	memory.DeleteRoot("object")
+	utils.Assert(memory.AllocatedPageNumber() == 0, memory.AllocatedPageNumber())
+	page := utils.PanicErr1(memory.allocPage(memory.maxPageIndex() - 1)) // the whole memory is usable
+	memory.freePage(page)
+}
+
+func TestMemory_RestoreFrom_otherBuild(t *testing.T) {
+	if runtime.GOOS != "linux" && !Relocatable {
+		t.Skip("restoring at the original address is only supported on linux")
+	}
+	// as if made by the build with the relocatable tag flipped
+	memory := New(1*MB, nil)
+	memory.header().magic ^= 1 << 8
+	var buffer bytes.Buffer
+	utils.PanicErr(memory.SnapshotTo(&buffer, 0))
+	memory.Free()
+	_, _, err := RestoreFrom(&buffer)
+	utils.Assert(err != nil && strings.Contains(err.Error(), "relocatable"), err)
+}
@@ -0,0 +1,82 @@
+package memory
+
+import (
+	"github.com/madokast/direct/memory/trace_type"
+	"strings"
+)
+
+// Stats is a snapshot of the statistics of a memory. Collected by Memory.Stats
+type Stats struct {
+	TotalSize        SizeType                       // of all pages
+	CommittedSize    SizeType                       // accessible now. See Memory.CommittedSize
+	AllocatedSize    SizeType                       // including pages and objects cached in local memories
+	FreeSize         SizeType                       // TotalSize - AllocatedSize
+	ScavengedSize    SizeType                       // returned to the OS in total
+	FreedRunNumbers  [freedPageClassNumber]SizeType // free-list lengths. Runs in class c have [2^c, 2^(c+1)) pages
+	LargestFreeSize  SizeType                       // of the largest freed run or the never used area, the largest page allocation not OOM
+	LocalCachedSizes []SizeType                     // cached by each local memory. Filled by the user of local memories
+	LiveObjects      map[trace_type.Type]SizeType   // traced objects alive by type. Nil if not traced
+	SoftLimit        SizeType                       // 0 for none. Filled by the user of the memory
+	OverSoftLimit    bool                           // AllocatedSize > SoftLimit > 0
+	HugePages        HugePages                      // how the memory is backed by huge pages. See NewHugePages
+	HugePageBacked   SizeType                       // backed by huge pages now. See Memory.HugePageBackedSize
+}
+
+// Stats collects statistics in O(1) except walking the list of the largest class of freed runs,
+// and reading /proc/self/smaps for transparent huge pages. Thread-safe
+func (m Memory) Stats() Stats {
+	header := m.header()
+	header.mu.Lock()
+	stats := Stats{
+		TotalSize:       header.maxPageIndex << BasePageSizeShiftNumber,
+		CommittedSize:   m.CommittedSize(),
+		AllocatedSize:   m.AllocatedPageNumber() << BasePageSizeShiftNumber,
+		ScavengedSize:   header.scavengedSize,
+		LargestFreeSize: m.largestFreePageNumber() << BasePageSizeShiftNumber,
+	}
+	for class := range stats.FreedRunNumbers {
+		stats.FreedRunNumbers[class] = m.freedRunNumber(class)
+	}
+	header.mu.Unlock()
+	stats.FreeSize = stats.TotalSize - stats.AllocatedSize
+	stats.HugePages = m.HugePages()
+	stats.HugePageBacked = m.HugePageBackedSize()
+	if t := m.Tracer(); t != nil {
+		stats.LiveObjects = t.liveObjects()
+	}
+	return stats
+}
+
+// largestFreePageNumber walks the largest class of freed runs only. Caller holds mu
+func (m Memory) largestFreePageNumber() SizeType {
+	header := m.header()
+	var largest SizeType = 0
+	emptyPageIndex := m.emptyPageIndex() // moved by lock-free allocation without mu
+	if emptyPageIndex <= header.maxPageIndex {
+		largest = header.maxPageIndex - emptyPageIndex + 1
+	}
+	if header.freedPageClassBitmap != 0 {
+		class := freedPageClassOf(SizeType(header.freedPageClassBitmap)) // the highest bit
+		for run := header.freedPageHeaders[class]; run.IsNotNull(); run = m.nextFreedPage(run) {
+			if run.PageNumber() > largest {
+				largest = run.PageNumber()
+			}
+		}
+	}
+	return largest
+}
+
+// liveObjects counts traced records by type. Strings held by factories are counted as StringFactory
+func (t *Tracer) liveObjects() map[trace_type.Type]SizeType {
+	t.traceMu.Lock()
+	defer t.traceMu.Unlock()
+	objects := map[trace_type.Type]SizeType{}
+	for _, record := range t.traceRecords {
+		_type := record._type
+		if strings.HasPrefix(string(_type), string(trace_type.StringFactory)) {
+			_type = trace_type.StringFactory
+		}
+		objects[_type]++
+	}
+	return objects
+}
@@ -0,0 +1,65 @@
+package memory
+
+import (
+	"github.com/madokast/direct/utils"
+	"testing"
+)
+
+func TestMemory_Stats(t *testing.T) {
+	memory := New(4*MB, nil)
+	defer memory.Free()
+	stats := memory.Stats()
+	utils.Assert(stats.AllocatedSize == 0 && stats.FreeSize == stats.TotalSize, stats)
+	utils.Assert(stats.LargestFreeSize == stats.TotalSize, stats)
+
+	var pages []PageHandler
+	for i := 0; i < 8; i++ {
+		pages = append(pages, utils.PanicErr1(memory.allocPage(SizeType(i+1))))
+	}
+	memory.freePage(pages[2]) // 3 pages in class 1
+	memory.freePage(pages[5]) // 6 pages in class 2
+	stats = memory.Stats()
+	utils.Assert(stats.AllocatedSize == (36-9)*BasePageSize, stats.AllocatedSize)
+	utils.Assert(stats.FreeSize == stats.TotalSize-stats.AllocatedSize)
+	utils.Assert(stats.FreedRunNumbers[1] == 1 && stats.FreedRunNumbers[2] == 1, stats.FreedRunNumbers)
+	utils.Assert(stats.LargestFreeSize == (memory.maxPageIndex()-36)*BasePageSize, stats.LargestFreeSize)
+
+	memory.freePage(pages[1]) // merged with pages[2] into 5 pages
+	memory.freePage(pages[7]) // merged with the never used area
+	stats = memory.Stats()
+	utils.Assert(stats.FreedRunNumbers[1] == 0 && stats.FreedRunNumbers[2] == 2, stats.FreedRunNumbers)
+	number := SizeType(0)
+	for run := memory.freedPageHeader(2); run.IsNotNull(); run = memory.nextFreedPage(run) {
+		number++
+	}
+	utils.Assert(number == 2, number)
+	for i, page := range pages {
+		if i != 1 && i != 2 && i != 5 && i != 7 {
+			memory.freePage(page)
+		}
+	}
+	stats = memory.Stats()
+	utils.Assert(stats.AllocatedSize == 0, stats.AllocatedSize)
+	for _, number := range stats.FreedRunNumbers {
+		utils.Assert(number == 0, stats.FreedRunNumbers)
+	}
+}
+
+func TestLocalMemory_CachedSize(t *testing.T) {
+	memory := New(4*MB, nil)
+	defer memory.Free()
+	local := memory.NewLocalMemory()
+	page := utils.PanicErr1(local.AllocPage(2))
+	utils.Assert(local.CachedSize() == 6*BasePageSize, local.CachedSize()) // 4 times allocated
+	local.FreePage(page)
+	utils.Assert(local.CachedSize() == 8*BasePageSize, local.CachedSize())
+	utils.Assert(memory.Stats().AllocatedSize == 8*BasePageSize)
+
+	object, size, err := local.AllocSmall(8)
+	utils.PanicErr(err)
+	cached := local.CachedSize()
+	local.FreeSmall(object)
+	utils.Assert(local.CachedSize() == cached+size, local.CachedSize())
+	local.Destroy()
+	utils.Assert(local.CachedSize() == 0, local.CachedSize())
+}
@@ -4,6 +4,8 @@ import (
 	"fmt"
 	"github.com/madokast/direct/memory/trace_type"
 	"github.com/madokast/direct/utils"
+	"os"
+	"sort"
 	"strings"
 	"sync"
 )
@@ -12,9 +14,12 @@ import (
 A Tracer records every alloc/free point.
 Used only for leak detection.
 Bad performance.
+Tracing is switched per memory. Users of a memory keep its Tracer and check it for nil, so the cost is a branch when off.
 */
 
-const Trace = false
+// Trace is the default of tracing new memories. It is on by the trace build tag or the environment variable DIRECT_TRACE=1.
+// Turn on a memory by StartTrace
+var Trace = traceBuilt || os.Getenv("DIRECT_TRACE") == "1"
 
 type traceRecord struct {
 	pageIndex SizeType
@@ -24,21 +29,23 @@ type traceRecord struct {
 	_type     trace_type.Type
 }
 
-type tracer struct {
+// Tracer of a memory. Thread-safe
+type Tracer struct {
 	traceMu      sync.Mutex
 	traceRecords map[Pointer]traceRecord
 	memory       Memory
+	partial      bool // the memory is reopened or shared, so some allocations are not traced
 }
 
-func newTrace(m Memory) *tracer {
-	return &tracer{
+func newTrace(m Memory) *Tracer {
+	return &Tracer{
 		traceMu:      sync.Mutex{},
 		traceRecords: map[Pointer]traceRecord{},
 		memory:       m,
 	}
 }
 
-func (t *tracer) TraceAlloc(ptr Pointer, _type trace_type.Type, size SizeType, file string, lineNo int) {
+func (t *Tracer) TraceAlloc(ptr Pointer, _type trace_type.Type, size SizeType, file string, lineNo int) {
 	if !utils.Asserted {
 		if trace_type.SkipTrace(_type) {
 			return
@@ -54,7 +61,7 @@ func (t *tracer) TraceAlloc(ptr Pointer, _type trace_type.Type, size SizeType, f
 	}
 
 	t.traceRecords[ptr] = traceRecord{
-		pageIndex: t.memory.PointerToPageIndex(ptr),
+		pageIndex: t.memory.PageIndexOf(ptr),
 		file:      file,
 		lineNo:    lineNo,
 		size:      size,
@@ -67,11 +74,11 @@ func (t *tracer) TraceAlloc(ptr Pointer, _type trace_type.Type, size SizeType, f
 	t.traceMu.Unlock()
 }
 
-func (t *tracer) DeTraceAlloc(ptr Pointer) {
+func (t *Tracer) DeTraceAlloc(ptr Pointer) {
 	t.traceMu.Lock()
 	if utils.Asserted {
 		_, ok := t.traceRecords[ptr]
-		if !ok {
+		if !ok && !t.partial {
 			panic(fmt.Sprintf("remove a un-traced pointer %s", ptr.String()))
 		}
 	}
@@ -83,20 +90,20 @@ func (t *tracer) DeTraceAlloc(ptr Pointer) {
 	t.traceMu.Unlock()
 }
 
-func (t *tracer) cleanTrace() {
+func (t *Tracer) cleanTrace() {
 	t.traceMu.Lock()
 	defer t.traceMu.Unlock()
 	t.traceRecords = make(map[Pointer]traceRecord)
 }
 
-func (t *tracer) hasLeak() bool {
+func (t *Tracer) hasLeak() bool {
 	t.traceMu.Lock()
 	defer t.traceMu.Unlock()
 	return len(t.traceRecords) > 0
 
 }
 
-func (t *tracer) leakReport() string {
+func (t *Tracer) leakReport() string {
 	t.traceMu.Lock()
 	defer t.traceMu.Unlock()
 	var sb strings.Builder
@@ -106,6 +113,43 @@ func (t *tracer) leakReport() string {
 	return sb.String()
 }
 
+// Partial reports some allocations are not traced, because the memory is reopened or shared
+func (t *Tracer) Partial() bool {
+	return t.partial
+}
+
+// HeapObject is a traced object alive in a memory
+type HeapObject struct {
+	Address   Pointer
+	PageIndex SizeType // of the page holding it
+	Size      SizeType
+	Type      trace_type.Type
+	File      string // where it is allocated
+	Line      int
+}
+
+// HeapObjects returns traced objects alive sorted by address
+func (t *Tracer) HeapObjects() []HeapObject {
+	t.traceMu.Lock()
+	objects := make([]HeapObject, 0, len(t.traceRecords))
+	for ptr, record := range t.traceRecords {
+		objects = append(objects, HeapObject{Address: ptr, PageIndex: record.pageIndex, Size: record.size,
+			Type: record._type, File: record.file, Line: record.lineNo})
+	}
+	t.traceMu.Unlock()
+	sort.Slice(objects, func(i, j int) bool { return objects[i].Address < objects[j].Address })
+	return objects
+}
+
+// HeapObjectOf returns the traced object at ptr. False if not traced
+func (t *Tracer) HeapObjectOf(ptr Pointer) (HeapObject, bool) {
+	t.traceMu.Lock()
+	record, ok := t.traceRecords[ptr]
+	t.traceMu.Unlock()
+	return HeapObject{Address: ptr, PageIndex: record.pageIndex, Size: record.size,
+		Type: record._type, File: record.file, Line: record.lineNo}, ok
+}
+
 func (tr *traceRecord) String() string {
 	return fmt.Sprintf("index:%d type:%s size:%s allocated at %s:%d", tr.pageIndex, tr._type, HumanFriendlyMemorySize(tr.size), tr.file, tr.lineNo)
 }
@@ -113,53 +157,41 @@ func (tr *traceRecord) String() string {
 /*--------------------- trace user -------------------*/
 
 var tracerMapMu sync.Mutex
-var tracerMap = map[Memory]*tracer{}
+var tracerMap = map[Memory]*Tracer{}
 
-func (m Memory) Tracer() *tracer {
-	if !Trace {
-		panic("call Tracer() after testing trace flag")
-	}
+// Tracer returns the tracer of the memory. Nil if not traced
+func (m Memory) Tracer() *Tracer {
 	tracerMapMu.Lock()
 	t := tracerMap[m]
 	tracerMapMu.Unlock()
-	if utils.Asserted {
-		if t == nil {
-			panic("Tracer is not init")
-		}
+	return t
+}
+
+// StartTrace turns on tracing of the memory. Objects allocated before, or by other processes sharing the file, are not traced.
+// No-op if traced
+func (m Memory) StartTrace() *Tracer {
+	tracerMapMu.Lock()
+	defer tracerMapMu.Unlock()
+	t := tracerMap[m]
+	if t == nil {
+		t = newTrace(m)
+		header := m.header()
+		t.partial = m.AllocatedPageNumber() > 0 || header.fileSize > 0
+		tracerMap[m] = t
 	}
 	return t
 }
 
+// startTrace turns on tracing of a new or mapped memory by default
 func (m Memory) startTrace() {
 	if Trace {
-		if utils.Asserted {
-			tracerMapMu.Lock()
-			_, ok := tracerMap[m]
-			tracerMapMu.Unlock()
-			if ok {
-				panic("a Tracer has been attached to the memory")
-			}
-		}
-
-		tracerMapMu.Lock()
-		tracerMap[m] = newTrace(m)
-		tracerMapMu.Unlock()
+		m.StartTrace()
 	}
 }
 
-func (m Memory) deleteTracer() {
-	if Trace {
-		if utils.Asserted {
-			tracerMapMu.Lock()
-			_, ok := tracerMap[m]
-			tracerMapMu.Unlock()
-			if !ok {
-				panic("no Tracer attaches to the memory")
-			}
-		}
-
-		tracerMapMu.Lock()
-		delete(tracerMap, m)
-		tracerMapMu.Unlock()
-	}
+// StopTrace turns off tracing of the memory. Users keeping the tracer should drop it
+func (m Memory) StopTrace() {
+	tracerMapMu.Lock()
+	delete(tracerMap, m)
+	tracerMapMu.Unlock()
 }
@@ -0,0 +1,6 @@
+//go:build !trace
+
+package memory
+
+// traceBuilt is on by the trace build tag. New memories are traced by default
+const traceBuilt = false
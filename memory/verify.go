@@ -0,0 +1,295 @@
+package memory
+
+import (
+	"fmt"
+	"math/bits"
+)
+
+/**
+Verify walks the memory and checks the invariants kept by the allocator:
+free lists are doubly linked, sized by their classes and tagged by the boundary bitmap and footers,
+freed runs neither overlap nor touch, pages neither freed nor in the stack of base pages sum up to allocatedPageNumber,
+slab spans with free objects are allocated and their free lists are in place,
+and pages and objects cached in local memories are neither freed nor cached twice.
+It is a debugging tool walking all free lists. Nothing is modified, but NeedsVerify is cleared when it passes.
+*/
+
+// CorruptedError is returned by Verify with the first violated invariant found
+type CorruptedError struct {
+	details string
+}
+
+func (e *CorruptedError) Error() string {
+	return "memory is corrupted: " + e.details
+}
+
+// NewCorruptedError makes a CorruptedError. Verify of collections uses it too
+func NewCorruptedError(format string, args ...any) error {
+	return &CorruptedError{details: fmt.Sprintf(format, args...)}
+}
+
+// pageBitset has one bit per page
+type pageBitset []Word
+
+func newPageBitset(pageNumber SizeType) pageBitset {
+	return make(pageBitset, (pageNumber+63)>>6)
+}
+
+// set sets bits of the run. False if any is set already
+func (b pageBitset) set(first, pageNumber SizeType) bool {
+	ok := true
+	for i := first; i < first+pageNumber; i++ {
+		if b[i>>6]&(1<<(i&63)) != 0 {
+			ok = false
+		}
+		b[i>>6] |= 1 << (i & 63)
+	}
+	return ok
+}
+
+func (b pageBitset) has(i SizeType) bool {
+	return b[i>>6]&(1<<(i&63)) != 0
+}
+
+// Verify checks the invariants of the memory and of the local memories made from it. Nil if consistent.
+// It holds mu and freezes lock-free allocations, so the memory may be used meanwhile, but the locals must not be
+func (m Memory) Verify(locals ...*LocalMemory) error {
+	header := m.header()
+	header.mu.Lock()
+	defer header.mu.Unlock()
+	m.freezeLockFree()
+	defer m.unfreezeLockFree()
+	if err := m.verify(locals); err != nil {
+		return err
+	}
+	header.mu.ClearTakenOver()
+	return nil
+}
+
+// NeedsVerify reports the lock of the memory was taken over from a dead process, which may leave free lists half-updated.
+// Verify clears it if the memory is consistent
+func (m Memory) NeedsVerify() bool {
+	return m.header().mu.TakenOver()
+}
+
+// verify checks the memory. Caller holds mu and freezes lock-free allocations
+func (m Memory) verify(locals []*LocalMemory) error {
+	header := m.header()
+	if header.magic != memoryMagic {
+		return NewCorruptedError("bad magic %#x", header.magic)
+	}
+	if header.emptyPageIndex < 1 || header.emptyPageIndex > header.maxPageIndex {
+		return NewCorruptedError("emptyPageIndex %d out of [1, %d]", header.emptyPageIndex, header.maxPageIndex)
+	}
+	if header.committedPageIndex < header.emptyPageIndex {
+		return NewCorruptedError("committedPageIndex %d < emptyPageIndex %d", header.committedPageIndex, header.emptyPageIndex)
+	}
+
+	freed := newPageBitset(header.emptyPageIndex)
+	var runs []PageHandler
+	var freedPageNumber, boundaryNumber SizeType = 0, 0
+	for class := 0; class < freedPageClassNumber; class++ {
+		head := header.freedPageHeaders[class]
+		if head.IsNull() != (header.freedPageClassBitmap&(1<<class) == 0) {
+			return NewCorruptedError("bit %d of freedPageClassBitmap %b mismatches the list", class, header.freedPageClassBitmap)
+		}
+		var length SizeType = 0
+		prev := nullPageHandle
+		for run := head; run.IsNotNull(); run = m.nextFreedPage(run) {
+			if err := m.verifyFreedRun(run, class, prev, freed); err != nil {
+				return err
+			}
+			runs = append(runs, run)
+			length++
+			freedPageNumber += run.PageNumber()
+			boundaryNumber += 2
+			if run.PageNumber() == 1 {
+				boundaryNumber--
+			}
+			prev = run
+		}
+		if head.IsNotNull() && PointerAs[linkedFreePageHeader](m.PagePointerOf(head)).listLength != length {
+			return NewCorruptedError("list of class %d has %d runs but its head records %d",
+				class, length, PointerAs[linkedFreePageHeader](m.PagePointerOf(head)).listLength)
+		}
+	}
+	// neighbours of a freed run are merged when freed
+	for _, run := range runs {
+		first := run.PageIndex()
+		if first > 1 && freed.has(first-1) {
+			return NewCorruptedError("freed run %s is not merged with its left neighbour", run.String())
+		}
+	}
+	var bitmapNumber SizeType = 0
+	bitmap := m.freeBoundaryBitmap()
+	for i := SizeType(0); i < freeBoundaryBitmapSize(header.maxPageIndex)>>3; i++ {
+		bitmapNumber += SizeType(bits.OnesCount64(uint64(*PointerAs[Word](bitmap + Pointer(i<<3)))))
+	}
+	if bitmapNumber != boundaryNumber {
+		return NewCorruptedError("%d bits set in the free boundary bitmap but freed runs have %d boundaries", bitmapNumber, boundaryNumber)
+	}
+	// base pages in the lock-free stack are free but not merged
+	stacked := m.basePagesInStack()
+	for _, page := range stacked {
+		if page.PageIndex() >= header.emptyPageIndex {
+			return NewCorruptedError("base page %s in the stack out of [1, %d)", page.String(), header.emptyPageIndex)
+		}
+		if !freed.set(page.PageIndex(), 1) {
+			return NewCorruptedError("base page %s in the stack is freed or stacked twice", page.String())
+		}
+		freedPageNumber++
+	}
+	if length := SizeType(len(stacked)); length != header.basePageStackLength {
+		return NewCorruptedError("%d base pages in the stack but its length is %d", length, header.basePageStackLength)
+	}
+	if allocated := header.emptyPageIndex - 1 - freedPageNumber; allocated != m.AllocatedPageNumber() {
+		return NewCorruptedError("%d pages are not freed but allocatedPageNumber is %d", allocated, m.AllocatedPageNumber())
+	}
+
+	spanFreeObjects, err := m.verifySlabSpans(freed)
+	if err != nil {
+		return err
+	}
+	return m.verifyLocals(locals, freed, spanFreeObjects)
+}
+
+// verifyFreedRun checks a run in the list of the class. Caller holds mu
+func (m Memory) verifyFreedRun(run PageHandler, class int, prev PageHandler, freed pageBitset) error {
+	header := m.header()
+	first, pageNumber := run.PageIndex(), run.PageNumber()
+	if pageNumber == 0 || first < 1 || first+pageNumber >= header.emptyPageIndex {
+		return NewCorruptedError("freed run %s in class %d out of [1, %d)", run.String(), class, header.emptyPageIndex)
+	}
+	if freedPageClassOf(pageNumber) != class {
+		return NewCorruptedError("freed run %s is in the list of class %d", run.String(), class)
+	}
+	linked := PointerAs[linkedFreePageHeader](m.PagePointerOf(run))
+	if linked.pageNumber != pageNumber {
+		return NewCorruptedError("freed run %s records %d pages", run.String(), linked.pageNumber)
+	}
+	if linked.prev != prev {
+		return NewCorruptedError("prev of freed run %s is %s but %s links to it", run.String(), linked.prev.String(), prev.String())
+	}
+	last := first + pageNumber - 1
+	if !m.isFreeBoundary(first) || !m.isFreeBoundary(last) {
+		return NewCorruptedError("boundary bits of freed run %s are not set", run.String())
+	}
+	if footer := PointerAs[freePageFooter](m.freePageFooterPointer(last)).firstPageIndex; footer != first {
+		return NewCorruptedError("footer of freed run %s records the first page %d", run.String(), footer)
+	}
+	if !freed.set(first, pageNumber) {
+		return NewCorruptedError("freed run %s overlaps another freed run or is listed twice", run.String())
+	}
+	return nil
+}
+
+// verifySlabSpans checks spans having free objects. Returns the free objects in them. Caller holds mu
+func (m Memory) verifySlabSpans(freed pageBitset) (map[Pointer]struct{}, error) {
+	header := m.header()
+	spans := newPageBitset(header.emptyPageIndex)
+	freeObjects := map[Pointer]struct{}{}
+	for class := 0; class < slabClassNumber; class++ {
+		prev := nullPageHandle
+		for span := header.slabPartialSpans[class]; span.IsNotNull(); span = m.slabSpanHeader(span).next {
+			first := span.PageIndex()
+			if span.PageNumber() != slabSpanPageNumber || first%slabSpanPageNumber != 0 || first+slabSpanPageNumber > header.emptyPageIndex {
+				return nil, NewCorruptedError("bad slab span %s in class %d", span.String(), class)
+			}
+			if freed.has(first) || !spans.set(first, slabSpanPageNumber) {
+				return nil, NewCorruptedError("slab span %s in class %d is freed or listed twice", span.String(), class)
+			}
+			spanHeader := m.slabSpanHeader(span)
+			if spanHeader.class != SizeType(class) || spanHeader.prev != prev {
+				return nil, NewCorruptedError("slab span %s of class %d and prev %s is in the list of class %d after %s",
+					span.String(), spanHeader.class, spanHeader.prev.String(), class, prev.String())
+			}
+			if spanHeader.freeNumber == 0 || spanHeader.freeNumber >= slabSpanCapacity(class) {
+				return nil, NewCorruptedError("slab span %s with %d free objects is partial", span.String(), spanHeader.freeNumber)
+			}
+			offset := spanHeader.freeList
+			for i := SizeType(0); i < spanHeader.freeNumber; i++ {
+				ptr := m.pointer() + Pointer(offset)
+				if err := m.verifySmallObject(ptr, class, freed); err != nil {
+					return nil, err
+				}
+				if m.slabSpanOf(ptr) != span {
+					return nil, NewCorruptedError("free object %s of slab span %s is in another span", ptr.String(), span.String())
+				}
+				if _, ok := freeObjects[ptr]; ok {
+					return nil, NewCorruptedError("free object %s of slab span %s is listed twice", ptr.String(), span.String())
+				}
+				freeObjects[ptr] = struct{}{}
+				offset = *PointerAs[SizeType](ptr)
+			}
+			prev = span
+		}
+	}
+	return freeObjects, nil
+}
+
+// verifySmallObject checks the object is in a span of the class, and the span is not freed. Caller holds mu
+func (m Memory) verifySmallObject(ptr Pointer, class int, freed pageBitset) error {
+	header := m.header()
+	if ptr < m.PagePointerOf(MakePageHandler(1, 1)) || m.PageIndexOf(ptr) >= header.emptyPageIndex {
+		return NewCorruptedError("small object %s of class %d out of pages", ptr.String(), class)
+	}
+	span := m.slabSpanOf(ptr)
+	if freed.has(span.PageIndex()) || m.slabSpanHeader(span).class != SizeType(class) {
+		return NewCorruptedError("small object %s is not in a slab span of class %d", ptr.String(), class)
+	}
+	offset := SizeType(ptr - m.PagePointerOf(span))
+	if offset < slabSpanHeaderSize || (offset-slabSpanHeaderSize)%slabClassSize(class) != 0 ||
+		(offset-slabSpanHeaderSize)/slabClassSize(class) >= slabSpanCapacity(class) {
+		return NewCorruptedError("small object %s is not aligned to its slot of class %d", ptr.String(), class)
+	}
+	return nil
+}
+
+// verifyLocals checks pages and objects cached in local memories are allocated and cached once. Caller holds mu
+func (m Memory) verifyLocals(locals []*LocalMemory, freed pageBitset, spanFreeObjects map[Pointer]struct{}) error {
+	header := m.header()
+	cached := newPageBitset(header.emptyPageIndex)
+	cachedObjects := map[Pointer]struct{}{}
+	for i, local := range locals {
+		if local.globalMemory != m {
+			return NewCorruptedError("local memory %d is made from another memory", i)
+		}
+		var pageNumber SizeType = 0
+		for _, page := range local.localPages {
+			first := page.PageIndex()
+			if page.PageNumber() == 0 || first < 1 || first+page.PageNumber() > header.emptyPageIndex {
+				return NewCorruptedError("page %s cached in local memory %d out of [1, %d)", page.String(), i, header.emptyPageIndex)
+			}
+			if !cached.set(first, page.PageNumber()) {
+				return NewCorruptedError("page %s cached in local memory %d is cached twice", page.String(), i)
+			}
+			for p := first; p < first+page.PageNumber(); p++ {
+				if freed.has(p) {
+					return NewCorruptedError("page %s cached in local memory %d is freed", page.String(), i)
+				}
+			}
+			pageNumber += page.PageNumber()
+		}
+		if pageNumber != local.cachedPageNumber {
+			return NewCorruptedError("local memory %d caches %d pages but records %d", i, pageNumber, local.cachedPageNumber)
+		}
+		for class := range local.smallObjects {
+			list := &local.smallObjects[class]
+			ptr := list.head
+			for n := SizeType(0); n < list.length; n++ {
+				if err := m.verifySmallObject(ptr, class, freed); err != nil {
+					return err
+				}
+				if _, ok := spanFreeObjects[ptr]; ok {
+					return NewCorruptedError("small object %s cached in local memory %d is free in its span", ptr.String(), i)
+				}
+				if _, ok := cachedObjects[ptr]; ok {
+					return NewCorruptedError("small object %s cached in local memory %d is cached twice", ptr.String(), i)
+				}
+				cachedObjects[ptr] = struct{}{}
+				ptr = *PointerAs[Pointer](ptr)
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,77 @@
+package memory
+
+import (
+	"errors"
+	"github.com/madokast/direct/utils"
+	"math/rand"
+	"testing"
+)
+
+func TestMemory_Verify(t *testing.T) {
+	memory := New(16*MB, nil)
+	defer memory.Free()
+	utils.PanicErr(memory.Verify())
+
+	local := memory.NewLocalMemory()
+	var pages []PageHandler
+	var objects []Pointer
+	for i := 0; i < 1000; i++ {
+		if rand.Intn(2) == 0 {
+			pages = append(pages, utils.PanicErr1(local.AllocPage(SizeType(rand.Intn(20)+1))))
+		} else {
+			object, _, err := local.AllocSmall(SizeType(rand.Intn(int(MaxSmallObjectSize)) + 1))
+			utils.PanicErr(err)
+			objects = append(objects, object)
+		}
+		if rand.Intn(3) == 0 && len(pages) > 0 {
+			local.FreePage(pages[0])
+			pages = pages[1:]
+		}
+		if rand.Intn(3) == 0 && len(objects) > 0 {
+			local.FreeSmall(objects[0])
+			objects = objects[1:]
+		}
+	}
+	utils.PanicErr(memory.Verify(&local))
+
+	for _, page := range pages {
+		local.FreePage(page)
+	}
+	for _, object := range objects {
+		local.FreeSmall(object)
+	}
+	utils.PanicErr(memory.Verify(&local))
+	local.Destroy()
+	utils.PanicErr(memory.Verify())
+	utils.Assert(memory.AllocatedPageNumber() == 0, memory.AllocatedPageNumber())
+}
+
+func TestMemory_Verify_corrupted(t *testing.T) {
+	memory := New(4*MB, nil)
+	defer memory.Free()
+	var pages []PageHandler
+	for i := 0; i < 4; i++ {
+		pages = append(pages, utils.PanicErr1(memory.allocPage(4)))
+	}
+	memory.freePage(pages[1])
+	utils.PanicErr(memory.Verify())
+
+	var corruptedError *CorruptedError
+	memory.header().allocatedPageNumber++
+	utils.Assert(errors.As(memory.Verify(), &corruptedError))
+	memory.header().allocatedPageNumber--
+
+	linked := PointerAs[linkedFreePageHeader](memory.PagePointerOf(pages[1]))
+	linked.next = pages[1] // a loop
+	utils.Assert(errors.As(memory.Verify(), &corruptedError), memory.Verify())
+	linked.next = nullPageHandle
+	utils.PanicErr(memory.Verify())
+
+	local := memory.NewLocalMemory()
+	local.localPages = append(local.localPages, pages[1]) // cached but freed
+	local.cachedPageNumber = pages[1].PageNumber()
+	utils.Assert(errors.As(memory.Verify(&local), &corruptedError), memory.Verify(&local))
+	local.localPages = append(local.localPages[:0], pages[2], pages[2])
+	local.cachedPageNumber = 2 * pages[2].PageNumber()
+	utils.Assert(errors.As(memory.Verify(&local), &corruptedError), memory.Verify(&local))
+}
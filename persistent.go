@@ -0,0 +1,239 @@
+package direct
+
+import (
+	"fmt"
+	"github.com/madokast/direct/memory"
+	"strings"
+)
+
+/**
+A file-backed arena keeps collections in a file. Reopen the file and find collections by their root names.
+Collections remember the id of their arena, so the arena is registered at the same id when reopened.
+Open file-backed arenas before NewArena to keep their ids free.
+A shared arena is a file-backed arena in /dev/shm attached by several processes.
+A root may record the type of its collection, checked when it is found.
+*/
+
+const arenaIDRootName = "direct.arenaID"
+
+// NewFileArena creates a file of totalSize holding the arena. The file must not exist
+func NewFileArena(path string, totalSize SizeType, options ...Option) (*Arena, error) {
+	m, err := memory.NewFile(path, totalSize)
+	if err != nil {
+		return nil, err
+	}
+	return newArenaOn(m, options)
+}
+
+// OpenFileArena opens the arena in the file from NewFileArena
+func OpenFileArena(path string, options ...Option) (*Arena, error) {
+	m, err := memory.OpenFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return openArenaOn(m, path, options)
+}
+
+// NewSharedArena creates an arena in shared memory named name. Other processes attach it by AttachSharedArena.
+// Processes sharing maps should run the same binary because maps keep their hash functions
+func NewSharedArena(name string, totalSize SizeType, options ...Option) (*Arena, error) {
+	m, err := memory.NewShared(name, totalSize)
+	if err != nil {
+		return nil, err
+	}
+	return newArenaOn(m, options)
+}
+
+// AttachSharedArena attaches the arena from NewSharedArena. Free detaches it.
+// Memory cached in local memories of a process is lost if the process exits without Free
+func AttachSharedArena(name string, options ...Option) (*Arena, error) {
+	m, err := memory.AttachShared(name)
+	if err != nil {
+		return nil, err
+	}
+	return openArenaOn(m, name, options)
+}
+
+// RemoveSharedArena removes the name of the shared arena. Attached processes can use it until Free
+func RemoveSharedArena(name string) error {
+	return memory.RemoveShared(name)
+}
+
+// newArenaOn registers an arena on the new memory and records its id
+func newArenaOn(m memory.Memory, options []Option) (*Arena, error) {
+	a, err := registerArena(func(id arenaID) bool { return id != globalArenaID })
+	if err != nil {
+		m.Free()
+		return nil, err
+	}
+	if err = m.SetRoot(arenaIDRootName, memory.Pointer(a.id)); err != nil {
+		unregisterArena(a)
+		m.Free()
+		return nil, err
+	}
+	a.memory = m
+	a.initLocals(newArenaConfig(options))
+	return a, nil
+}
+
+// openArenaOn registers an arena on the opened memory at its recorded id
+func openArenaOn(m memory.Memory, source string, options []Option) (*Arena, error) {
+	value, ok := m.Root(arenaIDRootName)
+	if !ok {
+		m.Free()
+		return nil, fmt.Errorf("%s has no arena id", source)
+	}
+	return registerArenaOn(m, arenaID(value), source, options)
+}
+
+// registerArenaOn registers an arena on the memory at the id
+func registerArenaOn(m memory.Memory, id arenaID, source string, options []Option) (*Arena, error) {
+	if id >= maxArenaNumber {
+		m.Free()
+		return nil, fmt.Errorf("bad arena id %d of %s", id, source)
+	}
+	a, err := registerArena(func(free arenaID) bool { return free == id })
+	if err != nil {
+		m.Free()
+		return nil, fmt.Errorf("arena id %d of %s is used", id, source)
+	}
+	a.memory = m
+	a.initLocals(newArenaConfig(options))
+	return a, nil
+}
+
+// Sync writes a file-backed arena back to its file. Memory cached in local memories is not written
+func (a *Arena) Sync() error {
+	return a.memory.Sync()
+}
+
+// kinds of roots. A root named by SetRoot is untyped
+const (
+	untypedRoot memory.RootKind = iota
+	sliceRoot
+	mapRoot
+	stackRoot
+)
+
+var rootKindNames = [...]string{"untyped", "slice", "map", "stack"}
+
+// SetRoot names a collection such as memory.Pointer(aMap), so it can be found by Root after reopening the arena.
+// SetRootSlice, SetRootMap and SetRootStack record the type of the collection as well
+func (a *Arena) SetRoot(name string, handle memory.Pointer) error {
+	return a.setRoot(name, handle, untypedRoot)
+}
+
+func (a *Arena) setRoot(name string, handle memory.Pointer, kind memory.RootKind) error {
+	if strings.HasPrefix(name, "direct.") {
+		return fmt.Errorf("root name %s is reserved", name)
+	}
+	return a.memory.SetTypedRoot(name, handle, kind)
+}
+
+// Root returns the collection named by SetRoot. Convert it to the collection type like Slice[int](handle).
+// Use RootMap for maps
+func (a *Arena) Root(name string) (handle memory.Pointer, ok bool) {
+	return a.memory.Root(name)
+}
+
+// typedRoot returns the root. It fails if the root is typed but not of the kind
+func (a *Arena) typedRoot(name string, kind memory.RootKind) (handle memory.Pointer, ok bool, err error) {
+	handle, rootKind, ok := a.memory.TypedRoot(name)
+	if ok && rootKind != untypedRoot && rootKind != kind {
+		return memory.NullPointer, false, fmt.Errorf("root %s is a %s but not a %s", name, rootKindNames[rootKind], rootKindNames[kind])
+	}
+	return handle, ok, nil
+}
+
+func (a *Arena) DeleteRoot(name string) {
+	a.memory.DeleteRoot(name)
+}
+
+// RootNames returns names of all roots
+func (a *Arena) RootNames() []string {
+	names := a.memory.RootNames()
+	for i := 0; i < len(names); i++ {
+		if strings.HasPrefix(names[i], "direct.") {
+			names = append(names[:i], names[i+1:]...)
+			i--
+		}
+	}
+	return names
+}
+
+// SetRootSlice names the slice. Find it by RootSlice
+func SetRootSlice[T any](arena *Arena, name string, s Slice[T]) error {
+	return arena.setRoot(name, memory.Pointer(s), sliceRoot)
+}
+
+// RootSlice returns the slice named by SetRootSlice or SetRoot
+func RootSlice[T any](arena *Arena, name string) (Slice[T], bool, error) {
+	handle, ok, err := arena.typedRoot(name, sliceRoot)
+	if err != nil || !ok || handle.IsNull() {
+		return nullSlice, ok, err
+	}
+	s := Slice[T](handle)
+	if s.header().arena != arena.id {
+		return nullSlice, false, fmt.Errorf("root %s is not a slice of the arena", name)
+	}
+	return s, true, nil
+}
+
+// SetRootStack names the stack. Find it by RootStack
+func SetRootStack[T any](arena *Arena, name string, s Stack[T]) error {
+	return arena.setRoot(name, memory.Pointer(s), stackRoot)
+}
+
+// RootStack returns the stack named by SetRootStack or SetRoot
+func RootStack[T any](arena *Arena, name string) (Stack[T], bool, error) {
+	handle, ok, err := arena.typedRoot(name, stackRoot)
+	if err != nil || !ok || handle.IsNull() {
+		return nullStack, ok, err
+	}
+	s := Stack[T](handle)
+	if s.header().arena != arena.id {
+		return nullStack, false, fmt.Errorf("root %s is not a stack of the arena", name)
+	}
+	return s, true, nil
+}
+
+// SetRootMap names the map. Find it by RootMap or RootCustomMap
+func SetRootMap[Key comparable, Value any](arena *Arena, name string, m Map[Key, Value]) error {
+	return arena.setRoot(name, memory.Pointer(m), mapRoot)
+}
+
+// RootMap returns the map of simple or String keys named by SetRootMap or SetRoot. It can be shared by processes
+func RootMap[Key comparable, Value any](arena *Arena, name string) (Map[Key, Value], bool, error) {
+	keyKind, err := defaultKeyKind[Key]()
+	if err != nil {
+		return nilMap, false, err
+	}
+	return rootMap[Key, Value](arena, name, keyKind)
+}
+
+// RootCustomMap returns the map from MakeCustomMap named by SetRootMap or SetRoot. Hash and equal functions of the last process are replaced.
+// A custom map cannot be used by several processes at the same time
+func RootCustomMap[Key comparable, Value any](arena *Arena, name string, hash func(Key) SizeType, equal func(key1 Key, key2 Key) bool) (Map[Key, Value], bool, error) {
+	m, ok, err := rootMap[Key, Value](arena, name, customKey)
+	if err != nil || !ok {
+		return m, ok, err
+	}
+	header := m.header()
+	header.hash = hash
+	header.equal = equal
+	header.hashEqualRefCtrl(1)
+	return m, true, nil
+}
+
+func rootMap[Key comparable, Value any](arena *Arena, name string, keyKind SizeType) (Map[Key, Value], bool, error) {
+	handle, ok, err := arena.typedRoot(name, mapRoot)
+	if err != nil || !ok || handle.IsNull() {
+		return nilMap, ok, err
+	}
+	m := Map[Key, Value](handle)
+	header := m.header()
+	if header.arena != arena.id || header.keyKind != keyKind {
+		return nilMap, false, fmt.Errorf("root %s is not a map of the arena with the key type", name)
+	}
+	return m, true, nil
+}
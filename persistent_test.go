@@ -0,0 +1,188 @@
+package direct
+
+import (
+	"fmt"
+	"github.com/madokast/direct/memory"
+	"github.com/madokast/direct/utils"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"testing"
+)
+
+func TestFileArena(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("file-backed arena is only supported on linux")
+	}
+	path := filepath.Join(t.TempDir(), "arena")
+	{
+		arena := utils.PanicErr1(NewFileArena(path, 16*memory.MB))
+		users := utils.PanicErr1(MakeMapIn[int, int](arena, 16))
+		for i := 0; i < 10000; i++ {
+			utils.PanicErr(users.Put(i, i*i))
+		}
+		names := utils.PanicErr1(MakeSliceFromGoSliceIn(arena, []int{1, 2, 3}))
+		utils.PanicErr(arena.SetRoot("users", memory.Pointer(users)))
+		utils.PanicErr(arena.SetRoot("names", memory.Pointer(names)))
+		utils.Assert(arena.SetRoot(arenaIDRootName, memory.NullPointer) != nil)
+		arena.Free()
+	}
+
+	_, err := NewFileArena(path, 16*memory.MB)
+	utils.Assert(err != nil) // exists
+
+	{
+		arena := utils.PanicErr1(OpenFileArena(path))
+		users, ok, err := RootMap[int, int](arena, "users")
+		utils.PanicErr(err)
+		utils.Assert(ok)
+		utils.Assert(users.Length() == 10000, users.Length())
+		for i := 0; i < 10000; i++ {
+			utils.Assert(users.Get(i) == i*i, i)
+		}
+		handle, ok := arena.Root("names")
+		utils.Assert(ok)
+		names := Slice[int](handle)
+		utils.Assert(names.String() == "[1 2 3]", names)
+		utils.PanicErr(names.Append(4)) // grows in the arena
+		utils.PanicErr(arena.SetRoot("names", memory.Pointer(names)))
+		_, ok = arena.Root("none")
+		utils.Assert(!ok)
+		arena.Free()
+	}
+
+	{
+		arena := utils.PanicErr1(OpenFileArena(path))
+		_, err := OpenFileArena(path)
+		utils.Assert(err != nil) // mapped
+		handle, _ := arena.Root("names")
+		names := Slice[int](handle)
+		utils.Assert(names.String() == "[1 2 3 4]", names)
+		users, _, _ := RootMap[int, int](arena, "users")
+		users.Free()
+		names.Free()
+		arena.DeleteRoot("users")
+		arena.DeleteRoot("names")
+		arena.Free()
+	}
+}
+
+func TestFileArena_relocated(t *testing.T) {
+	if runtime.GOOS != "linux" || !memory.Relocatable {
+		t.Skip("run with the relocatable tag on linux")
+	}
+	dir := t.TempDir()
+	path := filepath.Join(dir, "arena")
+	var address memory.Pointer
+	{
+		arena := utils.PanicErr1(NewFileArena(path, 16*memory.MB))
+		address = memory.Pointer(arena.memory)
+		sf := NewStringFactoryIn(arena)
+		users := utils.PanicErr1(MakeMapIn[String, int](arena, 16))
+		stack := utils.PanicErr1(MakeStackIn[int](arena))
+		for i := 0; i < 1000; i++ {
+			utils.PanicErr(users.Put(utils.PanicErr1(sf.CreateFromGoString(fmt.Sprint("user", i))), i))
+			utils.PanicErr(stack.Push(i))
+		}
+		sf.Destroy()
+		utils.PanicErr(arena.SetRoot("users", memory.Pointer(users)))
+		utils.PanicErr(arena.SetRoot("stack", memory.Pointer(stack)))
+		arena.Free()
+	}
+
+	guard := utils.PanicErr1(memory.NewFile(filepath.Join(dir, "guard"), 16*memory.MB)) // likely takes the old address
+	defer guard.Free()
+	arena := utils.PanicErr1(OpenFileArena(path))
+	t.Log("mapped at", address.String(), "then", memory.Pointer(arena.memory).String())
+	users, ok, err := RootMap[String, int](arena, "users")
+	utils.PanicErr(err)
+	utils.Assert(ok)
+	sf := NewStringFactoryIn(arena)
+	for i := 0; i < 1000; i++ {
+		key := utils.PanicErr1(sf.CreateFromGoString(fmt.Sprint("user", i)))
+		utils.Assert(users.Get(key) == i, i)
+		key.Free()
+	}
+	sf.Destroy()
+	handle, _ := arena.Root("stack")
+	stack := Stack[int](handle)
+	utils.Assert(stack.Length() == 1000 && stack.Top() == 999)
+	utils.PanicErr(stack.Push(1000)) // links a node by ref
+	utils.Assert(stack.ToGoSlice()[1000] == 1000)
+
+	users.Iterate(func(key String, _ int) {
+		key.Free()
+	})
+	users.Free()
+	stack.Free()
+	arena.DeleteRoot("users")
+	arena.DeleteRoot("stack")
+	arena.Free()
+}
+
+func TestSharedArena(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("shared arena is only supported on linux")
+	}
+	if name := os.Getenv("DIRECT_SHARED_ARENA"); name != "" {
+		sharedArenaChild(name)
+		return
+	}
+
+	name := fmt.Sprintf("direct-test-%d", os.Getpid())
+	arena := utils.PanicErr1(NewSharedArena(name, 64*memory.MB))
+	defer func() { utils.PanicErr(RemoveSharedArena(name)) }()
+	defer arena.Free()
+
+	table := utils.PanicErr1(MakeMapIn[int, int](arena, 16))
+	for i := 0; i < 1000; i++ {
+		utils.PanicErr(table.Put(i, i))
+	}
+	utils.PanicErr(arena.SetRoot("table", memory.Pointer(table)))
+
+	child := exec.Command(os.Args[0], "-test.run=^TestSharedArena$")
+	child.Env = append(os.Environ(), "DIRECT_SHARED_ARENA="+name)
+	child.Stdout = os.Stdout
+	child.Stderr = os.Stderr
+	utils.PanicErr(child.Start())
+	sharedArenaWork(arena) // allocates with the child at the same time
+	utils.PanicErr(child.Wait())
+
+	handle, ok := arena.Root("child")
+	utils.Assert(ok)
+	result := Slice[int](handle)
+	utils.Assert(result.Length() == 1000, result.Length())
+	for i := 0; i < 1000; i++ {
+		utils.Assert(result.Get(SizeType(i)) == i*2, i)
+	}
+	result.Free()
+	table.Free()
+	arena.DeleteRoot("child")
+	arena.DeleteRoot("table")
+}
+
+func sharedArenaChild(name string) {
+	arena := utils.PanicErr1(AttachSharedArena(name))
+	defer arena.Free()
+	table, ok, err := RootMap[int, int](arena, "table")
+	utils.PanicErr(err)
+	utils.Assert(ok)
+	sharedArenaWork(arena)
+
+	result := utils.PanicErr1(MakeSliceIn[int](arena, 16))
+	for i := 0; i < 1000; i++ {
+		utils.PanicErr(result.Append(table.Get(i) * 2))
+	}
+	utils.PanicErr(arena.SetRoot("child", memory.Pointer(result)))
+}
+
+func sharedArenaWork(arena *Arena) {
+	for i := 0; i < 1000; i++ {
+		s := utils.PanicErr1(MakeSliceIn[int](arena, SizeType(i%100+1)))
+		for j := 0; j < 100; j++ {
+			utils.PanicErr(s.Append(j))
+		}
+		s.Free()
+	}
+}
@@ -0,0 +1,121 @@
+package direct
+
+import (
+	"fmt"
+	"github.com/madokast/direct/memory"
+	"sync"
+	"sync/atomic"
+)
+
+/**
+Pressure callbacks let users shed memory, like entries of caches, before OOM.
+A callback fires once when the allocated fraction of an arena reaches its threshold,
+and is re-armed when the fraction falls PressureHysteresis below the threshold, so it does not fire on every allocation near it.
+The allocated size includes memory cached in local memories. It is checked after allocations and frees by two atomic loads.
+A soft limit lets allocations over it succeed, and reports the arena over it in Stats.
+*/
+
+// PressureHysteresis is how far the allocated fraction falls below a threshold before its callback is re-armed.
+// Half of the threshold if the threshold is not larger
+const PressureHysteresis = 0.05
+
+type pressureCallback struct {
+	high  SizeType // fires when allocated pages reach it
+	low   SizeType // re-armed when allocated pages fall below it
+	fn    func(fraction float64)
+	armed bool
+}
+
+type pressure struct {
+	totalPageNumber SizeType
+	softLimit       SizeType
+	mu              sync.Mutex
+	callbacks       []*pressureCallback
+	nextHigh        atomic.Uint64 // the lowest high of armed callbacks
+	nextLow         atomic.Uint64 // the highest low of fired callbacks
+}
+
+// WithSoftLimit makes the arena report itself over the soft limit in Stats when more than size bytes are allocated.
+// Allocations still succeed. 0 for none, the default
+func WithSoftLimit(size SizeType) Option {
+	return func(c *arenaConfig) {
+		c.softLimit = size
+	}
+}
+
+func newPressure(totalSize, softLimit SizeType) *pressure {
+	p := &pressure{totalPageNumber: totalSize >> memory.BasePageSizeShiftNumber, softLimit: softLimit}
+	p.nextHigh.Store(uint64(memory.SizeTypeMax))
+	return p
+}
+
+// OnPressure registers fn called when the allocated fraction of the arena reaches threshold in (0, 1].
+// fn is called in the goroutine allocating, after the allocation, with the fraction then. It may free memory of the arena.
+// A budget registers to its parent
+func (a *Arena) OnPressure(threshold float64, fn func(fraction float64)) {
+	if a.memory.IsNull() {
+		panic("register pressure callbacks of an un-init arena")
+	}
+	if threshold <= 0 || threshold > 1 {
+		panic(fmt.Sprintf("pressure threshold %f out of (0, 1]", threshold))
+	}
+	p := a.pressure
+	low := threshold - PressureHysteresis
+	if low <= 0 {
+		low = threshold / 2
+	}
+	p.mu.Lock()
+	p.callbacks = append(p.callbacks, &pressureCallback{
+		high:  SizeType(threshold * float64(p.totalPageNumber)),
+		low:   SizeType(low * float64(p.totalPageNumber)),
+		fn:    fn,
+		armed: true,
+	})
+	p.updateWatermarks()
+	p.mu.Unlock()
+	p.check(a.memory.AllocatedPageNumber())
+}
+
+// check fires callbacks crossed. The fast path is two atomic loads
+func (p *pressure) check(allocatedPageNumber SizeType) {
+	if uint64(allocatedPageNumber) < p.nextHigh.Load() && uint64(allocatedPageNumber) >= p.nextLow.Load() {
+		return
+	}
+	var fns []func(float64)
+	p.mu.Lock()
+	for _, c := range p.callbacks {
+		if c.armed && allocatedPageNumber >= c.high {
+			c.armed = false
+			fns = append(fns, c.fn)
+		} else if !c.armed && allocatedPageNumber < c.low {
+			c.armed = true
+		}
+	}
+	p.updateWatermarks()
+	p.mu.Unlock()
+	fraction := float64(allocatedPageNumber) / float64(p.totalPageNumber)
+	for _, fn := range fns {
+		fn(fraction)
+	}
+}
+
+// updateWatermarks caller holds mu
+func (p *pressure) updateWatermarks() {
+	nextHigh, nextLow := memory.SizeTypeMax, SizeType(0)
+	for _, c := range p.callbacks {
+		if c.armed && c.high < nextHigh {
+			nextHigh = c.high
+		}
+		if !c.armed && c.low > nextLow {
+			nextLow = c.low
+		}
+	}
+	p.nextHigh.Store(uint64(nextHigh))
+	p.nextLow.Store(uint64(nextLow))
+}
+
+// OverSoftLimit reports more memory than the soft limit is allocated. See WithSoftLimit
+func (a *Arena) OverSoftLimit() bool {
+	p := a.pressure
+	return p.softLimit > 0 && a.memory.AllocatedPageNumber()<<memory.BasePageSizeShiftNumber > p.softLimit
+}
@@ -0,0 +1,61 @@
+package direct
+
+import (
+	"github.com/madokast/direct/memory"
+	"github.com/madokast/direct/utils"
+	"testing"
+)
+
+func TestArena_OnPressure(t *testing.T) {
+	arena := NewArena(64 * memory.MB)
+	defer arena.Free()
+	var fractions []float64
+	arena.OnPressure(0.5, func(fraction float64) {
+		fractions = append(fractions, fraction)
+	})
+
+	var slices []Slice[byte]
+	allocate := func(size SizeType) {
+		for arena.Stats().AllocatedSize < size {
+			slices = append(slices, utils.PanicErr1(MakeSliceIn[byte](arena, 256*memory.KB)))
+		}
+	}
+	allocate(48 * memory.MB)
+	utils.Assert(len(fractions) == 1 && fractions[0] >= 0.5, fractions)
+	for _, s := range slices {
+		s.Free()
+	}
+	slices = slices[:0]
+	utils.Assert(arena.Stats().AllocatedSize < 29*memory.MB, arena.Stats().AllocatedSize) // re-armed
+	allocate(40 * memory.MB)
+	utils.Assert(len(fractions) == 2, fractions)
+
+	// a callback shedding memory
+	var shed int
+	arena.OnPressure(0.7, func(float64) {
+		for _, s := range slices {
+			s.Free()
+		}
+		slices = slices[:0]
+		shed++
+	})
+	for shed == 0 {
+		slices = append(slices, utils.PanicErr1(MakeSliceIn[byte](arena, 256*memory.KB)))
+	}
+	utils.Assert(len(slices) == 1 && len(fractions) == 2, len(slices), fractions) // the one allocated when shedding
+	for _, s := range slices {
+		s.Free()
+	}
+}
+
+func TestWithSoftLimit(t *testing.T) {
+	arena := NewArena(16*memory.MB, WithSoftLimit(4*memory.MB))
+	defer arena.Free()
+	utils.Assert(!arena.OverSoftLimit() && !arena.Stats().OverSoftLimit)
+	s := utils.PanicErr1(MakeSliceIn[byte](arena, 5*memory.MB))
+	stats := arena.Stats()
+	utils.Assert(arena.OverSoftLimit() && stats.OverSoftLimit && stats.SoftLimit == 4*memory.MB, stats)
+	s.Free()
+	arena.flushLocals()
+	utils.Assert(!arena.OverSoftLimit())
+}
@@ -0,0 +1,299 @@
+package direct
+
+import (
+	"compress/gzip"
+	"github.com/madokast/direct/memory"
+	"io"
+	"math"
+	"math/rand"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+/**
+A profiler samples one allocation per about rate bytes, like runtime.MemProfileRate, and records its stack.
+Samples are written as a pprof heap profile with alloc and inuse sample types, so go tool pprof shows
+which call sites hold off-heap memory.
+The fast path of an allocation is an atomic add. A free looks up the sampled pointers only if a counting filter says
+the pointer may be sampled.
+*/
+
+// ProfileRate is the default of WithProfileRate. Change it before making arenas
+var ProfileRate SizeType = 512 * KB
+
+const maxProfileStackDepth = 32
+const profileFilterSize = 4096 // counters of sampled pointers by hash
+
+type profileStack [maxProfileStackDepth]uintptr
+
+type profileBucket struct {
+	stack        profileStack
+	allocObjects int64
+	allocBytes   int64
+	freeObjects  int64
+	freeBytes    int64
+}
+
+type profileSample struct {
+	bucket *profileBucket
+	size   SizeType
+}
+
+type profiler struct {
+	rate    SizeType
+	next    atomic.Int64 // bytes before the next sample
+	filter  [profileFilterSize]atomic.Int32
+	mu      sync.Mutex
+	buckets map[profileStack]*profileBucket
+	samples map[memory.Pointer]profileSample // sampled and not freed
+	start   time.Time
+}
+
+func newProfiler(rate SizeType) *profiler {
+	p := &profiler{
+		rate:    rate,
+		buckets: map[profileStack]*profileBucket{},
+		samples: map[memory.Pointer]profileSample{},
+		start:   time.Now(),
+	}
+	p.next.Store(p.nextSampleDistance())
+	return p
+}
+
+// WithProfileRate samples one allocation per about rate bytes for WriteHeapProfile. 0 for off. The default is ProfileRate
+func WithProfileRate(rate SizeType) Option {
+	return func(c *arenaConfig) {
+		c.profileRate = rate
+	}
+}
+
+// nextSampleDistance is exponentially distributed with mean rate, so every byte is sampled with the same chance
+func (p *profiler) nextSampleDistance() int64 {
+	return int64(rand.ExpFloat64()*float64(p.rate)) + 1
+}
+
+// alloc records the allocation if sampled. skip is for runtime.Callers
+func (p *profiler) alloc(ptr memory.Pointer, size SizeType, skip int) {
+	if p.next.Add(-int64(size)) > 0 {
+		return
+	}
+	p.next.Store(p.nextSampleDistance())
+
+	var stack profileStack
+	runtime.Callers(skip+1, stack[:])
+	p.mu.Lock()
+	bucket := p.buckets[stack]
+	if bucket == nil {
+		bucket = &profileBucket{stack: stack}
+		p.buckets[stack] = bucket
+	}
+	bucket.allocObjects++
+	bucket.allocBytes += int64(size)
+	if _, ok := p.samples[ptr]; !ok {
+		p.samples[ptr] = profileSample{bucket: bucket, size: size}
+		p.filter[profileFilterIndex(ptr)].Add(1)
+	}
+	p.mu.Unlock()
+}
+
+func (p *profiler) free(ptr memory.Pointer) {
+	counter := &p.filter[profileFilterIndex(ptr)]
+	if counter.Load() == 0 {
+		return
+	}
+	p.mu.Lock()
+	if sample, ok := p.samples[ptr]; ok {
+		sample.bucket.freeObjects++
+		sample.bucket.freeBytes += int64(sample.size)
+		delete(p.samples, ptr)
+		counter.Add(-1)
+	}
+	p.mu.Unlock()
+}
+
+func profileFilterIndex(ptr memory.Pointer) int {
+	return int((ptr >> 4) * 0x9E3779B97F4A7C15 >> 52) // the top 12 bits
+}
+
+// WriteHeapProfile writes sampled allocations of the arena as a gzipped pprof heap profile.
+// Sample types are alloc_objects, alloc_space, inuse_objects and inuse_space. Nothing is sampled if the rate is 0
+func (a *Arena) WriteHeapProfile(w io.Writer) error {
+	if a.parent != nil {
+		return a.parent.WriteHeapProfile(w)
+	}
+	var buckets []profileBucket
+	rate := SizeType(0)
+	start := time.Now()
+	if p := a.profiler; p != nil {
+		p.mu.Lock()
+		for _, bucket := range p.buckets {
+			buckets = append(buckets, *bucket)
+		}
+		p.mu.Unlock()
+		rate, start = p.rate, p.start
+	}
+
+	b := newProfileBuilder()
+	b.valueTypes(1, [][2]string{{"alloc_objects", "count"}, {"alloc_space", "bytes"}, {"inuse_objects", "count"}, {"inuse_space", "bytes"}})
+	for _, bucket := range buckets {
+		allocObjects, allocBytes := scaleHeapSample(bucket.allocObjects, bucket.allocBytes, rate)
+		inuseObjects, inuseBytes := scaleHeapSample(bucket.allocObjects-bucket.freeObjects, bucket.allocBytes-bucket.freeBytes, rate)
+		b.sample(b.locations(bucket.stack[:]), []int64{allocObjects, allocBytes, inuseObjects, inuseBytes})
+	}
+	b.int64s(9, start.UnixNano())
+	b.int64s(10, time.Since(start).Nanoseconds())
+	b.valueTypes(11, [][2]string{{"space", "bytes"}})
+	b.int64s(12, int64(rate))
+
+	zw := gzip.NewWriter(w)
+	if _, err := zw.Write(b.finish()); err != nil {
+		return err
+	}
+	return zw.Close()
+}
+
+// scaleHeapSample estimates the number and size of all allocations from the sampled ones. See runtime/pprof
+func scaleHeapSample(count, size int64, rate SizeType) (int64, int64) {
+	if count <= 0 || size <= 0 {
+		return 0, 0
+	}
+	if rate <= 1 {
+		return count, size
+	}
+	averageSize := float64(size) / float64(count)
+	scale := 1 / (1 - math.Exp(-averageSize/float64(rate)))
+	return int64(float64(count) * scale), int64(float64(size) * scale)
+}
+
+/*--------------------- profile.proto encoder -------------------*/
+
+// profileBuilder encodes the message Profile of github.com/google/pprof/proto/profile.proto
+type profileBuilder struct {
+	buf         []byte // the Profile being encoded
+	strings     map[string]int64
+	stringIDs   []string
+	locationIDs map[uintptr]uint64
+	functionIDs map[string]uint64
+	tail        []byte // locations and functions written after samples
+}
+
+func newProfileBuilder() *profileBuilder {
+	b := &profileBuilder{
+		strings:     map[string]int64{},
+		locationIDs: map[uintptr]uint64{},
+		functionIDs: map[string]uint64{},
+	}
+	b.stringID("")
+	return b
+}
+
+func (b *profileBuilder) stringID(s string) int64 {
+	id, ok := b.strings[s]
+	if !ok {
+		id = int64(len(b.stringIDs))
+		b.strings[s] = id
+		b.stringIDs = append(b.stringIDs, s)
+	}
+	return id
+}
+
+func (b *profileBuilder) valueTypes(field int, types [][2]string) {
+	for _, t := range types {
+		var message []byte
+		message = appendVarintField(message, 1, uint64(b.stringID(t[0])))
+		message = appendVarintField(message, 2, uint64(b.stringID(t[1])))
+		b.buf = appendBytesField(b.buf, field, message)
+	}
+}
+
+func (b *profileBuilder) int64s(field int, value int64) {
+	b.buf = appendVarintField(b.buf, field, uint64(value))
+}
+
+func (b *profileBuilder) sample(locations []uint64, values []int64) {
+	var ids, vs, message []byte
+	for _, id := range locations {
+		ids = appendVarint(ids, id)
+	}
+	for _, v := range values {
+		vs = appendVarint(vs, uint64(v))
+	}
+	message = appendBytesField(message, 1, ids)
+	message = appendBytesField(message, 2, vs)
+	b.buf = appendBytesField(b.buf, 2, message)
+}
+
+// locations returns ids of locations of the stack, making new locations and functions
+func (b *profileBuilder) locations(stack []uintptr) (ids []uint64) {
+	for _, pc := range stack {
+		if pc == 0 {
+			break
+		}
+		id, ok := b.locationIDs[pc]
+		if !ok {
+			id = uint64(len(b.locationIDs) + 1)
+			b.locationIDs[pc] = id
+			var message []byte
+			message = appendVarintField(message, 1, id)
+			message = appendVarintField(message, 3, uint64(pc))
+			frames := runtime.CallersFrames([]uintptr{pc})
+			for {
+				frame, more := frames.Next()
+				var line []byte
+				line = appendVarintField(line, 1, b.function(frame.Function, frame.File))
+				line = appendVarintField(line, 2, uint64(frame.Line))
+				message = appendBytesField(message, 4, line)
+				if !more {
+					break
+				}
+			}
+			b.tail = appendBytesField(b.tail, 4, message)
+		}
+		ids = append(ids, id)
+	}
+	return ids
+}
+
+func (b *profileBuilder) function(name, file string) uint64 {
+	id, ok := b.functionIDs[name]
+	if !ok {
+		id = uint64(len(b.functionIDs) + 1)
+		b.functionIDs[name] = id
+		var message []byte
+		message = appendVarintField(message, 1, id)
+		message = appendVarintField(message, 2, uint64(b.stringID(name)))
+		message = appendVarintField(message, 3, uint64(b.stringID(name)))
+		message = appendVarintField(message, 4, uint64(b.stringID(file)))
+		b.tail = appendBytesField(b.tail, 5, message)
+	}
+	return id
+}
+
+func (b *profileBuilder) finish() []byte {
+	buf := append(b.buf, b.tail...)
+	for _, s := range b.stringIDs {
+		buf = appendBytesField(buf, 6, []byte(s))
+	}
+	return buf
+}
+
+func appendVarint(buf []byte, v uint64) []byte {
+	for v >= 0x80 {
+		buf = append(buf, byte(v)|0x80)
+		v >>= 7
+	}
+	return append(buf, byte(v))
+}
+
+func appendVarintField(buf []byte, field int, v uint64) []byte {
+	buf = appendVarint(buf, uint64(field)<<3)
+	return appendVarint(buf, v)
+}
+
+func appendBytesField(buf []byte, field int, v []byte) []byte {
+	buf = appendVarint(buf, uint64(field)<<3|2)
+	buf = appendVarint(buf, uint64(len(v)))
+	return append(buf, v...)
+}
@@ -0,0 +1,38 @@
+package direct
+
+import (
+	"bytes"
+	"compress/gzip"
+	"github.com/madokast/direct/memory"
+	"github.com/madokast/direct/utils"
+	"io"
+	"os"
+	"testing"
+)
+
+func TestArena_WriteHeapProfile(t *testing.T) {
+	arena := NewArena(16*memory.MB, WithProfileRate(1)) // every allocation
+	defer arena.Free()
+	kept := utils.PanicErr1(MakeSliceIn[int](arena, 1024))
+	freed := utils.PanicErr1(MakeMapIn[int, int](arena, 1024))
+	freed.Free()
+	utils.Assert(len(arena.profiler.samples) == 1, len(arena.profiler.samples))
+
+	var buffer bytes.Buffer
+	utils.PanicErr(arena.WriteHeapProfile(&buffer))
+	if path := os.Getenv("DIRECT_HEAP_PROFILE"); path != "" {
+		utils.PanicErr(os.WriteFile(path, buffer.Bytes(), 0o644)) // for go tool pprof
+	}
+	profile := utils.PanicErr1(io.ReadAll(utils.PanicErr1(gzip.NewReader(&buffer))))
+	for _, s := range []string{"inuse_space", "alloc_objects", "TestArena_WriteHeapProfile", "profile_test.go"} {
+		utils.Assert(bytes.Contains(profile, []byte(s)), s)
+	}
+	kept.Free()
+	utils.Assert(len(arena.profiler.samples) == 0, len(arena.profiler.samples))
+
+	arena2 := NewArena(1*memory.MB, WithProfileRate(0))
+	defer arena2.Free()
+	utils.Assert(arena2.profiler == nil)
+	buffer.Reset()
+	utils.PanicErr(arena2.WriteHeapProfile(&buffer)) // empty
+}
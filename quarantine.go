@@ -0,0 +1,170 @@
+package direct
+
+import (
+	"fmt"
+	"github.com/madokast/direct/memory"
+	"runtime"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+/**
+A quarantine is a debug mode catching use-after-free and double free.
+Freed memory is filled with the poison pattern and held in a FIFO instead of being reused at once.
+When it leaves the quarantine to be reused, a byte not in the pattern means it was written after free.
+Freeing memory still in the quarantine is a double free. Collections check their headers before reading them in Free,
+so a double free is caught before following poisoned pointers.
+Memory leaving the quarantine earlier cannot be checked.
+*/
+
+type quarantined struct {
+	ptr  memory.Pointer
+	page memory.PageHandler // memory.SmallObjectPageHandler for a small object
+	size SizeType
+	file string // where it is freed
+	line int
+}
+
+type quarantine struct {
+	memory  memory.Memory // of the arena owning the quarantine
+	limit   SizeType
+	size    SizeType
+	mu      sync.Mutex
+	fifo    []memory.Pointer
+	entries map[memory.Pointer]quarantined
+}
+
+// quarantines of the arenas checking frees. Copied on change, so checkDoubleFree reads it without a lock. A load when empty
+var (
+	quarantines   atomic.Pointer[[]*quarantine]
+	quarantinesMu sync.Mutex
+)
+
+// WithFreeCheck poisons freed memory and keeps up to quarantineSize bytes of it from being reused,
+// to find use-after-free and double free. 0 for off, the default. It is slow and for debugging only
+func WithFreeCheck(quarantineSize SizeType) Option {
+	return func(c *arenaConfig) {
+		c.quarantineSize = quarantineSize
+	}
+}
+
+func newQuarantine(limit SizeType, m memory.Memory) *quarantine {
+	q := &quarantine{memory: m, limit: limit, entries: map[memory.Pointer]quarantined{}}
+	quarantinesMu.Lock()
+	defer quarantinesMu.Unlock()
+	var list []*quarantine
+	if old := quarantines.Load(); old != nil {
+		list = append(list, *old...)
+	}
+	list = append(list, q)
+	quarantines.Store(&list)
+	return q
+}
+
+// put poisons the freed memory and quarantines it. Returns memory leaving the quarantine
+func (q *quarantine) put(ptr memory.Pointer, page memory.PageHandler, size SizeType) (evicted []quarantined) {
+	file, line := freeCaller()
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if first, ok := q.entries[ptr]; ok {
+		panic(fmt.Sprintf("double free %s at %s:%d. It is freed at %s:%d", ptr.String(), file, line, first.file, first.line))
+	}
+	memory.LibMarkFreedMemory(ptr, size)
+	q.entries[ptr] = quarantined{ptr: ptr, page: page, size: size, file: file, line: line}
+	q.fifo = append(q.fifo, ptr)
+	q.size += size
+	for q.size > q.limit {
+		evicted = append(evicted, q.pop())
+	}
+	return evicted
+}
+
+// drain returns all quarantined memory
+func (q *quarantine) drain() (evicted []quarantined) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for len(q.fifo) > 0 {
+		evicted = append(evicted, q.pop())
+	}
+	q.fifo = nil
+	return evicted
+}
+
+// pop removes the oldest. Caller holds mu
+func (q *quarantine) pop() quarantined {
+	entry := q.entries[q.fifo[0]]
+	q.fifo[0] = memory.NullPointer
+	q.fifo = q.fifo[1:]
+	delete(q.entries, entry.ptr)
+	q.size -= entry.size
+	return entry
+}
+
+func (q *quarantine) contains(ptr memory.Pointer) (quarantined, bool) {
+	q.mu.Lock()
+	entry, ok := q.entries[ptr]
+	q.mu.Unlock()
+	return entry, ok
+}
+
+// check panics if the memory is written after free
+func (e *quarantined) check() {
+	if offset := memory.LibFindWrittenAfterFree(e.ptr, e.size); offset < e.size {
+		what := "small object"
+		if e.page != memory.SmallObjectPageHandler {
+			what = "page " + e.page.String()
+		}
+		panic(fmt.Sprintf("%s %s of %s freed at %s:%d is written after free at offset %d",
+			what, e.ptr.String(), memory.HumanFriendlyMemorySize(e.size), e.file, e.line, offset))
+	}
+}
+
+func (q *quarantine) free() {
+	quarantinesMu.Lock()
+	defer quarantinesMu.Unlock()
+	var list []*quarantine
+	for _, other := range *quarantines.Load() {
+		if other != q {
+			list = append(list, other)
+		}
+	}
+	quarantines.Store(&list)
+}
+
+// freeChecked reports whether any arena checks frees. Collections check more then
+func freeChecked() bool {
+	list := quarantines.Load()
+	return list != nil && len(*list) > 0
+}
+
+// checkDoubleFree panics if the collection at ptr is freed and still quarantined. Call it before reading the header in Free
+func checkDoubleFree(ptr memory.Pointer) {
+	if !freeChecked() {
+		return
+	}
+	for _, q := range *quarantines.Load() {
+		if !q.memory.Contains(ptr) {
+			continue
+		}
+		if first, ok := q.contains(ptr); ok {
+			file, line := freeCaller()
+			panic(fmt.Sprintf("double free %s at %s:%d. It is freed at %s:%d", ptr.String(), file, line, first.file, first.line))
+		}
+		return // only the arena owning ptr quarantines it
+	}
+}
+
+const directPackagePrefix = "github.com/madokast/direct."
+
+// freeCaller is the first caller out of this package, or a test of it
+func freeCaller() (file string, line int) {
+	var pcs [32]uintptr
+	frames := runtime.CallersFrames(pcs[:runtime.Callers(2, pcs[:])])
+	for {
+		frame, more := frames.Next()
+		if !strings.HasPrefix(frame.Function, directPackagePrefix) || strings.HasSuffix(frame.File, "_test.go") || !more {
+			return frame.File, frame.Line
+		}
+	}
+}
@@ -0,0 +1,91 @@
+package direct
+
+import (
+	"fmt"
+	"github.com/madokast/direct/memory"
+	"github.com/madokast/direct/utils"
+	"strings"
+	"testing"
+)
+
+// panicMessage returns the panic of f. Empty if f does not panic
+func panicMessage(f func()) (message string) {
+	defer func() {
+		if r := recover(); r != nil {
+			message = fmt.Sprint(r)
+		}
+	}()
+	f()
+	return ""
+}
+
+func TestWithFreeCheck_useAfterFree(t *testing.T) {
+	arena := NewArena(16*memory.MB, WithFreeCheck(64*memory.KB))
+	defer arena.Free()
+	s := utils.PanicErr1(MakeSliceIn[int](arena, 1024))
+	ptr := s.pointer() // of the page
+	s.Free()
+	*memory.PointerAs[int](ptr + 16) = 1 // use after free
+
+	message := panicMessage(func() {
+		for i := 0; i < 16; i++ { // evict s from the quarantine
+			s2 := utils.PanicErr1(MakeSliceIn[int](arena, 1024))
+			s2.Free()
+		}
+	})
+	t.Log(message)
+	utils.Assert(strings.Contains(message, "is written after free at offset 16"), message)
+	utils.Assert(strings.Contains(message, "quarantine_test.go"), message) // where it is freed
+}
+
+func TestWithFreeCheck_doubleFree(t *testing.T) {
+	arena := NewArena(16*memory.MB, WithFreeCheck(1*memory.MB))
+	defer arena.Free()
+	expectDoubleFree := func(free func()) {
+		message := panicMessage(free)
+		t.Log(message)
+		utils.Assert(strings.Contains(message, "double free"), message)
+	}
+
+	s := utils.PanicErr1(MakeSliceIn[int](arena, 10))
+	s.Free()
+	expectDoubleFree(s.Free)
+
+	m := utils.PanicErr1(MakeMapIn[int, int](arena, 10))
+	utils.PanicErr(m.Put(1, 1))
+	m.Free()
+	expectDoubleFree(m.Free)
+
+	stack := utils.PanicErr1(MakeStackIn[int](arena))
+	utils.PanicErr(stack.Push(1))
+	stack.Free()
+	expectDoubleFree(stack.Free)
+
+	sf := NewStringFactoryIn(arena)
+	str := utils.PanicErr1(sf.CreateFromGoString("hello"))
+	sf.Destroy()
+	str.Free() // the holder is freed
+	expectDoubleFree(str.Free)
+
+	shared := CreateSharedFactoryIn[Slice[int]](arena)
+	obj := utils.PanicErr1(shared.MakeShared(utils.PanicErr1(MakeSliceIn[int](arena, 10))))
+	copied := obj
+	obj.Free()
+	expectDoubleFree(copied.Free)
+	shared.Destroy()
+}
+
+func TestWithFreeCheck_doubleFreeString(t *testing.T) {
+	arena := NewArena(16*memory.MB, WithFreeCheck(1*memory.MB))
+	defer arena.Free()
+	sf := NewStringFactoryIn(arena)
+	defer sf.Destroy()
+	str := utils.PanicErr1(sf.CreateFromGoString("hello"))
+	sibling := utils.PanicErr1(sf.CreateFromGoString("world")) // in the same holder, which stays alive
+	str.Free()
+	message := panicMessage(str.Free)
+	t.Log(message)
+	utils.Assert(strings.Contains(message, "double free"), message)
+	utils.Assert(sibling.String() == "world", sibling.String())
+	sibling.Free()
+}
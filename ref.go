@@ -0,0 +1,18 @@
+package direct
+
+import "github.com/madokast/direct/memory"
+
+// ref is a pointer stored in collections. It is the pointer itself unless memory.Relocatable,
+// where it is the arena id and the offset from the arena memory, so the arena can be mapped anywhere.
+// Adding to a ref moves it inside the same object like a pointer. The zero value is null
+type ref memory.Pointer
+
+const nullRef ref = 0
+
+func (r ref) IsNull() bool {
+	return r == nullRef
+}
+
+func (r ref) IsNotNull() bool {
+	return r != nullRef
+}
@@ -0,0 +1,18 @@
+//go:build !relocatable
+
+package direct
+
+import "github.com/madokast/direct/memory"
+
+// refOf returns the ref of ptr in the arena of id
+func refOf(_ arenaID, ptr memory.Pointer) ref {
+	return ref(ptr)
+}
+
+// deref returns the pointer of r
+func deref(r ref) memory.Pointer {
+	return memory.Pointer(r)
+}
+
+// setArenaBase is called when the memory of an arena is set or freed
+func setArenaBase(arenaID, memory.Memory) {}
@@ -0,0 +1,31 @@
+//go:build relocatable
+
+package direct
+
+import "github.com/madokast/direct/memory"
+
+const refArenaShift = 48 // a ref is arena id << refArenaShift | offset
+
+// arenaBases are the addresses of arena memories in this process. Indexed by arena id
+var arenaBases [maxArenaNumber]memory.Pointer
+
+// refOf returns the ref of ptr in the arena of id
+func refOf(id arenaID, ptr memory.Pointer) ref {
+	if ptr.IsNull() {
+		return nullRef
+	}
+	return ref(id)<<refArenaShift | ref(ptr-arenaBases[id])
+}
+
+// deref returns the pointer of r
+func deref(r ref) memory.Pointer {
+	if r.IsNull() {
+		return memory.NullPointer
+	}
+	return arenaBases[r>>refArenaShift] + memory.Pointer(r&(1<<refArenaShift-1))
+}
+
+// setArenaBase is called when the memory of an arena is set or freed
+func setArenaBase(id arenaID, m memory.Memory) {
+	arenaBases[id] = memory.Pointer(m)
+}
@@ -90,8 +90,9 @@ func (s *Shared[T]) Free() {
 			panic("double free shared obj!")
 		}
 	}
+	checkDoubleFree(s.holder.pointer())
 	objCnt := s.holder.RefAt(s.index)
-	if utils.Asserted {
+	if utils.Asserted || freeChecked() {
 		if atomic.LoadInt64(&objCnt.refCnt) == 0 {
 			panic("double free shared obj!")
 		}
@@ -108,7 +109,7 @@ func (s *Shared[T]) Free() {
 	if cnt == 0 {
 		objCnt.obj.Free()
 		header := s.holder.header()
-		holderRefCnt := atomic.AddInt32(memory.PointerAs[int32](header.elementBasePointer), -1)
+		holderRefCnt := atomic.AddInt32(memory.PointerAs[int32](header.elementBasePointer()), -1)
 		if utils.Debug {
 			fmt.Println("do free shared obj, holder cnt", holderRefCnt)
 		}
@@ -124,6 +125,7 @@ func (s *Shared[T]) Free() {
 // SharedFactory creates sharedObj. Thread unsafe
 type SharedFactory[T object] struct {
 	holder Slice[objRefCnt[T]] // index 0 for holder-element-count
+	arena  *Arena              // nil for Global
 	noCopy utils.NoCopy
 }
 
@@ -133,25 +135,37 @@ func CreateSharedFactory[T object]() SharedFactory[T] {
 	}
 }
 
+// CreateSharedFactoryIn makes shared objects in the arena
+func CreateSharedFactoryIn[T object](arena *Arena) SharedFactory[T] {
+	return SharedFactory[T]{
+		holder: nullSlice,
+		arena:  arena,
+	}
+}
+
 func (sf *SharedFactory[T]) MakeShared(obj T) (s Shared[T], err error) {
 	var sfHolder = sf.holder                                  // register
 	var sfHolderHeader *sliceHeader = nil                     // register
 	var sfHolderHeaderElementBasePointer = memory.NullPointer // register
 	if sfHolder == nullSlice {
 		// index 0 for count
-		sfHolder, err = makeSlice0[objRefCnt[T]](2, trace_type.Shared, 3)
+		arena := sf.arena
+		if arena == nil {
+			arena = Global
+		}
+		sfHolder, err = makeSlice0[objRefCnt[T]](arena, 2, trace_type.Shared, 3)
 		if err != nil {
 			return s, err
 		}
 		sf.holder = sfHolder
 		sfHolderHeader = sfHolder.header()
 		sfHolderHeader.length = 1 // index 0 for holder-element-count
-		sfHolderHeaderElementBasePointer = sfHolderHeader.elementBasePointer
+		sfHolderHeaderElementBasePointer = sfHolderHeader.elementBasePointer()
 		// init ref count. One means the factory holding it
 		*memory.PointerAs[int32](sfHolderHeaderElementBasePointer) = 1
 	} else {
 		sfHolderHeader = sfHolder.header()
-		sfHolderHeaderElementBasePointer = sfHolderHeader.elementBasePointer
+		sfHolderHeaderElementBasePointer = sfHolderHeader.elementBasePointer()
 	}
 
 	if utils.Asserted {
@@ -209,7 +223,7 @@ func (sf *SharedFactory[T]) MakeShared(obj T) (s Shared[T], err error) {
 func (sf *SharedFactory[T]) Destroy() {
 	holder := sf.holder      // register
 	if holder != nullSlice { // maybe null
-		holderRefCnt := atomic.AddInt32(memory.PointerAs[int32](holder.header().elementBasePointer), -1)
+		holderRefCnt := atomic.AddInt32(memory.PointerAs[int32](holder.header().elementBasePointer()), -1)
 		if utils.Asserted {
 			if holderRefCnt < 0 {
 				panic(fmt.Sprintf("holderRefCnt(%d) <= 0", holderRefCnt))
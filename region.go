@@ -0,0 +1,233 @@
+package direct
+
+import (
+	"context"
+	"fmt"
+	"github.com/madokast/direct/memory"
+	"github.com/madokast/direct/memory/trace_type"
+	"github.com/madokast/direct/utils"
+	"sort"
+	"sync"
+)
+
+/**
+A region frees everything allocated through it at once. Like a budget, it is an arena sharing the memory and
+local memories of its parent, so collections of any type made in it, and what they grow into, are recorded.
+Allocations and frees of a region are passed to its parent, and a region only records objects alive.
+Close frees the recorded objects without walking collections, so collections of a region need not be freed one by one,
+but must not be used or freed after Close. An object needing more than freeing, like a custom map holding its functions,
+registers a finalizer run by Close. A region may be closed when a context is done.
+With tracing on, Close keeps the objects bulk-freed, reported by BulkFreed.
+*/
+
+// Region records allocations of its arena and frees them all in Close
+type Region struct {
+	name      string
+	arena     *Arena
+	mu        sync.Mutex
+	objects   map[memory.Pointer]regionObject
+	size      SizeType
+	closed    bool
+	done      chan struct{} // closed when Close is done
+	bulkFreed []memory.HeapObject
+}
+
+type regionObject struct {
+	page      memory.PageHandler // memory.SmallObjectPageHandler for a small object
+	size      SizeType
+	finalizer func() // run by Close before freeing. Nil for most objects
+}
+
+// RegionClosedError is returned when allocating in a closed region
+type RegionClosedError struct {
+	region string
+}
+
+func (e *RegionClosedError) Error() string {
+	return fmt.Sprintf("region %s is closed", e.region)
+}
+
+// NewRegion makes a region in the arena. Make collections in its Arena, and Close it after use.
+// A region cannot be nested in a region, but may be made in a budget
+func (a *Arena) NewRegion(name string) (*Region, error) {
+	if a.memory.IsNull() {
+		panic("make a region of an un-init arena")
+	}
+	if a.region != nil {
+		return nil, fmt.Errorf("region %s cannot be nested in region %s", name, a.region.name)
+	}
+	b, err := registerArena(func(id arenaID) bool { return id != globalArenaID })
+	if err != nil {
+		return nil, err
+	}
+	r := &Region{name: name, arena: b, objects: map[memory.Pointer]regionObject{}, done: make(chan struct{})}
+	b.memory = a.memory
+	b.parent = a
+	b.region = r
+	b.tracer = a.tracer
+	b.profiler = a.profiler
+	b.quarantine = a.quarantine
+	b.pressure = a.pressure
+	b.waiters = a.waiters
+	setArenaBase(b.id, b.memory)
+	return r, nil
+}
+
+// NewRegionCtx is NewRegion closed when ctx is done, or by Close before it.
+// Goroutines allocating in the region should be done with it when ctx is done
+func (a *Arena) NewRegionCtx(ctx context.Context, name string) (*Region, error) {
+	r, err := a.NewRegion(name)
+	if err != nil {
+		return nil, err
+	}
+	go func() {
+		select {
+		case <-ctx.Done():
+			r.Close()
+		case <-r.done:
+		}
+	}()
+	return r, nil
+}
+
+// Arena of the region. Collections made in it are recorded
+func (r *Region) Arena() *Arena {
+	return r.arena
+}
+
+func (r *Region) Name() string {
+	return r.name
+}
+
+// Size is the size of objects alive in the region
+func (r *Region) Size() SizeType {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.size
+}
+
+// Closed reports Close is done, and objects of the region are freed
+func (r *Region) Closed() bool {
+	select {
+	case <-r.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// Close frees all objects alive in the region, and unregisters its arena. No-op if closed.
+// With tracing on, it keeps the objects bulk-freed for BulkFreed
+func (r *Region) Close() {
+	r.mu.Lock()
+	if r.closed {
+		r.mu.Unlock()
+		return
+	}
+	r.closed = true
+	objects := r.objects
+	r.objects = nil
+	r.size = 0
+	r.mu.Unlock()
+
+	a := r.arena
+	if tracer := a.tracer; tracer != nil {
+		var bulkFreed []memory.HeapObject
+		for ptr := range objects {
+			if object, ok := tracer.HeapObjectOf(ptr); ok {
+				bulkFreed = append(bulkFreed, object)
+			}
+		}
+		sort.Slice(bulkFreed, func(i, j int) bool { return bulkFreed[i].Address < bulkFreed[j].Address })
+		if utils.Debug {
+			fmt.Printf("region %s bulk-frees %d objects\n", r.name, len(objects))
+			for _, object := range bulkFreed {
+				fmt.Printf("Addr:%s index:%d type:%s size:%s allocated at %s:%d\n", object.Address.String(), object.PageIndex,
+					object.Type, memory.HumanFriendlyMemorySize(object.Size), object.File, object.Line)
+			}
+		}
+		r.mu.Lock()
+		r.bulkFreed = bulkFreed
+		r.mu.Unlock()
+	}
+	for _, object := range objects {
+		if object.finalizer != nil {
+			object.finalizer()
+		}
+	}
+	for ptr, object := range objects {
+		if object.page == memory.SmallObjectPageHandler {
+			a.parent.freeSmall(ptr)
+		} else {
+			a.parent.freePage(object.page)
+		}
+	}
+	setArenaBase(a.id, memory.NullMemory)
+	unregisterArena(a)
+	close(r.done)
+}
+
+// BulkFreed returns the traced objects freed by Close, sorted by address. Nil if not traced or not closed
+func (r *Region) BulkFreed() []memory.HeapObject {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.bulkFreed
+}
+
+// record adds an object allocated. False if the region is closed
+func (r *Region) record(ptr memory.Pointer, object regionObject) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.closed {
+		return false
+	}
+	r.objects[ptr] = object
+	r.size += object.size
+	return true
+}
+
+// setFinalizer sets the finalizer of an object recorded, run if the object is not freed before Close
+func (r *Region) setFinalizer(ptr memory.Pointer, finalizer func()) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if object, ok := r.objects[ptr]; ok {
+		object.finalizer = finalizer
+		r.objects[ptr] = object
+	}
+}
+
+// forget removes an object freed
+func (r *Region) forget(ptr memory.Pointer) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if object, ok := r.objects[ptr]; ok {
+		delete(r.objects, ptr)
+		r.size -= object.size
+	}
+}
+
+// regionAllocPage allocates by the parent and records the page
+func (a *Arena) regionAllocPage(pageNumber SizeType, _type trace_type.Type, callerSkip int) (page memory.PageHandler, err error) {
+	page, err = a.parent.allocPage(pageNumber, _type, callerSkip+1)
+	if err != nil {
+		return page, err
+	}
+	if !a.region.record(a.memory.PagePointerOf(page), regionObject{page: page, size: page.Size()}) {
+		a.parent.freePage(page)
+		return 0, &RegionClosedError{region: a.region.name}
+	}
+	return page, nil
+}
+
+// regionAllocSmall allocates by the parent and records the object
+func (a *Arena) regionAllocSmall(size SizeType, _type trace_type.Type, callerSkip int) (ptr memory.Pointer, realSize SizeType, err error) {
+	ptr, realSize, err = a.parent.allocSmall(size, _type, callerSkip+1)
+	if err != nil {
+		return ptr, realSize, err
+	}
+	if !a.region.record(ptr, regionObject{page: memory.SmallObjectPageHandler, size: realSize}) {
+		a.parent.freeSmall(ptr)
+		return memory.NullPointer, 0, &RegionClosedError{region: a.region.name}
+	}
+	return ptr, realSize, nil
+}
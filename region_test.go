@@ -0,0 +1,121 @@
+package direct
+
+import (
+	"context"
+	"errors"
+	"github.com/madokast/direct/memory"
+	"github.com/madokast/direct/memory/trace_type"
+	"github.com/madokast/direct/utils"
+	"testing"
+	"time"
+)
+
+func TestArena_NewRegion(t *testing.T) {
+	arena := NewArena(16*memory.MB, WithTrace(true))
+	defer arena.Free()
+	r := utils.PanicErr1(arena.NewRegion("request"))
+	_, err := r.Arena().NewRegion("nested")
+	utils.Assert(err != nil)
+	_, err = r.Arena().NewBudget("budget", memory.MB)
+	utils.Assert(err != nil)
+
+	s := utils.PanicErr1(MakeSliceIn[int](r.Arena(), 10))
+	for i := 0; i < 10000; i++ {
+		utils.PanicErr(s.Append(i)) // grows in the region
+	}
+	m := utils.PanicErr1(MakeMapIn[int, int](r.Arena(), 1))
+	for i := 0; i < 1000; i++ {
+		utils.PanicErr(m.Put(i, i))
+	}
+	st := utils.PanicErr1(MakeStackIn[int](r.Arena()))
+	for i := 0; i < 1000; i++ {
+		utils.PanicErr(st.Push(i))
+	}
+	sf := NewStringFactoryIn(r.Arena())
+	str := utils.PanicErr1(sf.CreateFromGoString("hello"))
+	utils.Assert(str.AsGoString() == "hello")
+	freed := utils.PanicErr1(MakeSliceIn[int](r.Arena(), 10))
+	size := r.Size()
+	freed.Free() // forgotten
+	utils.Assert(r.Size() < size, r.Size(), size)
+
+	r.Close()
+	r.Close()
+	utils.Assert(r.Closed() && r.Size() == 0)
+	utils.Assert(arenas[r.Arena().id].Load() == nil)
+	types := map[trace_type.Type]bool{}
+	for _, object := range r.BulkFreed() {
+		if !trace_type.SkipTrace(object.Type) { // nodes and tables are traced if asserted
+			types[object.Type] = true
+		}
+	}
+	utils.Assert(types[trace_type.Slice] && types[trace_type.MapHeader] && types[trace_type.StackHeader], types)
+	utils.Assert(len(types) == 4, types) // and the string holder
+	utils.Assert(!arena.IsMemoryLeak(), arena.MemoryLeakInfo())
+
+	_, err = MakeSliceIn[int](r.Arena(), 10)
+	var regionClosedError *RegionClosedError
+	utils.Assert(errors.As(err, &regionClosedError), err)
+	utils.Assert(!arena.IsMemoryLeak(), arena.MemoryLeakInfo())
+}
+
+func TestArena_NewRegion_customMap(t *testing.T) {
+	arena := NewArena(16*memory.MB, WithTrace(true))
+	defer arena.Free()
+	registered := func() int {
+		userDefinedHashEqualFuncSetMu.Lock()
+		defer userDefinedHashEqualFuncSetMu.Unlock()
+		return len(userDefinedHashEqualFuncSet)
+	}
+	before := registered()
+	r := utils.PanicErr1(arena.NewRegion("custom"))
+	hash := func(k int) SizeType { return SizeType(k) }
+	equal := func(k1, k2 int) bool { return k1 == k2 }
+	m := utils.PanicErr1(MakeCustomMapIn[int, int](r.Arena(), 1, hash, equal))
+	for i := 0; i < 1000; i++ {
+		utils.PanicErr(m.Put(i, i))
+	}
+	freed := utils.PanicErr1(MakeCustomMapIn[int, int](r.Arena(), 1, func(k int) SizeType { return SizeType(k) + 1 }, equal))
+	utils.Assert(registered() == before+3, registered(), before)
+	freed.Free() // not finalized again by Close
+	utils.Assert(registered() == before+2, registered(), before)
+
+	r.Close()
+	utils.Assert(registered() == before, registered(), before)
+	utils.Assert(!arena.IsMemoryLeak(), arena.MemoryLeakInfo())
+}
+
+func TestArena_NewRegion_budget(t *testing.T) {
+	arena := NewArena(16 * memory.MB)
+	defer arena.Free()
+	cache := utils.PanicErr1(arena.NewBudget("cache", 1*memory.MB))
+	defer cache.Free()
+	r := utils.PanicErr1(cache.NewRegion("request"))
+
+	s := utils.PanicErr1(MakeSliceIn[int](r.Arena(), 10))
+	for err := error(nil); err == nil; {
+		err = s.Append(1)
+	}
+	utils.Assert(cache.BudgetUsed() > 512*memory.KB, cache.BudgetUsed())
+	r.Close()
+	utils.Assert(cache.BudgetUsed() == 0, cache.BudgetUsed())
+}
+
+func TestArena_NewRegionCtx(t *testing.T) {
+	arena := NewArena(16*memory.MB, WithTrace(true))
+	defer arena.Free()
+	ctx, cancel := context.WithCancel(context.Background())
+	r := utils.PanicErr1(arena.NewRegionCtx(ctx, "request"))
+	for i := 0; i < 100; i++ {
+		_ = utils.PanicErr1(MakeSliceIn[int](r.Arena(), SizeType(i)))
+	}
+	utils.Assert(r.Size() > 0)
+
+	cancel()
+	for !r.Closed() {
+		_ = r.BulkFreed() // read while Close runs on its own goroutine
+		time.Sleep(time.Millisecond)
+	}
+	utils.Assert(len(r.BulkFreed()) > 0)
+	utils.Assert(!arena.IsMemoryLeak(), arena.MemoryLeakInfo())
+}
@@ -18,8 +18,8 @@ func (s Slice[T]) Iterator() (iter SliceIterator[T]) {
 		// do nothing
 	} else {
 		header := memory.PointerAs[sliceHeader](sp)
-		iter.cur = header.elementBasePointer - memory.Pointer(memory.Sizeof[T]()) // -1
-		iter.end = header.elementBasePointer + memory.Pointer(header.length*memory.Sizeof[T]())
+		iter.cur = header.elementBasePointer() - memory.Pointer(memory.Sizeof[T]()) // -1
+		iter.end = header.elementBasePointer() + memory.Pointer(header.length*memory.Sizeof[T]())
 		iter.index = SizeTypeMax // -1
 	}
 	return
@@ -68,7 +68,7 @@ func (it *SliceIterator[T]) Index() SizeType {
 func (s Slice[T]) Iterate(iter func(T)) {
 	if s.pointer().IsNotNull() {
 		header := s.header()
-		ptr := header.elementBasePointer
+		ptr := header.elementBasePointer()
 		length := header.length
 		for i := SizeType(0); i < length; i++ {
 			iter(*memory.PointerAs[T](ptr))
@@ -80,7 +80,7 @@ func (s Slice[T]) Iterate(iter func(T)) {
 func (s Slice[T]) IterateRef(iter func(*T)) {
 	if s.pointer().IsNotNull() {
 		header := s.header()
-		ptr := header.elementBasePointer
+		ptr := header.elementBasePointer()
 		length := header.length
 		for i := SizeType(0); i < length; i++ {
 			iter(memory.PointerAs[T](ptr))
@@ -92,7 +92,7 @@ func (s Slice[T]) IterateRef(iter func(*T)) {
 func (s Slice[T]) IterateBreakable(iter func(T) (_continue_ bool)) {
 	if s.pointer().IsNotNull() {
 		header := s.header()
-		ptr := header.elementBasePointer
+		ptr := header.elementBasePointer()
 		length := header.length
 		for i := SizeType(0); i < length; i++ {
 			if !iter(*memory.PointerAs[T](ptr)) {
@@ -106,7 +106,7 @@ func (s Slice[T]) IterateBreakable(iter func(T) (_continue_ bool)) {
 func (s Slice[T]) IterateIndex(iter func(index SizeType, element T)) {
 	if s.pointer().IsNotNull() {
 		header := s.header()
-		ptr := header.elementBasePointer
+		ptr := header.elementBasePointer()
 		length := header.length
 		for i := SizeType(0); i < length; i++ {
 			iter(i, *memory.PointerAs[T](ptr))
@@ -118,7 +118,7 @@ func (s Slice[T]) IterateIndex(iter func(index SizeType, element T)) {
 func (s Slice[T]) IterateRefIndex(iter func(index SizeType, ref *T)) {
 	if s.pointer().IsNotNull() {
 		header := s.header()
-		ptr := header.elementBasePointer
+		ptr := header.elementBasePointer()
 		length := header.length
 		for i := SizeType(0); i < length; i++ {
 			iter(i, memory.PointerAs[T](ptr))
@@ -130,7 +130,7 @@ func (s Slice[T]) IterateRefIndex(iter func(index SizeType, ref *T)) {
 func (s Slice[T]) IterateIndexBreakable(iter func(index SizeType, element T) (_continue_ bool)) {
 	if s.pointer().IsNotNull() {
 		header := s.header()
-		ptr := header.elementBasePointer
+		ptr := header.elementBasePointer()
 		length := header.length
 		for i := SizeType(0); i < length; i++ {
 			if !iter(i, *memory.PointerAs[T](ptr)) {
@@ -144,7 +144,7 @@ func (s Slice[T]) IterateIndexBreakable(iter func(index SizeType, element T) (_c
 func (s Slice[T]) IterateRefIndexBreakable(iter func(index SizeType, element *T) (_continue_ bool)) {
 	if s.pointer().IsNotNull() {
 		header := s.header()
-		ptr := header.elementBasePointer
+		ptr := header.elementBasePointer()
 		length := header.length
 		for i := SizeType(0); i < length; i++ {
 			if !iter(i, memory.PointerAs[T](ptr)) {
@@ -15,36 +15,47 @@ type Slice[T any] memory.Pointer
 
 // MakeSlice == make([]T, 0, elementCapacity)
 func MakeSlice[T any](elementCapacity SizeType) (Slice[T], error) {
-	return makeSlice0[T](elementCapacity, trace_type.Slice, 3)
+	return makeSlice0[T](Global, elementCapacity, trace_type.Slice, 3)
+}
+
+// MakeSliceIn is MakeSlice in the arena
+func MakeSliceIn[T any](arena *Arena, elementCapacity SizeType) (Slice[T], error) {
+	return makeSlice0[T](arena, elementCapacity, trace_type.Slice, 3)
 }
 
 // makeSlice0 is the root make func doing alloc
-func makeSlice0[T any](elementCapacity SizeType, _type trace_type.Type, traceSkip int) (Slice[T], error) {
+func makeSlice0[T any](arena *Arena, elementCapacity SizeType, _type trace_type.Type, traceSkip int) (Slice[T], error) {
 	sliceByteSize := memory.Sizeof[sliceHeader]() + elementCapacity*memory.Sizeof[T]()
-	pageNumber := (sliceByteSize + memory.BasePageSize - 1) >> memory.BasePageSizeShiftNumber
-
-	pageHandler, err := Global.allocPage(pageNumber, _type, traceSkip)
+	ptr, size, pageHandler, err := arena.allocObject(sliceByteSize, _type, traceSkip)
 	if err != nil {
 		return nullSlice, err
 	}
-	pagePointer := Global.pagePointerOf(pageHandler)
+	return initSlice[T](arena, ptr, size, pageHandler), nil
+}
 
-	header := memory.PointerAs[sliceHeader](pagePointer)
+// initSlice makes an empty slice in the memory of byteSize at ptr
+func initSlice[T any](arena *Arena, ptr memory.Pointer, byteSize SizeType, pageHandler memory.PageHandler) Slice[T] {
+	header := memory.PointerAs[sliceHeader](ptr)
 	header.length = 0
-	header.capacity = (pageHandler.Size() - memory.Sizeof[sliceHeader]()) / memory.Sizeof[T]()
+	header.capacity = (byteSize - memory.Sizeof[sliceHeader]()) / memory.Sizeof[T]()
 	header.pageHandler = pageHandler
-	header.elementBasePointer = pagePointer + memory.Pointer(memory.Sizeof[sliceHeader]())
-
-	return Slice[T](pagePointer), nil
+	header.arena = arena.id
+	header.elementBase = refOf(arena.id, ptr+memory.Pointer(memory.Sizeof[sliceHeader]()))
+	return Slice[T](refOf(arena.id, ptr))
 }
 
 // MakeSliceWithLength == make([]T, elementLength)
 func MakeSliceWithLength[T any](elementLength SizeType) (Slice[T], error) {
-	return makeSliceWithLength0[T](elementLength, trace_type.Slice, 4)
+	return makeSliceWithLength0[T](Global, elementLength, trace_type.Slice, 4)
 }
 
-func makeSliceWithLength0[T any](elementLength SizeType, _type trace_type.Type, traceSkip int) (Slice[T], error) {
-	s, err := makeSlice0[T](elementLength, _type, traceSkip)
+// MakeSliceWithLengthIn is MakeSliceWithLength in the arena
+func MakeSliceWithLengthIn[T any](arena *Arena, elementLength SizeType) (Slice[T], error) {
+	return makeSliceWithLength0[T](arena, elementLength, trace_type.Slice, 4)
+}
+
+func makeSliceWithLength0[T any](arena *Arena, elementLength SizeType, _type trace_type.Type, traceSkip int) (Slice[T], error) {
+	s, err := makeSlice0[T](arena, elementLength, _type, traceSkip)
 	if err != nil {
 		return nullSlice, err
 	}
@@ -56,16 +67,25 @@ func makeSliceWithLength0[T any](elementLength SizeType, _type trace_type.Type,
 		}
 	}
 	header.length = elementLength
-	memory.LibZero(header.elementBasePointer, elementLength*memory.Sizeof[T]())
+	arena.memory.ZeroBytes(header.elementBasePointer(), elementLength*memory.Sizeof[T]())
 	return s, nil
 }
 
 func MakeSliceFromGoSlice[T any](gs []T) (Slice[T], error) {
+	return makeSliceFromGoSlice0(Global, gs)
+}
+
+// MakeSliceFromGoSliceIn is MakeSliceFromGoSlice in the arena
+func MakeSliceFromGoSliceIn[T any](arena *Arena, gs []T) (Slice[T], error) {
+	return makeSliceFromGoSlice0(arena, gs)
+}
+
+func makeSliceFromGoSlice0[T any](arena *Arena, gs []T) (Slice[T], error) {
 	elementLength := SizeType(len(gs))
 	if elementLength == 0 {
 		return nullSlice, nil
 	}
-	s, err := makeSlice0[T](elementLength, trace_type.Slice, 3)
+	s, err := makeSlice0[T](arena, elementLength, trace_type.Slice, 4)
 	if err != nil {
 		return nullSlice, err
 	}
@@ -79,7 +99,7 @@ func MakeSliceFromGoSlice[T any](gs []T) (Slice[T], error) {
 		}
 	}
 	header.length = elementLength
-	memory.LibMemMove(header.elementBasePointer, memory.LibGoSliceHeaderPointer(gs), elementLength*memory.Sizeof[T]())
+	arena.memory.MoveBytes(header.elementBasePointer(), memory.LibGoSliceHeaderPointer(gs), elementLength*memory.Sizeof[T]())
 	return s, nil
 }
 
@@ -92,7 +112,7 @@ func (s *Slice[T]) Append(val T) (err error) {
 	last := header.length
 	header.length++
 	//*s.RefAt(last) = val
-	ptr := header.elementBasePointer + memory.Pointer(last*memory.Sizeof[T]())
+	ptr := header.elementBasePointer() + memory.Pointer(last*memory.Sizeof[T]())
 	*memory.PointerAs[T](ptr) = val
 	return nil
 }
@@ -119,7 +139,7 @@ func (s *Slice[T]) AppendBatch(values Slice[T]) (err error) {
 			panic(fmt.Sprintf("AppendBatch header.length(%d) > header.capacity(%d)", header.length, header.capacity))
 		}
 	}
-	memory.LibMemMove(header.elementBasePointer+memory.Pointer(start*memory.Sizeof[T]()), values.header().elementBasePointer, appendNumber*memory.Sizeof[T]())
+	s.arena().memory.MoveBytes(header.elementBasePointer()+memory.Pointer(start*memory.Sizeof[T]()), values.header().elementBasePointer(), appendNumber*memory.Sizeof[T]())
 	return nil
 }
 
@@ -140,7 +160,7 @@ func (s *Slice[T]) AppendGoSlice(values []T) (err error) {
 			panic(fmt.Sprintf("AppendBatch header.length(%d) > header.capacity(%d)", header.length, header.capacity))
 		}
 	}
-	memory.LibMemMove(header.elementBasePointer+memory.Pointer(start*memory.Sizeof[T]()),
+	s.arena().memory.MoveBytes(header.elementBasePointer()+memory.Pointer(start*memory.Sizeof[T]()),
 		memory.Pointer(((*reflect.SliceHeader)(unsafe.Pointer(&values))).Data),
 		appendNumber*memory.Sizeof[T]())
 	return nil
@@ -174,7 +194,7 @@ func (s Slice[T]) RefAt(index SizeType) *T {
 			panic(fmt.Sprintf("slice out of bound %d %d", index, s.header().length))
 		}
 	}
-	ptr := s.header().elementBasePointer + memory.Pointer(index*memory.Sizeof[T]())
+	ptr := s.header().elementBasePointer() + memory.Pointer(index*memory.Sizeof[T]())
 	return memory.PointerAs[T](ptr)
 }
 
@@ -186,7 +206,7 @@ func (s *Slice[T]) checkCapacity(appendNumber SizeType) (err error) {
 	}
 	// handle null
 	if s.pointer().IsNull() {
-		*s, err = makeSlice0[T](appendNumber|8, trace_type.Slice, 4)
+		*s, err = makeSlice0[T](Global, appendNumber|8, trace_type.Slice, 4)
 		return err
 	}
 
@@ -204,13 +224,13 @@ func (s *Slice[T]) checkCapacity(appendNumber SizeType) (err error) {
 		if targetCapacity < minTarget {
 			targetCapacity = minTarget
 		}
-		s2, err = makeSlice0[T](targetCapacity, trace_type.Slice, 4)
+		s2, err = makeSlice0[T](arenaOf(header.arena), targetCapacity, trace_type.Slice, 4)
 		if err != nil {
 			return err
 		}
 		s2Header := s2.header()
 		s2Header.length = header.length
-		memory.LibMemMove(s2Header.elementBasePointer, header.elementBasePointer, originLength*memory.Sizeof[T]())
+		s2.arena().memory.MoveBytes(s2Header.elementBasePointer(), header.elementBasePointer(), originLength*memory.Sizeof[T]())
 		s.Free()
 		*s = s2
 	}
@@ -238,13 +258,13 @@ func (s Slice[T]) Copy() (Slice[T], error) {
 	if srcLength == 0 {
 		return nullSlice, nil
 	}
-	cp, err := makeSlice0[T](srcLength, trace_type.Slice, 3)
+	cp, err := makeSlice0[T](arenaOf(srcHeader.arena), srcLength, trace_type.Slice, 3)
 	if err != nil {
 		return nullSlice, err
 	}
 	cpHeader := cp.header()
 	cpHeader.length = srcLength
-	memory.LibMemMove(cpHeader.elementBasePointer, srcHeader.elementBasePointer, srcLength*memory.Sizeof[T]())
+	cp.arena().memory.MoveBytes(cpHeader.elementBasePointer(), srcHeader.elementBasePointer(), srcLength*memory.Sizeof[T]())
 	return cp, nil
 }
 
@@ -260,17 +280,34 @@ func (s Slice[T]) Moved() bool {
 
 func (s Slice[T]) Free() {
 	if s.pointer().IsNotNull() {
+		checkDoubleFree(s.pointer())
 		if utils.Asserted {
 			if s.header().pageHandler.IsNull() {
 				panic("double free?")
 			}
 		}
-		Global.freePage(s.header().pageHandler)
+		header := s.header()
+		arenaOf(header.arena).freeObject(s.pointer(), header.pageHandler)
 	}
 }
 
+// Verify checks the length is not larger than the capacity, and the elements fit in the allocated memory. Nil for the null slice
+func (s Slice[T]) Verify() error {
+	if s.pointer().IsNull() {
+		return nil
+	}
+	header := s.header()
+	if header.length > header.capacity {
+		return memory.NewCorruptedError("slice %s has length %d > capacity %d", s.pointer().String(), header.length, header.capacity)
+	}
+	if base := s.pointer() + memory.Pointer(memory.Sizeof[sliceHeader]()); header.elementBasePointer() != base {
+		return memory.NewCorruptedError("elements of slice %s are at %s instead of %s", s.pointer().String(), header.elementBasePointer().String(), base.String())
+	}
+	return verifyObject(header.arena, s.pointer(), header.pageHandler, memory.Sizeof[sliceHeader]()+header.capacity*memory.Sizeof[T]())
+}
+
 func (s Slice[T]) pointer() memory.Pointer {
-	return memory.Pointer(s)
+	return deref(ref(s))
 }
 
 func (s Slice[T]) header() *sliceHeader {
@@ -291,14 +328,19 @@ func SliceCopy[T any](src, dst Slice[T], elementNumber SizeType) {
 			panic(fmt.Sprintf("SliceCopy dst.Length(%d) < elementNumber(%d)", dst.Length(), elementNumber))
 		}
 	}
-	memory.LibMemMove(dst.header().elementBasePointer, src.header().elementBasePointer, elementNumber*memory.Sizeof[T]())
+	dst.arena().memory.MoveBytes(dst.header().elementBasePointer(), src.header().elementBasePointer(), elementNumber*memory.Sizeof[T]())
 }
 
 const nullSlice = 0
 
 type sliceHeader struct {
-	length             SizeType
-	capacity           SizeType
-	pageHandler        memory.PageHandler // for free
-	elementBasePointer memory.Pointer     // pointer to first element
+	length      SizeType
+	capacity    SizeType
+	pageHandler memory.PageHandler // for freeObject
+	arena       arenaID            // the arena allocating it
+	elementBase ref                // ref of the first element
+}
+
+func (h *sliceHeader) elementBasePointer() memory.Pointer {
+	return deref(h.elementBase)
 }
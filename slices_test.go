@@ -218,7 +218,7 @@ func BenchmarkMySlice_make_parallel(b *testing.B) {
 
 func Test_BenchmarkMySlice_make_parallel(t *testing.T) {
 	Global.Init(256 * 1024 * 1024)
-	memories := locals
+	memories := Global.locals
 	wg := sync.WaitGroup{}
 	for k := 0; k < 32; k++ {
 		wg.Add(1)
@@ -790,3 +790,23 @@ func TestGcFail(t *testing.T) {
 	s.Free()
 	Global.Free()
 }
+
+func TestSlice_SmallObject(t *testing.T) {
+	Global.Init(1 * memory.MB)
+	defer Global.Free()
+
+	var ss []Slice[int]
+	for i := 0; i < 100; i++ {
+		s := utils.PanicErr1(MakeSliceFromGoSlice([]int{i, i + 1, i + 2}))
+		utils.Assert(s.header().pageHandler == memory.SmallObjectPageHandler)
+		ss = append(ss, s)
+	}
+	// 100 small slices take less than 100 pages
+	utils.Assert(Global.AllocatedPageNumber() < 100, Global.AllocatedPageNumber())
+	for i, s := range ss {
+		utils.Assert(s.Get(2) == i+2, s)
+		utils.PanicErr(s.Append(i + 3)) // grow
+		utils.Assert(s.Get(3) == i+3, s)
+		s.Free()
+	}
+}
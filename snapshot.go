@@ -0,0 +1,57 @@
+package direct
+
+import (
+	"fmt"
+	"github.com/madokast/direct/memory"
+	"io"
+)
+
+/**
+A snapshot streams an arena with its free lists and roots. Restore it to warm-start or to inspect collections elsewhere.
+Collections store absolute pointers, so the snapshot is restored at the original address and fails if it is used.
+Build with the relocatable tag to restore anywhere.
+The arena id is kept in the snapshot because collections remember it.
+*/
+
+// SnapshotTo writes the arena to w. Memory cached in local memories is returned first,
+// so no goroutine should use the arena meanwhile
+func (a *Arena) SnapshotTo(w io.Writer) error {
+	if a.memory.IsNull() {
+		panic("snapshot an un-init arena")
+	}
+	if a.budget != nil {
+		return fmt.Errorf("budget %s cannot be snapshot. Snapshot its arena", a.budget.name)
+	}
+	if a.region != nil {
+		return fmt.Errorf("region %s cannot be snapshot. Snapshot its arena", a.region.name)
+	}
+	a.flushLocals()
+	return a.memory.SnapshotTo(w, memory.Word(a.id))
+}
+
+// RestoreFrom inits the arena by a snapshot of an arena of the same id, like Global
+func (a *Arena) RestoreFrom(r io.Reader, options ...Option) error {
+	if !a.memory.IsNull() {
+		panic("arena memory has been initialized")
+	}
+	m, tag, err := memory.RestoreFrom(r)
+	if err != nil {
+		return err
+	}
+	if arenaID(tag) != a.id {
+		m.Free()
+		return fmt.Errorf("the snapshot is of arena %d but not %d", tag, a.id)
+	}
+	a.memory = m
+	a.initLocals(newArenaConfig(options))
+	return nil
+}
+
+// RestoreArenaFrom restores a snapshot of an arena from NewArena. The arena is registered at the original id
+func RestoreArenaFrom(r io.Reader, options ...Option) (*Arena, error) {
+	m, tag, err := memory.RestoreFrom(r)
+	if err != nil {
+		return nil, err
+	}
+	return registerArenaOn(m, arenaID(tag), "the snapshot", options)
+}
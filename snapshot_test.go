@@ -0,0 +1,105 @@
+package direct
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/madokast/direct/memory"
+	"github.com/madokast/direct/utils"
+	"runtime"
+	"testing"
+)
+
+func TestArena_SnapshotTo(t *testing.T) {
+	if runtime.GOOS != "linux" && !memory.Relocatable {
+		t.Skip("restoring at the original address is only supported on linux")
+	}
+	var buffer bytes.Buffer
+	{
+		Global.Init(16 * memory.MB)
+		sf := NewStringFactory()
+		users := utils.PanicErr1(MakeMap[String, int](16))
+		for i := 0; i < 1000; i++ {
+			utils.PanicErr(users.Put(utils.PanicErr1(sf.CreateFromGoString(fmt.Sprint("user", i))), i))
+		}
+		sf.Destroy()
+		ids := utils.PanicErr1(MakeSliceFromGoSlice([]int{1, 2, 3}))
+		var stack Stack[int]
+		utils.PanicErr(stack.Push(1))
+		utils.PanicErr(SetRootMap(Global, "users", users))
+		utils.PanicErr(SetRootSlice(Global, "ids", ids))
+		utils.PanicErr(SetRootStack(Global, "stack", stack))
+		utils.PanicErr(Global.SnapshotTo(&buffer))
+
+		users.Iterate(func(key String, _ int) {
+			key.Free()
+		})
+		users.Free()
+		ids.Free()
+		stack.Free()
+		for _, name := range Global.RootNames() {
+			Global.DeleteRoot(name)
+		}
+		Global.Free()
+	}
+
+	_, err := RestoreArenaFrom(bytes.NewReader(buffer.Bytes()))
+	utils.Assert(err != nil) // id of Global is used
+
+	utils.PanicErr(Global.RestoreFrom(&buffer))
+	names := Global.RootNames()
+	utils.Assert(len(names) == 3, names)
+	users, ok, err := RootMap[String, int](Global, "users")
+	utils.PanicErr(err)
+	utils.Assert(ok && users.Length() == 1000, users.Length())
+	sf := NewStringFactory()
+	key := utils.PanicErr1(sf.CreateFromGoString("user999"))
+	utils.Assert(users.Get(key) == 999)
+	key.Free()
+	sf.Destroy()
+	ids, ok, err := RootSlice[int](Global, "ids")
+	utils.PanicErr(err)
+	utils.Assert(ok && ids.String() == "[1 2 3]", ids)
+	stack, ok, err := RootStack[int](Global, "stack")
+	utils.PanicErr(err)
+	utils.Assert(ok && stack.Top() == 1)
+	_, _, err = RootSlice[int](Global, "users")
+	utils.Assert(err != nil) // a map
+
+	users.Iterate(func(key String, _ int) {
+		key.Free()
+	})
+	users.Free()
+	ids.Free()
+	stack.Free()
+	for _, name := range names {
+		Global.DeleteRoot(name)
+	}
+	Global.Free()
+}
+
+func TestRestoreArenaFrom(t *testing.T) {
+	if runtime.GOOS != "linux" && !memory.Relocatable {
+		t.Skip("restoring at the original address is only supported on linux")
+	}
+	var buffer bytes.Buffer
+	arena := NewArena(1 * memory.MB)
+	id := arena.id
+	s := utils.PanicErr1(MakeSliceFromGoSliceIn(arena, []int{1, 2, 3}))
+	utils.PanicErr(arena.SetRoot("s", memory.Pointer(s)))
+	utils.PanicErr(arena.SnapshotTo(&buffer))
+	s.Free()
+	arena.DeleteRoot("s")
+	arena.Free()
+
+	utils.Assert(Global.RestoreFrom(bytes.NewReader(buffer.Bytes())) != nil) // another id
+	arena = utils.PanicErr1(RestoreArenaFrom(&buffer))
+	utils.Assert(arena.id == id)
+	s, ok, err := RootSlice[int](arena, "s")
+	utils.PanicErr(err)
+	utils.Assert(ok)
+	utils.PanicErr(s.Append(4)) // grows in the arena
+	utils.Assert(s.String() == "[1 2 3 4]", s)
+	s.Free()
+	arena.DeleteRoot("s")
+	arena.Free()
+}
@@ -13,6 +13,41 @@ import (
 // stackHeader -> nodeHeader -> nodeHeader ...
 type Stack[T any] memory.Pointer
 
+// MakeStackIn makes an empty stack in the arena. Pushing to the zero value makes it in Global
+func MakeStackIn[T any](arena *Arena) (Stack[T], error) {
+	return makeStack0[T](arena, 3)
+}
+
+// makeStack0 allocates the header node. A stack of small elements starts with a small header node
+func makeStack0[T any](arena *Arena, traceSkip int) (Stack[T], error) {
+	headerNodeSize := stackNodePageSize[T]() << memory.BasePageSizeShiftNumber
+	if stackHeaderSize+memory.Sizeof[T]() <= memory.MaxSmallObjectSize {
+		headerNodeSize = memory.MaxSmallObjectSize
+	}
+	ptr, headerNodeSize, headerPageHandler, err := arena.allocObject(headerNodeSize, trace_type.StackHeader, traceSkip)
+	if err != nil {
+		return nullStack, err
+	}
+	header := memory.PointerAs[stackHeader](ptr)
+	header.length = 0
+	header.capacity = (headerNodeSize - stackHeaderSize) / memory.Sizeof[T]()
+	header.headerCapacity = header.capacity
+	header.headerPageHandler = headerPageHandler
+	header.arena = arena.id
+	header.next = nullRef
+	header.last = nullRef
+	header.nextElement = refOf(arena.id, ptr+memory.Pointer(stackHeaderSize))
+	if utils.Asserted {
+		if header.capacity <= 0 {
+			panic(fmt.Sprintf("header.capacity(%d) <= 0", header.capacity))
+		}
+	}
+	if utils.Debug {
+		fmt.Println("init stack header", ptr.String())
+	}
+	return Stack[T](refOf(arena.id, ptr)), nil
+}
+
 func (s *Stack[T]) Push(val T) (err error) {
 	err = s.checkCapacity()
 	if err != nil {
@@ -25,8 +60,8 @@ func (s *Stack[T]) Push(val T) (err error) {
 		}
 	}
 	header.length++
-	*memory.PointerAs[T](header.nextElementPtr) = val
-	header.nextElementPtr += memory.Pointer(memory.Sizeof[T]()) // do not check bound. check it in checkCapacity
+	*memory.PointerAs[T](deref(header.nextElement)) = val
+	header.nextElement += ref(memory.Sizeof[T]()) // do not check bound. check it in checkCapacity
 	return nil
 }
 
@@ -47,34 +82,14 @@ func (s Stack[T]) TopRef() *T {
 			panic("top of empty stack")
 		}
 	}
-	return memory.PointerAs[T](s.header().nextElementPtr - memory.Pointer(memory.Sizeof[T]()))
+	return memory.PointerAs[T](deref(s.header().nextElement) - memory.Pointer(memory.Sizeof[T]()))
 }
 
 func (s *Stack[T]) checkCapacity() error {
 	if s.pointer().IsNull() {
-		// init
-		pageSize := stackNodePageSize[T]()
-		page, err := Global.allocPage(pageSize, trace_type.StackHeader, 3)
-		if err != nil {
-			return err
-		}
-		ptr := Global.pagePointerOf(page)
-		header := memory.PointerAs[stackHeader](ptr)
-		header.length = 0
-		header.capacity = ((pageSize << memory.BasePageSizeShiftNumber) - stackHeaderSize) / memory.Sizeof[T]()
-		header.next = memory.NullPointer
-		header.last = memory.NullPointer
-		header.nextElementPtr = ptr + memory.Pointer(stackHeaderSize)
-		if utils.Asserted {
-			if header.capacity <= 0 {
-				panic(fmt.Sprintf("header.capacity(%d) <= 0", header.capacity))
-			}
-		}
-		if utils.Debug {
-			fmt.Println("init stack header", ptr.String())
-		}
-		*s = Stack[T](ptr)
-		return nil
+		var err error
+		*s, err = makeStack0[T](Global, 4)
+		return err
 	}
 
 	header := s.header()
@@ -86,13 +101,15 @@ func (s *Stack[T]) checkCapacity() error {
 	if header.length == header.capacity {
 		// next node
 		pageSize := stackNodePageSize[T]()
-		page, err := Global.allocPage(pageSize, trace_type.StackNode, 3)
+		arena := arenaOf(header.arena)
+		page, err := arena.allocPage(pageSize, trace_type.StackNode, 3)
 		if err != nil {
 			return err
 		}
-		ptr := Global.pagePointerOf(page)
+		ptr := arena.pagePointerOf(page)
 		nodeHeader := memory.PointerAs[stackNodeHeader](ptr)
-		nodeHeader.next = memory.NullPointer
+		nodeHeader.next = nullRef
+		node := refOf(header.arena, ptr)
 
 		header.capacity += ((pageSize << memory.BasePageSizeShiftNumber) - stackNodeHeaderSize) / memory.Sizeof[T]()
 		if utils.Asserted {
@@ -100,24 +117,24 @@ func (s *Stack[T]) checkCapacity() error {
 				panic(fmt.Sprintf("after append new node. header.length(%d) >= header.capacity(%d)", header.length, header.capacity))
 			}
 		}
-		if header.next == memory.NullPointer {
+		if header.next == nullRef {
 			// stack header only
-			header.next = ptr
-			header.last = ptr
+			header.next = node
+			header.last = node
 		} else {
 			// link to last
 			if utils.Asserted {
 				if header.last.IsNull() {
 					panic("last is null")
 				}
-				if memory.PointerAs[stackNodeHeader](header.last).next.IsNotNull() {
+				if memory.PointerAs[stackNodeHeader](deref(header.last)).next.IsNotNull() {
 					panic("next node of last node is not null")
 				}
 			}
-			memory.PointerAs[stackNodeHeader](header.last).next = ptr
-			header.last = ptr
+			memory.PointerAs[stackNodeHeader](deref(header.last)).next = node
+			header.last = node
 		}
-		header.nextElementPtr = ptr + memory.Pointer(stackNodeHeaderSize)
+		header.nextElement = node + ref(stackNodeHeaderSize)
 		if utils.Debug {
 			fmt.Println("alloc stack node", ptr.String())
 		}
@@ -149,30 +166,78 @@ func (s Stack[T]) String() string {
 
 func (s Stack[T]) Free() {
 	if s.pointer().IsNotNull() {
+		checkDoubleFree(s.pointer())
 		if utils.Asserted {
 			if s.header().capacity == 0 {
 				panic("double free?")
 			}
 		}
+		arena := arenaOf(s.header().arena)
 		pageSize := stackNodePageSize[T]()
-		next := s.header().next
+		next := deref(s.header().next)
 		for next.IsNotNull() {
-			nextNext := memory.PointerAs[stackNodeHeader](next).next
-			Global.freePointer(next, pageSize)
+			nextNext := deref(memory.PointerAs[stackNodeHeader](next).next)
+			arena.freePointer(next, pageSize)
 			if utils.Debug {
 				fmt.Println("free stack node", next.String())
 			}
 			next = nextNext
 		}
-		Global.freePointer(s.pointer(), pageSize)
+		arena.freeObject(s.pointer(), s.header().headerPageHandler)
 		if utils.Debug {
 			fmt.Println("free stack header", s.pointer().String())
 		}
 	}
 }
 
+// Verify checks the links of nodes, the capacity they sum up to and where the next element goes. Nil for the null stack
+func (s Stack[T]) Verify() error {
+	if s.pointer().IsNull() {
+		return nil
+	}
+	header := s.header()
+	if header.length > header.capacity {
+		return memory.NewCorruptedError("stack %s has length %d > capacity %d", s.pointer().String(), header.length, header.capacity)
+	}
+	if err := verifyObject(header.arena, s.pointer(), header.headerPageHandler, stackHeaderSize+header.headerCapacity*memory.Sizeof[T]()); err != nil {
+		return err
+	}
+	nodeCapacity := ((stackNodePageSize[T]() << memory.BasePageSizeShiftNumber) - stackNodeHeaderSize) / memory.Sizeof[T]()
+	if header.capacity < header.headerCapacity || (header.capacity-header.headerCapacity)%nodeCapacity != 0 {
+		return memory.NewCorruptedError("stack %s has capacity %d but %d in the header node and %d in others",
+			s.pointer().String(), header.capacity, header.headerCapacity, nodeCapacity)
+	}
+	nodeNumber := (header.capacity - header.headerCapacity) / nodeCapacity
+	last, lastBase := nullRef, s.pointer()+memory.Pointer(stackHeaderSize)
+	node := header.next
+	for i := SizeType(0); i < nodeNumber; i++ {
+		if node.IsNull() {
+			return memory.NewCorruptedError("stack %s has %d nodes but %d by its capacity", s.pointer().String(), i, nodeNumber)
+		}
+		last, lastBase = node, deref(node)+memory.Pointer(stackNodeHeaderSize)
+		node = memory.PointerAs[stackNodeHeader](deref(node)).next
+	}
+	if node.IsNotNull() || header.last != last {
+		return memory.NewCorruptedError("stack %s has more than %d nodes or its last node is not %s", s.pointer().String(), nodeNumber, deref(header.last).String())
+	}
+	// the next element is in the last node
+	lastCapacity := header.headerCapacity
+	if nodeNumber > 0 {
+		lastCapacity = nodeCapacity
+	}
+	if header.length < header.capacity-lastCapacity {
+		return memory.NewCorruptedError("stack %s with length %d has an empty node", s.pointer().String(), header.length)
+	}
+	next := lastBase + memory.Pointer((header.length-(header.capacity-lastCapacity))*memory.Sizeof[T]())
+	if deref(header.nextElement) != next {
+		return memory.NewCorruptedError("next element of stack %s with length %d is at %s instead of %s",
+			s.pointer().String(), header.length, deref(header.nextElement).String(), next.String())
+	}
+	return nil
+}
+
 func (s Stack[T]) pointer() memory.Pointer {
-	return memory.Pointer(s)
+	return deref(ref(s))
 }
 
 func (s Stack[T]) header() *stackHeader {
@@ -186,16 +251,19 @@ func (s Stack[T]) header() *stackHeader {
 
 // stackHeader is the first node
 type stackHeader struct {
-	length         SizeType       // total element number in the stack
-	capacity       SizeType       // full check
-	next           memory.Pointer // null for tail
-	last           memory.Pointer // point to last node for quick enstack
-	nextElementPtr memory.Pointer // insert enstackd element
+	length            SizeType           // total element number in the stack
+	capacity          SizeType           // full check
+	next              ref                // null for tail
+	last              ref                // point to last node for quick enstack
+	nextElement       ref                // insert enstackd element
+	headerCapacity    SizeType           // element capacity of the header node
+	headerPageHandler memory.PageHandler // for freeObject
+	arena             arenaID            // the arena allocating it
 }
 
 // nodeHeader is the following node
 type stackNodeHeader struct {
-	next memory.Pointer // null for tail
+	next ref // null for tail
 }
 
 var stackHeaderSize = memory.Sizeof[stackHeader]()
@@ -22,9 +22,9 @@ func (s Stack[T]) Iterator() (iter StackIterator[T]) {
 	} else {
 		header := memory.PointerAs[stackHeader](ptr)
 		iter.cur = ptr + memory.Pointer(stackHeaderSize) - memory.Pointer(memory.Sizeof[T]()) // -1
-		iter.nextNode = header.next
+		iter.nextNode = deref(header.next)
 		iter.index = SizeTypeMax // -1
-		iter.nodeLength = ((stackNodePageSize[T]() << memory.BasePageSizeShiftNumber) - stackHeaderSize) / memory.Sizeof[T]()
+		iter.nodeLength = header.headerCapacity
 		iter.length = header.length
 	}
 	return
@@ -37,7 +37,7 @@ func (it *StackIterator[T]) Next() bool {
 		} else {
 			nextNodeHeader := memory.PointerAs[stackNodeHeader](it.nextNode)
 			it.cur = it.nextNode + memory.Pointer(stackNodeHeaderSize)
-			it.nextNode = nextNodeHeader.next
+			it.nextNode = deref(nextNodeHeader.next)
 			it.index++
 			it.nodeLength = ((stackNodePageSize[T]()<<memory.BasePageSizeShiftNumber)-stackNodeHeaderSize)/memory.Sizeof[T]() - 1
 			if utils.Asserted {
@@ -85,7 +85,7 @@ func (s Stack[T]) Iterate(iter func(T)) {
 
 		var index SizeType = 0
 		cursor := s.pointer() + memory.Pointer(stackHeaderSize)
-		nodeCap := ((pageSize << memory.BasePageSizeShiftNumber) - stackHeaderSize) / memory.Sizeof[T]()
+		nodeCap := header.headerCapacity
 
 		for index < length {
 			iter(*memory.PointerAs[T](cursor))
@@ -97,7 +97,7 @@ func (s Stack[T]) Iterate(iter func(T)) {
 			}
 		}
 
-		next := header.next
+		next := deref(header.next)
 		for next.IsNotNull() {
 			cursor = next + memory.Pointer(stackNodeHeaderSize)
 			nodeCap = ((pageSize << memory.BasePageSizeShiftNumber) - stackNodeHeaderSize) / memory.Sizeof[T]()
@@ -110,7 +110,7 @@ func (s Stack[T]) Iterate(iter func(T)) {
 					break
 				}
 			}
-			next = memory.PointerAs[stackNodeHeader](next).next
+			next = deref(memory.PointerAs[stackNodeHeader](next).next)
 		}
 	}
 }
@@ -20,7 +20,7 @@ func TestStack_Push(t *testing.T) {
 	for i := 0; i < 10; i++ {
 		utils.PanicErr(stack.Push([8]int{i}))
 		header := stack.header()
-		t.Log(header.length, header.capacity, header.next, header.last, header.nextElementPtr)
+		t.Log(header.length, header.capacity, header.next, header.last, header.nextElement)
 	}
 	stack.Free()
 
@@ -157,7 +157,7 @@ func BenchmarkSliceAppend(b *testing.B) {
 	for i := 0; i < b.N; i++ {
 		var ss Slice[int]
 		for k := 0; k < 100*100*100; k++ {
-			utils.PanicErr(ss.Append(k)) // 4252713 ns/op
+			utils.PanicErr(ss.Append(k)) // 4252713 ns/op. About 1.4x with the relocatable tag
 		}
 		ss.Free()
 	}
@@ -172,7 +172,7 @@ func BenchmarkStackAppend(b *testing.B) {
 	for i := 0; i < b.N; i++ {
 		var s Stack[int] = nullStack
 		for k := 0; k < 100*100*100; k++ {
-			utils.PanicErr(s.Push(k)) // 5489071 ns/op
+			utils.PanicErr(s.Push(k)) // 5489071 ns/op. About 1.7x with the relocatable tag
 		}
 		s.Free()
 	}
@@ -180,3 +180,27 @@ func BenchmarkStackAppend(b *testing.B) {
 
 	Global.Free()
 }
+
+func TestStack_SmallHeader(t *testing.T) {
+	Global.Init(1 * memory2.MB)
+	defer Global.Free()
+
+	var stack Stack[int]
+	defer func() { stack.Free() }()
+	utils.PanicErr(stack.Push(0))
+	utils.Assert(stack.header().headerPageHandler == memory2.SmallObjectPageHandler)
+	utils.Assert(stack.header().headerCapacity == (memory2.MaxSmallObjectSize-stackHeaderSize)/8, stack.header().headerCapacity)
+	for i := 1; i < 100; i++ {
+		utils.PanicErr(stack.Push(i))
+	}
+
+	iter := stack.Iterator()
+	for iter.Next() {
+		utils.Assert(iter.Value() == int(iter.Index()), iter.Value(), iter.Index())
+	}
+	gs := stack.ToGoSlice()
+	utils.Assert(len(gs) == 100, len(gs))
+	for i, e := range gs {
+		utils.Assert(i == e, i, e)
+	}
+}
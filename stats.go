@@ -0,0 +1,160 @@
+package direct
+
+import (
+	"bufio"
+	"fmt"
+	"github.com/madokast/direct/memory"
+	"io"
+	"sort"
+	"strings"
+)
+
+// Stats is a snapshot of the statistics of an arena. See memory.Stats
+type Stats = memory.Stats
+
+// Stats collects statistics of the arena and bytes cached in its local memories, locals then extra locals by M id.
+// Thread-safe. A budget returns the stats of its parent
+func (a *Arena) Stats() Stats {
+	if a.parent != nil {
+		return a.parent.Stats()
+	}
+	stats := a.memory.Stats()
+	stats.LocalCachedSizes = make([]SizeType, 0, len(a.locals))
+	for i := range a.locals {
+		stats.LocalCachedSizes = append(stats.LocalCachedSizes, a.locals[i].CachedSize())
+	}
+	a.extraLocalsMu.Lock()
+	mids := make([]int64, 0, len(a.extraLocals))
+	for mid := range a.extraLocals {
+		mids = append(mids, mid)
+	}
+	sort.Slice(mids, func(i, j int) bool { return mids[i] < mids[j] })
+	for _, mid := range mids {
+		stats.LocalCachedSizes = append(stats.LocalCachedSizes, a.extraLocals[mid].CachedSize())
+	}
+	a.extraLocalsMu.Unlock()
+	stats.SoftLimit = a.pressure.softLimit
+	stats.OverSoftLimit = stats.SoftLimit > 0 && stats.AllocatedSize > stats.SoftLimit
+	return stats
+}
+
+type prometheusSample struct {
+	labels string
+	value  SizeType
+}
+
+type prometheusMetric struct {
+	name    string
+	help    string
+	_type   string
+	samples func(arena string, a *Arena, stats *Stats) []prometheusSample
+}
+
+func singleSample(value func(stats *Stats) SizeType) func(string, *Arena, *Stats) []prometheusSample {
+	return func(arena string, _ *Arena, stats *Stats) []prometheusSample {
+		return []prometheusSample{{labels: arena, value: value(stats)}}
+	}
+}
+
+var prometheusMetrics = []prometheusMetric{
+	{"direct_total_bytes", "Size of all pages of the arena.", "gauge",
+		singleSample(func(stats *Stats) SizeType { return stats.TotalSize })},
+	{"direct_committed_bytes", "Accessible size of the arena.", "gauge",
+		singleSample(func(stats *Stats) SizeType { return stats.CommittedSize })},
+	{"direct_allocated_bytes", "Allocated size including memory cached in local memories.", "gauge",
+		singleSample(func(stats *Stats) SizeType { return stats.AllocatedSize })},
+	{"direct_free_bytes", "Free size of the arena.", "gauge",
+		singleSample(func(stats *Stats) SizeType { return stats.FreeSize })},
+	{"direct_largest_free_bytes", "Size of the largest free run.", "gauge",
+		singleSample(func(stats *Stats) SizeType { return stats.LargestFreeSize })},
+	{"direct_scavenged_bytes_total", "Size returned to the OS.", "counter",
+		singleSample(func(stats *Stats) SizeType { return stats.ScavengedSize })},
+	{"direct_free_runs", "Length of the free list of runs having [2^class, 2^(class+1)) pages.", "gauge",
+		func(arena string, _ *Arena, stats *Stats) (samples []prometheusSample) {
+			for class, number := range stats.FreedRunNumbers {
+				if number > 0 {
+					samples = append(samples, prometheusSample{fmt.Sprintf(`%s,class="%d"`, arena, class), number})
+				}
+			}
+			return
+		}},
+	{"direct_local_cached_bytes", "Size cached in a local memory.", "gauge",
+		func(arena string, _ *Arena, stats *Stats) (samples []prometheusSample) {
+			for local, size := range stats.LocalCachedSizes {
+				samples = append(samples, prometheusSample{fmt.Sprintf(`%s,local="%d"`, arena, local), size})
+			}
+			return
+		}},
+	{"direct_live_objects", "Live objects by type. Only if the arena is traced.", "gauge",
+		func(arena string, _ *Arena, stats *Stats) (samples []prometheusSample) {
+			for _type, number := range stats.LiveObjects {
+				samples = append(samples, prometheusSample{fmt.Sprintf(`%s,type="%s"`, arena, escapeLabel(string(_type))), number})
+			}
+			sort.Slice(samples, func(i, j int) bool { return samples[i].labels < samples[j].labels })
+			return
+		}},
+	{"direct_soft_limit_bytes", "Soft limit of the arena. 0 for none.", "gauge",
+		singleSample(func(stats *Stats) SizeType { return stats.SoftLimit })},
+	{"direct_over_soft_limit", "1 if more than the soft limit is allocated.", "gauge",
+		singleSample(func(stats *Stats) SizeType {
+			if stats.OverSoftLimit {
+				return 1
+			}
+			return 0
+		})},
+	{"direct_huge_page_backed_bytes", "Size backed by huge pages.", "gauge",
+		singleSample(func(stats *Stats) SizeType { return stats.HugePageBacked })},
+	{"direct_budget_used_bytes", "Size taken by a budget.", "gauge",
+		func(arena string, a *Arena, _ *Stats) []prometheusSample {
+			if a.budget == nil {
+				return nil
+			}
+			return []prometheusSample{{fmt.Sprintf(`%s,budget="%s"`, arena, escapeLabel(a.budget.name)), a.BudgetUsed()}}
+		}},
+	{"direct_budget_limit_bytes", "Limit of a budget.", "gauge",
+		func(arena string, a *Arena, _ *Stats) []prometheusSample {
+			if a.budget == nil {
+				return nil
+			}
+			return []prometheusSample{{fmt.Sprintf(`%s,budget="%s"`, arena, escapeLabel(a.budget.name)), a.budget.limit}}
+		}},
+}
+
+// WritePrometheus writes statistics of the arenas in the Prometheus text format, labeled by arena id.
+// Budgets write their usage labeled by the id of the parent
+func WritePrometheus(w io.Writer, arenas ...*Arena) error {
+	stats := make([]Stats, len(arenas))
+	labels := make([]string, len(arenas))
+	for i, a := range arenas {
+		owner := a
+		if a.parent != nil {
+			owner = a.parent
+		} else {
+			stats[i] = a.Stats()
+		}
+		labels[i] = fmt.Sprintf(`arena="%d"`, owner.id)
+	}
+
+	bw := bufio.NewWriter(w)
+	for _, metric := range prometheusMetrics {
+		headed := false
+		for i, a := range arenas {
+			if a.parent != nil && !strings.HasPrefix(metric.name, "direct_budget_") {
+				continue
+			}
+			for _, sample := range metric.samples(labels[i], a, &stats[i]) {
+				if !headed {
+					_, _ = fmt.Fprintf(bw, "# HELP %s %s\n# TYPE %s %s\n", metric.name, metric.help, metric.name, metric._type)
+					headed = true
+				}
+				_, _ = fmt.Fprintf(bw, "%s{%s} %d\n", metric.name, sample.labels, sample.value)
+			}
+		}
+	}
+	return bw.Flush()
+}
+
+// escapeLabel escapes a label value of the Prometheus text format
+func escapeLabel(value string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(value)
+}
@@ -0,0 +1,51 @@
+package direct
+
+import (
+	"bytes"
+	"github.com/madokast/direct/memory"
+	"github.com/madokast/direct/memory/trace_type"
+	"github.com/madokast/direct/utils"
+	"strings"
+	"testing"
+)
+
+func TestArena_Stats(t *testing.T) {
+	arena := NewArena(16 * memory.MB)
+	defer arena.Free()
+	s := utils.PanicErr1(MakeSliceIn[int](arena, 1024))
+	stats := arena.Stats()
+	utils.Assert(len(stats.LocalCachedSizes) >= len(arena.locals), stats.LocalCachedSizes)
+	var cached SizeType = 0
+	for _, size := range stats.LocalCachedSizes {
+		cached += size
+	}
+	utils.Assert(cached > 0 && cached+8*memory.KB <= stats.AllocatedSize, cached, stats.AllocatedSize)
+	if memory.Trace {
+		utils.Assert(stats.LiveObjects[trace_type.Slice] == 1, stats.LiveObjects)
+	} else {
+		utils.Assert(stats.LiveObjects == nil)
+	}
+	s.Free()
+}
+
+func TestWritePrometheus(t *testing.T) {
+	arena := NewArena(16 * memory.MB)
+	defer arena.Free()
+	cache := utils.PanicErr1(arena.NewBudget("cache", 1*memory.MB))
+	defer cache.Free()
+	s := utils.PanicErr1(MakeSliceIn[int](cache, 1024))
+	defer s.Free()
+
+	var buffer bytes.Buffer
+	utils.PanicErr(WritePrometheus(&buffer, arena, cache))
+	text := buffer.String()
+	t.Log(text)
+	utils.Assert(strings.Count(text, "# TYPE direct_allocated_bytes gauge\n") == 1, text)
+	utils.Assert(strings.Count(text, "direct_allocated_bytes{") == 1, text) // not repeated for the budget
+	utils.Assert(strings.Contains(text, `direct_local_cached_bytes{arena="`), text)
+	utils.Assert(strings.Contains(text, `direct_budget_limit_bytes{arena="`), text)
+	utils.Assert(strings.Contains(text, `,budget="cache"} 1048576`), text)
+	for _, line := range strings.Split(strings.TrimSpace(text), "\n") {
+		utils.Assert(strings.HasPrefix(line, "# ") || strings.HasPrefix(line, "direct_"), line)
+	}
+}
@@ -12,7 +12,7 @@ import (
 
 // String represents an un-modifiable string in managed_memory.
 type String struct {
-	ptr    memory.Pointer
+	ptr    ref // the first field like a go string
 	length SizeType
 	holder Slice[byte]
 }
@@ -28,6 +28,9 @@ func (s String) Length() SizeType {
 }
 
 func (s String) AsGoString() string {
+	if memory.Relocatable {
+		s.ptr = ref(deref(s.ptr)) // a go string holds the pointer
+	}
 	return *((*string)(unsafe.Pointer(&s)))
 }
 
@@ -51,18 +54,19 @@ func equalString[str any](s1, s2 str) bool {
 			panic(fmt.Sprintf("call equalString using non-string type s1=%v, s2=%v, type(s2)=%T", s1, s2, fmt.Sprintf("%T", s1)))
 		}
 	}
-	return *((*string)(unsafe.Pointer(&s1))) == *((*string)(unsafe.Pointer(&s2)))
+	return ((*String)(unsafe.Pointer(&s1))).AsGoString() == ((*String)(unsafe.Pointer(&s2))).AsGoString()
 }
 
 func (s String) Hashcode() (hash SizeType) {
 	hash = 2166136261
 	const prime32 = 16777619
+	ptr := deref(s.ptr)
 	i := SizeType(0)
 	for ; i < s.length; i++ {
 		hash *= prime32
-		//logger.Debug("at", fmt.Sprintf("%c", *PointerAs[byte](s.ptr)))
-		hash ^= SizeType(*memory.PointerAs[byte](s.ptr))
-		s.ptr++
+		//logger.Debug("at", fmt.Sprintf("%c", *PointerAs[byte](ptr)))
+		hash ^= SizeType(*memory.PointerAs[byte](ptr))
+		ptr++
 	}
 	return hash
 }
@@ -80,11 +84,21 @@ func (s String) String() string {
 	return s.CopyToGoString()
 }
 
-func (s String) Free() {
+// Free releases the string from its holder, freed when no string of it is left. The string is marked freed,
+// so freeing it again panics like Shared.Free. Freeing an empty string is ok
+func (s *String) Free() {
+	if s.ptr == 0 {
+		if s.holder == nullSlice {
+			return // free an empty string is ok
+		} else {
+			panic("double free string!")
+		}
+	}
 	if s.holder.pointer().IsNotNull() {
+		checkDoubleFree(s.holder.pointer())
 		header := s.holder.header()
-		cnt := atomic.AddInt32(memory.PointerAs[int32](header.elementBasePointer), -1)
-		if utils.Asserted {
+		cnt := atomic.AddInt32(memory.PointerAs[int32](header.elementBasePointer()), -1)
+		if utils.Asserted || freeChecked() {
 			if cnt < 0 {
 				panic(fmt.Sprintf("string holder cnt <(%d) 0", cnt))
 			}
@@ -96,6 +110,8 @@ func (s String) Free() {
 			s.holder.Free()
 		}
 	}
+	s.ptr = 0 // freed. The holder is kept
+	s.length = 0
 }
 
 func (s *String) Nove() (moved String) {
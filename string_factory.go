@@ -13,6 +13,7 @@ import (
 // StringFactory creates String. Thread-unsafe
 type StringFactory struct {
 	holder Slice[byte] // str-count + data
+	arena  *Arena      // nil for Global
 	noCopy utils.NoCopy
 }
 
@@ -22,6 +23,14 @@ func NewStringFactory() StringFactory {
 	}
 }
 
+// NewStringFactoryIn creates strings in the arena
+func NewStringFactoryIn(arena *Arena) StringFactory {
+	return StringFactory{
+		holder: nullSlice,
+		arena:  arena,
+	}
+}
+
 func (sf *StringFactory) CreateFromGoString(gs string) (s String, err error) {
 	var gsLength = SizeType(len(gs))
 	if gsLength == 0 {
@@ -33,7 +42,7 @@ func (sf *StringFactory) CreateFromGoString(gs string) (s String, err error) {
 	var sfHolderHeaderElementBasePointer = memory.NullPointer // register
 	if sfHolder != nullSlice {
 		sfHolderHeader = sfHolder.header()
-		sfHolderHeaderElementBasePointer = sfHolderHeader.elementBasePointer
+		sfHolderHeaderElementBasePointer = sfHolderHeader.elementBasePointer()
 		if sfHolderHeader.length+gsLength > sfHolderHeader.capacity {
 			if utils.Debug {
 				fmt.Printf("holder(len=%d, cap=%d) cannot add new string(len=%d)\n", sfHolderHeader.length, sfHolderHeader.capacity, gsLength)
@@ -53,14 +62,18 @@ func (sf *StringFactory) CreateFromGoString(gs string) (s String, err error) {
 	}
 	if sfHolder == nullSlice {
 		// int32 for count
-		sfHolder, err = makeSlice0[byte](gsLength+memory.Sizeof[int32](), trace_type.StringFactoryHolds(gs), 3)
+		arena := sf.arena
+		if arena == nil {
+			arena = Global
+		}
+		sfHolder, err = makeSlice0[byte](arena, gsLength+memory.Sizeof[int32](), trace_type.StringFactoryHolds(gs), 3)
 		if err != nil {
 			return emptyString, err
 		}
 		sf.holder = sfHolder
 		sfHolderHeader = sfHolder.header()
 		sfHolderHeader.length = memory.Sizeof[int32]()
-		sfHolderHeaderElementBasePointer = sfHolderHeader.elementBasePointer
+		sfHolderHeaderElementBasePointer = sfHolderHeader.elementBasePointer()
 		// ref cnt 1 for the factory
 		*memory.PointerAs[int32](sfHolderHeaderElementBasePointer) = 1
 	}
@@ -83,9 +96,9 @@ func (sf *StringFactory) CreateFromGoString(gs string) (s String, err error) {
 
 	s.holder = sfHolder
 	s.length = gsLength
-	s.ptr = sfHolderHeaderElementBasePointer + memory.Pointer(sfHolderHeader.length)
+	s.ptr = sfHolderHeader.elementBase + ref(sfHolderHeader.length)
 
-	memory.LibMemMove(s.ptr, memory.Pointer((*reflect.StringHeader)(unsafe.Pointer(&gs)).Data), gsLength)
+	sfHolder.arena().memory.MoveBytes(sfHolderHeaderElementBasePointer+memory.Pointer(sfHolderHeader.length), memory.Pointer((*reflect.StringHeader)(unsafe.Pointer(&gs)).Data), gsLength)
 	sfHolderHeader.length += s.length
 
 	// add count
@@ -99,7 +112,7 @@ func (sf *StringFactory) CreateFromGoString(gs string) (s String, err error) {
 func (sf *StringFactory) Destroy() {
 	holder := sf.holder
 	if holder != nullSlice {
-		cnt := atomic.AddInt32(memory.PointerAs[int32](holder.header().elementBasePointer), -1)
+		cnt := atomic.AddInt32(memory.PointerAs[int32](holder.header().elementBasePointer()), -1)
 		if utils.Asserted {
 			if cnt < 0 {
 				panic(fmt.Sprintf("string holder cnt(%d) < 0", cnt))
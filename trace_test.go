@@ -302,3 +302,30 @@ func Test_StackPushMore(t *testing.T) {
 	}
 	Global.Free()
 }
+
+func TestWithTrace(t *testing.T) {
+	arena := NewArena(1*memory.MB, WithTrace(true))
+	utils.Assert(arena.Traced())
+	cache := utils.PanicErr1(arena.NewBudget("cache", 1*memory.MB))
+	_, file, line, _ := runtime.Caller(0)
+	s := utils.PanicErr1(MakeSliceIn[int](cache, 10))
+	m := utils.PanicErr1(MakeMapIn[int, int](arena, 10))
+	stack := utils.PanicErr1(MakeStackIn[int](arena))
+	utils.PanicErr(stack.Push(1))
+	utils.Assert(arena.IsMemoryLeak())
+	info := arena.MemoryLeakInfo()
+	utils.Assert(strings.Contains(info, fmt.Sprintf("allocated at %s:%d", file, line+1)), info)
+	utils.Assert(strings.Contains(info, "type:Map"), info)
+	s.Free()
+	m.Free()
+	stack.Free()
+	utils.Assert(!arena.IsMemoryLeak(), arena.MemoryLeakInfo())
+	cache.Free()
+	arena.Free()
+
+	arena = NewArena(1*memory.MB, WithTrace(false))
+	utils.Assert(!arena.Traced() && arena.memory.Tracer() == nil)
+	s = utils.PanicErr1(MakeSliceIn[int](arena, 10))
+	s.Free()
+	arena.Free()
+}
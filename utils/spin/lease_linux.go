@@ -0,0 +1,36 @@
+//go:build linux
+
+package spin
+
+import (
+	"syscall"
+	"unsafe"
+)
+
+// open file description locks, owned by the file description instead of the process
+const (
+	fOfdGetLk = 36
+	fOfdSetLk = 37
+)
+
+// lease takes a read lock at the offset, the token of this process, in the file. Readers do not conflict
+func lease(fd uintptr, offset uintptr) error {
+	return ofdLock(fd, fOfdSetLk, &syscall.Flock_t{Type: syscall.F_RDLCK, Start: int64(offset), Len: 1})
+}
+
+// leased tells whether another file description holds the lease at the offset. Failing to check is alive
+func leased(fd uintptr, offset uintptr) bool {
+	flock := syscall.Flock_t{Type: syscall.F_WRLCK, Start: int64(offset), Len: 1}
+	if ofdLock(fd, fOfdGetLk, &flock) != nil {
+		return true
+	}
+	return flock.Type != syscall.F_UNLCK
+}
+
+// ofdLock never blocks, so it is a raw syscall, which may be made when preemption is disabled
+func ofdLock(fd uintptr, cmd uintptr, flock *syscall.Flock_t) error {
+	if _, _, errno := syscall.RawSyscall(syscall.SYS_FCNTL, fd, cmd, uintptr(unsafe.Pointer(flock))); errno != 0 {
+		return errno
+	}
+	return nil
+}
@@ -0,0 +1,12 @@
+//go:build !linux
+
+package spin
+
+// lease is not supported, so holders are always alive and locks are never taken over
+func lease(uintptr, uintptr) error {
+	return nil
+}
+
+func leased(uintptr, uintptr) bool {
+	return true
+}
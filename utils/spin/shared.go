@@ -0,0 +1,110 @@
+package spin
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"github.com/madokast/direct/utils"
+	"sync"
+	"sync/atomic"
+)
+
+/**
+A SharedMutex records the token of its holder, random for each process, so pids of other PID namespaces and reused pids
+do not matter. A process using the lock of a file-backed memory holds a lease, an OFD read lock at the offset of its token
+in the file, released by the kernel when the process dies. A holder without a lease is dead and its lock is taken over.
+The memory under a lock taken over may be half-updated, so TakenOver is set until the memory is verified.
+*/
+
+// SharedMutex is a Mutex safe between processes sharing its memory.
+// The lock held by a dead process can be taken over if the living ones hold leases. See Lease
+type SharedMutex struct {
+	holder    uintptr // token of the holder. 0 for unlock
+	takenOver uintptr // 1 if taken over from a dead holder. See TakenOver
+}
+
+const checkHolderSpins = 64 // check the holder is alive every checkHolderSpins spins
+
+const maxToken = 1 << 31 // tokens are offsets of leases in the file. Fits uintptr of 32-bit platforms
+
+// token of this process, in [1, maxToken)
+var token = newToken()
+
+func newToken() uintptr {
+	var bs [8]byte
+	if _, err := rand.Read(bs[:]); err != nil {
+		panic(err)
+	}
+	return uintptr(binary.LittleEndian.Uint64(bs[:])%(maxToken-1) + 1)
+}
+
+// leases maps locks to files leased by this process
+var leases = map[*SharedMutex]uintptr{}
+var leasesMu sync.Mutex
+
+// Lease makes the lock robust. The process holds a lease on the file fd of the memory of the lock until Release,
+// and checks holders of the lock by leases of theirs. The fd must not be closed before Release
+func (mu *SharedMutex) Lease(fd uintptr) error {
+	if err := lease(fd, token); err != nil {
+		return err
+	}
+	leasesMu.Lock()
+	leases[mu] = fd
+	leasesMu.Unlock()
+	return nil
+}
+
+// Release forgets the lease. Closing the file releases it
+func (mu *SharedMutex) Release() {
+	leasesMu.Lock()
+	delete(leases, mu)
+	leasesMu.Unlock()
+}
+
+func (mu *SharedMutex) Lock() {
+	for spins := 1; !atomic.CompareAndSwapUintptr(&mu.holder, unlock, token); spins++ {
+		if spins%checkHolderSpins == 0 {
+			holder := atomic.LoadUintptr(&mu.holder)
+			if holder != unlock && holder != token && !mu.holderAlive(holder) &&
+				atomic.CompareAndSwapUintptr(&mu.holder, holder, token) {
+				atomic.StoreUintptr(&mu.takenOver, 1)
+				return
+			}
+		}
+		keepRunning()
+	}
+}
+
+func (mu *SharedMutex) Unlock() {
+	if utils.Asserted {
+		if !atomic.CompareAndSwapUintptr(&mu.holder, token, unlock) {
+			panic("unlock a SharedMutex not locked by this process")
+		}
+		return
+	}
+	atomic.StoreUintptr(&mu.holder, unlock)
+}
+
+// Reset unlocks the lock of a memory no process uses now. It is taken over if it was locked
+func (mu *SharedMutex) Reset() {
+	if atomic.SwapUintptr(&mu.holder, unlock) != unlock {
+		atomic.StoreUintptr(&mu.takenOver, 1)
+	}
+}
+
+// TakenOver reports the lock was taken over from a dead holder, so what it guards may be half-updated
+func (mu *SharedMutex) TakenOver() bool {
+	return atomic.LoadUintptr(&mu.takenOver) != 0
+}
+
+// ClearTakenOver is called when what the lock guards is verified
+func (mu *SharedMutex) ClearTakenOver() {
+	atomic.StoreUintptr(&mu.takenOver, 0)
+}
+
+// holderAlive checks the lease of the holder. Alive if this process holds no lease to check by
+func (mu *SharedMutex) holderAlive(holder uintptr) bool {
+	leasesMu.Lock()
+	fd, ok := leases[mu]
+	leasesMu.Unlock()
+	return !ok || leased(fd, holder)
+}
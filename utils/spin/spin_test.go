@@ -1,8 +1,11 @@
 package spin
 
 import (
+	"os"
+	"runtime"
 	"sync"
 	"testing"
+	"time"
 )
 
 func BenchmarkKeepRun(b *testing.B) {
@@ -55,3 +58,90 @@ func TestMutex_Lock2(t *testing.T) {
 		t.Fail()
 	}
 }
+
+func TestSharedMutex_Lock(t *testing.T) {
+	var mu SharedMutex
+	var s int
+	var wg sync.WaitGroup
+	for i := 0; i < 100; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for k := 0; k < 1000; k++ {
+				mu.Lock()
+				s += 1
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	if s != 100*1000 {
+		t.Fatal(s)
+	}
+}
+
+func TestSharedMutex_deadHolder(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("leases are only supported on linux")
+	}
+	file, err := os.CreateTemp(t.TempDir(), "lock")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = file.Close() }()
+	var mu SharedMutex
+	if err = mu.Lease(file.Fd()); err != nil {
+		t.Fatal(err)
+	}
+	defer mu.Release()
+
+	// a holder alive in another process, or in any PID namespace, holds its lease by another file description
+	other, err := os.OpenFile(file.Name(), os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherToken := token%(maxToken-1) + 1
+	if err = lease(other.Fd(), otherToken); err != nil {
+		t.Fatal(err)
+	}
+	mu.holder = otherToken
+	locked := make(chan struct{})
+	go func() {
+		mu.Lock()
+		close(locked)
+	}()
+	select {
+	case <-locked:
+		t.Fatal("lock of a living holder is taken over")
+	case <-time.After(100 * time.Millisecond):
+	}
+	if mu.TakenOver() {
+		t.Fatal("taken over")
+	}
+
+	_ = other.Close() // dies
+	<-locked
+	if mu.holder != token || !mu.TakenOver() {
+		t.Fatal(mu.holder, mu.takenOver)
+	}
+	mu.Unlock()
+	mu.ClearTakenOver()
+	mu.Lock()
+	if mu.TakenOver() {
+		t.Fatal("taken over")
+	}
+	mu.Unlock()
+}
+
+func TestSharedMutex_Reset(t *testing.T) {
+	var mu SharedMutex
+	mu.Reset()
+	if mu.TakenOver() {
+		t.Fatal("reset an unlocked lock")
+	}
+	mu.Lock()
+	mu.Reset() // the process crashed holding it
+	if !mu.TakenOver() || mu.holder != unlock {
+		t.Fatal(mu.holder, mu.takenOver)
+	}
+}
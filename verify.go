@@ -0,0 +1,54 @@
+package direct
+
+import (
+	"github.com/madokast/direct/memory"
+)
+
+// CorruptedError is returned by Verify with the first violated invariant found. See memory.Memory.Verify
+type CorruptedError = memory.CorruptedError
+
+// Verify checks the invariants of the memory of the arena, including pages and objects cached in its local memories.
+// Nil if consistent. No goroutine should use the arena meanwhile. A budget verifies its parent
+func (a *Arena) Verify() error {
+	if a.parent != nil {
+		return a.parent.Verify()
+	}
+	locals := make([]*memory.LocalMemory, 0, len(a.locals))
+	for i := range a.locals {
+		locals = append(locals, &a.locals[i])
+	}
+	a.extraLocalsMu.Lock()
+	for mid := range a.extraLocals {
+		locals = append(locals, a.extraLocals[mid])
+	}
+	a.extraLocalsMu.Unlock()
+	return a.memory.Verify(locals...)
+}
+
+// NeedsVerify reports a process died holding the lock of the memory of a shared or file-backed arena. See memory.Memory.NeedsVerify
+func (a *Arena) NeedsVerify() bool {
+	return a.memory.NeedsVerify()
+}
+
+// verifyObject checks the object at ptr from allocObject of the arena holds byteSize bytes
+func verifyObject(id arenaID, ptr memory.Pointer, pageHandler memory.PageHandler, byteSize SizeType) error {
+	if id >= maxArenaNumber {
+		return memory.NewCorruptedError("object %s of arena %d out of %d arenas", ptr.String(), id, maxArenaNumber)
+	}
+	a := arenas[id].Load()
+	if a == nil || a.memory.IsNull() {
+		return memory.NewCorruptedError("object %s of arena %d which is freed", ptr.String(), id)
+	}
+	var size SizeType
+	if pageHandler == memory.SmallObjectPageHandler {
+		size = a.memory.SmallObjectSizeOf(ptr)
+	} else if pageHandler.IsNull() || a.memory.PagePointerOf(pageHandler) != ptr {
+		return memory.NewCorruptedError("object %s is not at its page %s", ptr.String(), pageHandler.String())
+	} else {
+		size = pageHandler.Size()
+	}
+	if byteSize > size {
+		return memory.NewCorruptedError("object %s of %d bytes is allocated %d bytes", ptr.String(), byteSize, size)
+	}
+	return nil
+}
@@ -0,0 +1,57 @@
+package direct
+
+import (
+	"errors"
+	"github.com/madokast/direct/memory"
+	"github.com/madokast/direct/utils"
+	"math/rand"
+	"testing"
+)
+
+func TestArena_Verify(t *testing.T) {
+	arena := NewArena(64 * memory.MB)
+	defer arena.Free()
+	utils.PanicErr(arena.Verify())
+
+	s := utils.PanicErr1(MakeSliceIn[int](arena, 10))
+	m := utils.PanicErr1(MakeMapIn[int, int](arena, 10))
+	st := utils.PanicErr1(MakeStackIn[[100]int](arena))
+	for i := 0; i < 10000; i++ {
+		utils.PanicErr(s.Append(i))
+		utils.PanicErr(m.Put(rand.Intn(5000), i))
+		if rand.Intn(4) == 0 {
+			m.Delete(rand.Intn(5000))
+		}
+		utils.PanicErr(st.Push([100]int{i}))
+	}
+	utils.PanicErr(s.Verify())
+	utils.PanicErr(m.Verify())
+	utils.PanicErr(st.Verify())
+	small := utils.PanicErr1(MakeStackIn[int](arena)) // in the header node only
+	utils.PanicErr(small.Push(1))
+	utils.PanicErr(small.Verify())
+	small.Free()
+	utils.PanicErr(arena.Verify())
+
+	var corruptedError *CorruptedError
+	s.header().length = s.Capacity() + 1
+	utils.Assert(errors.As(s.Verify(), &corruptedError))
+	s.header().length = s.Capacity()
+
+	m.header().count++
+	utils.Assert(errors.As(m.Verify(), &corruptedError))
+	m.header().count--
+
+	last := st.header().last
+	st.header().last = st.header().next
+	utils.Assert(errors.As(st.Verify(), &corruptedError))
+	st.header().last = last
+	utils.PanicErr(st.Verify())
+
+	s.Free()
+	m.Free()
+	st.Free()
+	utils.PanicErr(arena.Verify())
+	var null Map[int, int]
+	utils.PanicErr(null.Verify())
+}
@@ -0,0 +1,158 @@
+package direct
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/madokast/direct/memory/trace_type"
+	"sync"
+	"sync/atomic"
+)
+
+/**
+Ctx variants of constructors and growing methods wait instead of failing when the arena is exhausted,
+giving backpressure between goroutines sharing an arena.
+A waiter retries after any free of the arena, until the allocation succeeds or the context is done.
+While anyone waits, a free also flushes the local memory of the freeing thread, so freed pages are not kept out of reach.
+An allocation larger than the arena, or than the limit of a budget, fails at once.
+*/
+
+type allocWaiters struct {
+	number atomic.Int32 // goroutines waiting. A free checks it only
+	mu     sync.Mutex
+	freed  chan struct{} // closed on free
+}
+
+// wait registers a waiter. The returned channel is closed by a free after it
+func (w *allocWaiters) wait() <-chan struct{} {
+	w.number.Add(1)
+	w.mu.Lock()
+	if w.freed == nil {
+		w.freed = make(chan struct{})
+	}
+	freed := w.freed
+	w.mu.Unlock()
+	return freed
+}
+
+func (w *allocWaiters) done() {
+	w.number.Add(-1)
+}
+
+func (w *allocWaiters) waiting() bool {
+	return w.number.Load() > 0
+}
+
+// wake wakes all waiters to retry
+func (w *allocWaiters) wake() {
+	w.mu.Lock()
+	if w.freed != nil {
+		close(w.freed)
+		w.freed = nil
+	}
+	w.mu.Unlock()
+}
+
+// waitAlloc calls alloc until it succeeds, fails not for exhaustion of the arena, or ctx is done
+func waitAlloc[R any](ctx context.Context, arena *Arena, alloc func() (R, error)) (R, error) {
+	waiters := arena.waiters
+	for {
+		freed := waiters.wait()
+		r, err := alloc()
+		if err == nil || !arena.satisfiable(err) {
+			waiters.done()
+			return r, err
+		}
+		select {
+		case <-freed:
+			waiters.done()
+		case <-ctx.Done():
+			waiters.done()
+			return r, fmt.Errorf("%w when waiting for memory: %s", ctx.Err(), err.Error())
+		}
+	}
+}
+
+// satisfiable reports err is for exhaustion, and waiting for frees may satisfy the allocation
+func (a *Arena) satisfiable(err error) bool {
+	var oom *OOMError
+	if errors.As(err, &oom) {
+		return oom.Size() <= a.memory.TotalSize()
+	}
+	var quotaExceeded *QuotaExceededError
+	if errors.As(err, &quotaExceeded) {
+		return quotaExceeded.size <= quotaExceeded.limit
+	}
+	return false
+}
+
+// MakeSliceCtx is MakeSlice waiting while Global is exhausted. See MakeSliceCtxIn
+func MakeSliceCtx[T any](ctx context.Context, elementCapacity SizeType) (Slice[T], error) {
+	return waitAlloc(ctx, Global, func() (Slice[T], error) {
+		return makeSlice0[T](Global, elementCapacity, trace_type.Slice, 5)
+	})
+}
+
+// MakeSliceCtxIn is MakeSliceIn waiting while the arena is exhausted, until the context is done
+func MakeSliceCtxIn[T any](ctx context.Context, arena *Arena, elementCapacity SizeType) (Slice[T], error) {
+	return waitAlloc(ctx, arena, func() (Slice[T], error) {
+		return makeSlice0[T](arena, elementCapacity, trace_type.Slice, 5)
+	})
+}
+
+// AppendCtx is Append waiting while the arena of the slice is exhausted
+func (s *Slice[T]) AppendCtx(ctx context.Context, val T) error {
+	_, err := waitAlloc(ctx, s.arena(), func() (struct{}, error) {
+		return struct{}{}, s.Append(val)
+	})
+	return err
+}
+
+// MakeMapCtx is MakeMap waiting while Global is exhausted
+func MakeMapCtx[Key comparable, Value any](ctx context.Context, capacity SizeType) (Map[Key, Value], error) {
+	return waitAlloc(ctx, Global, func() (Map[Key, Value], error) {
+		return makeMap0[Key, Value](Global, capacity, 6)
+	})
+}
+
+// MakeMapCtxIn is MakeMapIn waiting while the arena is exhausted
+func MakeMapCtxIn[Key comparable, Value any](ctx context.Context, arena *Arena, capacity SizeType) (Map[Key, Value], error) {
+	return waitAlloc(ctx, arena, func() (Map[Key, Value], error) {
+		return makeMap0[Key, Value](arena, capacity, 6)
+	})
+}
+
+// PutCtx is Put waiting while the arena of the map is exhausted
+func (m Map[Key, Value]) PutCtx(ctx context.Context, k Key, v Value) error {
+	_, err := waitAlloc(ctx, arenaOf(m.header().arena), func() (struct{}, error) {
+		return struct{}{}, m.Put(k, v)
+	})
+	return err
+}
+
+// MakeStackCtxIn is MakeStackIn waiting while the arena is exhausted
+func MakeStackCtxIn[T any](ctx context.Context, arena *Arena) (Stack[T], error) {
+	return waitAlloc(ctx, arena, func() (Stack[T], error) {
+		return makeStack0[T](arena, 5)
+	})
+}
+
+// PushCtx is Push waiting while the arena of the stack is exhausted
+func (s *Stack[T]) PushCtx(ctx context.Context, val T) error {
+	arena := Global
+	if s.pointer().IsNotNull() {
+		arena = arenaOf(s.header().arena)
+	}
+	_, err := waitAlloc(ctx, arena, func() (struct{}, error) {
+		return struct{}{}, s.Push(val)
+	})
+	return err
+}
+
+// arena allocating the slice. Global for the null slice
+func (s Slice[T]) arena() *Arena {
+	if s.pointer().IsNull() {
+		return Global
+	}
+	return arenaOf(s.header().arena)
+}
@@ -0,0 +1,99 @@
+package direct
+
+import (
+	"context"
+	"errors"
+	"github.com/madokast/direct/memory"
+	"github.com/madokast/direct/utils"
+	"testing"
+	"time"
+)
+
+// fill allocates slices of size until OOM or the quota is exceeded
+func fill(arena *Arena, size SizeType) (slices []Slice[byte]) {
+	for {
+		s, err := MakeSliceIn[byte](arena, size)
+		if err != nil {
+			var oom *OOMError
+			var quotaExceeded *QuotaExceededError
+			utils.Assert(errors.As(err, &oom) || errors.As(err, &quotaExceeded), err)
+			return slices
+		}
+		slices = append(slices, s)
+	}
+}
+
+func TestMakeSliceCtxIn(t *testing.T) {
+	arena := NewArena(4 * memory.MB)
+	defer arena.Free()
+	slices := fill(arena, 64*memory.KB)
+
+	done := make(chan Slice[byte])
+	go func() {
+		s, err := MakeSliceCtxIn[byte](context.Background(), arena, 64*memory.KB)
+		utils.PanicErr(err)
+		done <- s
+	}()
+	for !arena.waiters.waiting() {
+		time.Sleep(time.Millisecond)
+	}
+	select {
+	case <-done:
+		panic("allocated in an exhausted arena")
+	case <-time.After(20 * time.Millisecond):
+	}
+	for _, s := range slices {
+		s.Free()
+	}
+	s := <-done
+	utils.Assert(s.Capacity() >= 64*memory.KB, s.Capacity())
+	s.Free()
+}
+
+func TestWaitAlloc_cancel(t *testing.T) {
+	arena := NewArena(4 * memory.MB)
+	defer arena.Free()
+	slices := fill(arena, 64*memory.KB)
+	defer func() {
+		for _, s := range slices {
+			s.Free()
+		}
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	_, err := MakeMapCtxIn[int, int](ctx, arena, 64*memory.KB)
+	utils.Assert(errors.Is(err, context.DeadlineExceeded), err)
+
+	// never satisfiable
+	start := time.Now()
+	_, err = MakeSliceCtxIn[byte](context.Background(), arena, 8*memory.MB)
+	var oom *OOMError
+	utils.Assert(errors.As(err, &oom) && time.Since(start) < time.Second, err)
+}
+
+func TestAppendCtx_budget(t *testing.T) {
+	arena := NewArena(16 * memory.MB)
+	defer arena.Free()
+	cache := utils.PanicErr1(arena.NewBudget("cache", 1*memory.MB))
+	defer cache.Free()
+	s := utils.PanicErr1(MakeSliceWithLengthIn[int](cache, 8*1024))
+	for s.Length() < s.Capacity() {
+		utils.PanicErr(s.Append(1))
+	}
+	slices := fill(cache, 16*memory.KB)
+
+	done := make(chan error)
+	go func() {
+		done <- s.AppendCtx(context.Background(), 2) // grows beyond the quota
+	}()
+	for !arena.waiters.waiting() {
+		time.Sleep(time.Millisecond)
+	}
+	for _, full := range slices {
+		full.Free()
+	}
+	utils.PanicErr(<-done)
+	utils.Assert(s.Get(s.Length()-1) == 2, s.Length())
+	s.Free()
+}